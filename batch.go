@@ -0,0 +1,195 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/collector"
+)
+
+const batchPath = "/snmp/batch"
+
+var (
+	batchUpDesc = prometheus.NewDesc(
+		"snmp_up",
+		"Whether the target of a batch scrape was scraped without errors.",
+		nil, nil,
+	)
+	batchDurationDesc = prometheus.NewDesc(
+		"snmp_target_scrape_duration_seconds",
+		"Time the scrape of the target of a batch scrape took.",
+		nil, nil,
+	)
+)
+
+// batchTarget is one target of a batch scrape, as posted in the request body.
+type batchTarget struct {
+	Target       string   `json:"target"`
+	Auth         string   `json:"auth,omitempty"`
+	Module       []string `json:"module,omitempty"`
+	Profile      string   `json:"profile,omitempty"`
+	SNMPContext  string   `json:"snmp_context,omitempty"`
+	SNMPEngineID string   `json:"snmp_engineid,omitempty"`
+}
+
+func (t batchTarget) query() url.Values {
+	query := url.Values{"target": {t.Target}}
+	if t.Auth != "" {
+		query.Set("auth", t.Auth)
+	}
+	if len(t.Module) > 0 {
+		query["module"] = t.Module
+	}
+	if t.Profile != "" {
+		query.Set("profile", t.Profile)
+	}
+	if t.SNMPContext != "" {
+		query.Set("snmp_context", t.SNMPContext)
+	}
+	if t.SNMPEngineID != "" {
+		query.Set("snmp_engineid", t.SNMPEngineID)
+	}
+	return query
+}
+
+// parseBatchRequest returns the targets of a batch scrape. A POST request
+// carries a JSON list of targets in its body, each with their own auth and
+// modules. Otherwise the 'target' parameter may be given multiple times, and
+// all targets share the other parameters.
+func parseBatchRequest(r *http.Request) ([]*scrapeRequest, error) {
+	var targets []url.Values
+	if r.Method == http.MethodPost {
+		var body []batchTarget
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			return nil, fmt.Errorf("error parsing batch request body: %w", err)
+		}
+		for _, t := range body {
+			targets = append(targets, t.query())
+		}
+	} else {
+		query := r.URL.Query()
+		for _, t := range query["target"] {
+			q := url.Values{}
+			for k, v := range query {
+				q[k] = v
+			}
+			q["target"] = []string{t}
+			targets = append(targets, q)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("batch request must contain at least one target")
+	}
+
+	seen := map[string]bool{}
+	reqs := make([]*scrapeRequest, 0, len(targets))
+	for _, t := range targets {
+		req, err := parseScrapeRequest(t)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", t.Get("target"), err)
+		}
+		if seen[req.target] {
+			return nil, fmt.Errorf("target %q must only be specified once", req.target)
+		}
+		seen[req.target] = true
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// batchCollector scrapes one target of a batch. Scrape errors are reported
+// through snmp_up instead of failing the whole batch, and the number of
+// targets scraped at the same time is bounded by sem.
+type batchCollector struct {
+	collector *collector.Collector
+	sem       chan struct{}
+	logger    *slog.Logger
+}
+
+// Describe implements Prometheus.Collector. It sends no descriptors, so that
+// the collector is unchecked.
+func (b batchCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements Prometheus.Collector.
+func (b batchCollector) Collect(ch chan<- prometheus.Metric) {
+	b.sem <- struct{}{}
+	defer func() { <-b.sem }()
+
+	start := time.Now()
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		b.collector.Collect(metrics)
+		close(metrics)
+	}()
+	up := 1.0
+	for m := range metrics {
+		if err := m.Write(&dto.Metric{}); err != nil {
+			b.logger.Info("Error scraping target", "err", err)
+			up = 0
+			continue
+		}
+		ch <- m
+	}
+	ch <- prometheus.MustNewConstMetric(batchUpDesc, prometheus.GaugeValue, up)
+	ch <- prometheus.MustNewConstMetric(batchDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds())
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, exporterMetrics collector.Metrics) {
+	debug := debugPackets(r.URL.Query(), logger)
+
+	reqs, err := parseBatchRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+	ctx, cancel, err := scrapeContext(r, *timeoutOffset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+	defer cancel()
+	for _, req := range reqs {
+		if err := req.loadSecrets(ctx); err != nil {
+			http.Error(w, fmt.Sprintf("target %q: %s", req.target, err), http.StatusInternalServerError)
+			snmpRequestErrors.Inc()
+			return
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	sem := make(chan struct{}, max(*batchConcurrency, 1))
+	for _, req := range reqs {
+		targetLogger := logger.With("auth", req.authName, "target", req.target)
+		c := req.collector(ctx, targetLogger, exporterMetrics, debug)
+		prometheus.WrapRegistererWith(prometheus.Labels{"instance": req.target}, registry).MustRegister(
+			batchCollector{collector: c, sem: sem, logger: targetLogger},
+		)
+	}
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	h.ServeHTTP(w, r)
+}
@@ -0,0 +1,155 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/collector"
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// useMockTargets makes scrapes query mock targets, which answer the get of
+// sysName and the walk of ifDescr, in place of targets on the network. The
+// target "unreachable" refuses connections.
+func useMockTargets(t *testing.T) {
+	newScraper := collector.NewScraper
+	t.Cleanup(func() { collector.NewScraper = newScraper })
+	collector.NewScraper = func(_ *slog.Logger, target, _ string, _ bool) (scraper.SNMPScraper, error) {
+		mock := scraper.NewMockSNMPScraper(
+			map[string]gosnmp.SnmpPDU{
+				"1.3.6.1.2.1.1.5.0": {Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.OctetString, Value: []byte(target)},
+			},
+			map[string][]gosnmp.SnmpPDU{
+				"1.3.6.1.2.1.2.2.1.2": {{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("eth0")}},
+			},
+		)
+		if target == "unreachable" {
+			mock.ConnectError = errors.New("connection refused")
+		}
+		return mock, nil
+	}
+}
+
+// testMetrics returns exporter metrics that are not registered anywhere.
+func testMetrics() collector.Metrics {
+	return collector.Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}),
+	}
+}
+
+func batchTestConfig() *SafeConfig {
+	system, ifMIB := config.DefaultModule, config.DefaultModule
+	system.Get = []string{"1.3.6.1.2.1.1.5.0"}
+	ifMIB.Walk = []string{"1.3.6.1.2.1.2.2.1.2"}
+	return &SafeConfig{
+		C: &config.Config{
+			Auths: map[string]*config.Auth{
+				"public_v2":  {Community: "public", SecurityLevel: "noAuthNoPriv", Version: 2},
+				"private_v2": {Community: "private", SecurityLevel: "noAuthNoPriv", Version: 2},
+			},
+			Modules: map[string]*config.Module{
+				"if_mib": &ifMIB,
+				"system": &system,
+			},
+		},
+	}
+}
+
+func TestParseBatchRequest(t *testing.T) {
+	sc = batchTestConfig()
+
+	req := httptest.NewRequest(http.MethodGet, "/snmp/batch?target=10.0.0.1&target=10.0.0.2&auth=private_v2&module=system", http.NoBody)
+	reqs, err := parseBatchRequest(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(reqs) != 2 || reqs[0].target != "10.0.0.1" || reqs[1].target != "10.0.0.2" {
+		t.Fatalf("Unexpected targets: %v", reqs)
+	}
+	for _, r := range reqs {
+		if r.authName != "private_v2" || len(r.modules) != 1 {
+			t.Errorf("Expected shared auth and module for %s, got %+v", r.target, r)
+		}
+	}
+
+	body := `[{"target": "10.0.0.1", "module": ["if_mib", "system"]}, {"target": "10.0.0.2", "auth": "private_v2", "snmp_context": "vrf-mgmt"}]`
+	req = httptest.NewRequest(http.MethodPost, "/snmp/batch", strings.NewReader(body))
+	reqs, err = parseBatchRequest(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(reqs))
+	}
+	if reqs[0].authName != "public_v2" || len(reqs[0].modules) != 2 {
+		t.Errorf("Unexpected first target: %+v", reqs[0])
+	}
+	if reqs[1].authName != "private_v2" || reqs[1].snmpContext != "vrf-mgmt" || len(reqs[1].modules) != 1 {
+		t.Errorf("Unexpected second target: %+v", reqs[1])
+	}
+
+	for _, c := range []struct {
+		name, method, url, body string
+	}{
+		{name: "no targets", method: http.MethodGet, url: "/snmp/batch"},
+		{name: "duplicate target", method: http.MethodGet, url: "/snmp/batch?target=10.0.0.1&target=10.0.0.1"},
+		{name: "unknown module", method: http.MethodPost, url: "/snmp/batch", body: `[{"target": "10.0.0.1", "module": ["nope"]}]`},
+		{name: "unknown field", method: http.MethodPost, url: "/snmp/batch", body: `[{"target": "10.0.0.1", "modules": ["if_mib"]}]`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.url, strings.NewReader(c.body))
+			if _, err := parseBatchRequest(req); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	sc = batchTestConfig()
+	useMockTargets(t)
+
+	// The second target cannot be connected to, so its scrape fails.
+	req := httptest.NewRequest(http.MethodGet, "/snmp/batch?target=10.0.0.1&target=unreachable", http.NoBody)
+	resp := httptest.NewRecorder()
+	batchHandler(resp, req, nopLogger, testMetrics())
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	for _, want := range []string{
+		`snmp_up{instance="10.0.0.1"} 1`,
+		`snmp_up{instance="unreachable"} 0`,
+		`snmp_scrape_pdus_returned{instance="10.0.0.1",module="if_mib"} 1`,
+	} {
+		if !strings.Contains(resp.Body.String(), want) {
+			t.Errorf("Expected %q in response:\n%s", want, resp.Body.String())
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// The OID that is fetched to find out whether an auth works, sysObjectID.0.
+const authProbeOID = "1.3.6.1.2.1.1.2.0"
+
+var snmpAuthInfoDesc = prometheus.NewDesc("snmp_auth_info", "The auth of the auth chain that was used to scrape the target.", []string{"auth", "auth_chain"}, nil)
+
+type NamedAuth struct {
+	*config.Auth
+	name string
+	// load returns the auth with its secrets, if they are only loaded once
+	// the auth is used.
+	load func(ctx context.Context) (*config.Auth, error)
+}
+
+func NewNamedAuth(name string, auth *config.Auth) *NamedAuth {
+	return &NamedAuth{
+		Auth: auth,
+		name: name,
+	}
+}
+
+// NewLazyNamedAuth returns an auth whose secrets are loaded by load once it is
+// used, so that the auths of a chain that are not tried are not loaded.
+func NewLazyNamedAuth(name string, auth *config.Auth, load func(ctx context.Context) (*config.Auth, error)) *NamedAuth {
+	return &NamedAuth{
+		Auth: auth,
+		name: name,
+		load: load,
+	}
+}
+
+// authChainKey identifies the auth chain used for a target.
+type authChainKey struct {
+	chain  string
+	target string
+}
+
+// rememberedAuth is the auth of a chain that last worked for a target.
+type rememberedAuth struct {
+	name string
+	// Whether the target stopped answering requests with the auth, which
+	// may be down or may have moved to another auth.
+	suspect bool
+}
+
+// authChainMemory remembers which auth of a chain last worked for each
+// target, so that later scrapes go straight to it.
+type authChainMemory struct {
+	mu   sync.Mutex
+	last map[authChainKey]rememberedAuth
+}
+
+var authChains = newAuthChainMemory()
+
+func newAuthChainMemory() *authChainMemory {
+	return &authChainMemory{last: make(map[authChainKey]rememberedAuth)}
+}
+
+func (m *authChainMemory) get(key authChainKey) (rememberedAuth, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.last[key]
+	return a, ok
+}
+
+func (m *authChainMemory) set(key authChainKey, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last[key] = rememberedAuth{name: name}
+}
+
+func (m *authChainMemory) forget(key authChainKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.last, key)
+}
+
+// suspect marks the remembered auth of the target as possibly no longer
+// working.
+func (m *authChainMemory) suspect(key authChainKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a, ok := m.last[key]; ok {
+		a.suspect = true
+		m.last[key] = a
+	}
+}
+
+// WithAuthChain makes the collector scrape with the first auth of the chain
+// that works for the target, instead of its auth. The auth that last worked
+// is tried first.
+func (c *Collector) WithAuthChain(chain string, auths []*NamedAuth) {
+	c.authChain = chain
+	c.chainAuths = auths
+}
+
+// selectAuth sets the auth of the collector to the one of its auth chain to
+// use for the target. Unless one is remembered, the auths are tried in turn.
+// A remembered auth the target stopped answering is tried first, and kept if
+// no other auth works either.
+func (c *Collector) selectAuth(ctx context.Context) error {
+	if c.authChain == "" {
+		return nil
+	}
+	key := authChainKey{chain: c.authChain, target: c.target}
+	auths := c.chainAuths
+	if last, ok := authChains.get(key); ok {
+		if i := slices.IndexFunc(auths, func(a *NamedAuth) bool { return a.name == last.name }); i >= 0 {
+			if !last.suspect {
+				return c.useAuth(ctx, auths[i])
+			}
+			auths = append([]*NamedAuth{auths[i]}, slices.Delete(slices.Clone(auths), i, i+1)...)
+		}
+	}
+	var errs []error
+	for _, a := range auths {
+		err := c.useAuth(ctx, a)
+		if err == nil {
+			err = c.probeAuth(ctx)
+		}
+		if err == nil {
+			c.logger.Debug("Found working auth of auth chain", "auth_chain", c.authChain, "auth", a.name)
+			authChains.set(key, a.name)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		c.logger.Debug("Auth of auth chain failed", "auth_chain", c.authChain, "auth", a.name, "err", err)
+		errs = append(errs, fmt.Errorf("%s: %w", a.name, err))
+	}
+	return fmt.Errorf("no auth of auth chain %q works: %w", c.authChain, errors.Join(errs...))
+}
+
+// useAuth makes the collector use the auth, once its secrets are loaded
+// within the scrape deadline.
+func (c *Collector) useAuth(ctx context.Context, a *NamedAuth) error {
+	auth := a.Auth
+	if a.load != nil {
+		var err error
+		if auth, err = a.load(ctx); err != nil {
+			return err
+		}
+	}
+	c.authName = a.name
+	c.auth = auth
+	return nil
+}
+
+// probeAuth checks that the target answers a request with the auth of the
+// collector, within the scrape deadline.
+func (c *Collector) probeAuth(ctx context.Context) error {
+	release, err := sessions().acquire(ctx, c.target, c.metrics)
+	if err != nil {
+		return err
+	}
+	defer release()
+	client, err := c.newClient(ctx, c.logger)
+	if err != nil {
+		return err
+	}
+	walkParams := config.DefaultWalkParams
+	if len(c.modules) > 0 {
+		walkParams = c.modules[0].WalkParams
+	}
+	client.SetOptions(walkOptions(walkParams))
+	if err := client.Connect(); err != nil {
+		return err
+	}
+	defer client.Close()
+	planRequest(ctx, client, walkParams)
+	_, err = client.Get([]string{authProbeOID})
+	return err
+}
+
+// checkAuth forgets the auth that worked for the target if err suggests that
+// it no longer does. v1 and v2c targets do not answer requests with an
+// unknown community, but neither do targets that are down, so after a
+// timeout the other auths are only tried on the next scrape if the target
+// doesn't answer the remembered one either.
+func (c *Collector) checkAuth(err error) {
+	if c.authChain == "" {
+		return
+	}
+	key := authChainKey{chain: c.authChain, target: c.target}
+	switch scraper.Reason(err) {
+	case scraper.ReasonAuthFailure, scraper.ReasonUnknownUser, scraper.ReasonDecryptionError:
+		authChains.forget(key)
+	case scraper.ReasonTimeout:
+		if c.auth.Version != 3 {
+			authChains.suspect(key)
+		}
+	}
+}
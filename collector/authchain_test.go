@@ -0,0 +1,203 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// fakeAgent answers v2c gets with the given community on loopback, and
+// ignores other requests like a real agent does.
+type fakeAgent struct {
+	conn      net.PacketConn
+	community string
+	requests  atomic.Int64
+}
+
+func newFakeAgent(t *testing.T, community string) *fakeAgent {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &fakeAgent{conn: conn, community: community}
+	go a.serve()
+	t.Cleanup(func() { conn.Close() })
+	return a
+}
+
+func (a *fakeAgent) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		a.requests.Add(1)
+		req, err := (&gosnmp.GoSNMP{Logger: gosnmp.Default.Logger}).SnmpDecodePacket(buf[:n])
+		if err != nil || req.Community != a.community {
+			continue
+		}
+		resp := &gosnmp.SnmpPacket{
+			Version:   req.Version,
+			Community: req.Community,
+			PDUType:   gosnmp.GetResponse,
+			RequestID: req.RequestID,
+			Variables: []gosnmp.SnmpPDU{{Name: authProbeOID, Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.8072.3.2.10"}},
+		}
+		out, err := resp.MarshalMsg()
+		if err != nil {
+			continue
+		}
+		a.conn.WriteTo(out, addr)
+	}
+}
+
+func TestAuthChain(t *testing.T) {
+	agent := newFakeAgent(t, "public")
+	module := config.DefaultModule
+	module.WalkParams.Timeout = 100 * time.Millisecond
+	retries := 0
+	module.WalkParams.Retries = &retries
+	auths := []*NamedAuth{
+		NewNamedAuth("private_v2", &config.Auth{Version: 2, Community: "private"}),
+		NewNamedAuth("public_v2", &config.Auth{Version: 2, Community: "public"}),
+	}
+	newCollector := func() *Collector {
+		c := New(context.Background(), agent.conn.LocalAddr().String(), "chain", "", "", "", auths[0].Auth,
+			[]*NamedModule{NewNamedModule("system", &module)}, promslog.NewNopLogger(), Metrics{}, 1, false)
+		c.WithAuthChain("chain", auths)
+		return c
+	}
+
+	c := newCollector()
+	if err := c.selectAuth(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.authName != "public_v2" || c.auth.Community != "public" {
+		t.Errorf("Expected the second auth of the chain, got %s", c.authName)
+	}
+	if got := agent.requests.Load(); got != 2 {
+		t.Errorf("Expected a probe with each auth, got %d requests", got)
+	}
+
+	// The auth that worked is used right away.
+	c = newCollector()
+	if err := c.selectAuth(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.authName != "public_v2" {
+		t.Errorf("Expected the remembered auth, got %s", c.authName)
+	}
+	if got := agent.requests.Load(); got != 2 {
+		t.Errorf("Expected no probes, got %d requests", got)
+	}
+
+	// A v2c target that stops answering may be down, so its auth is probed
+	// again before the others.
+	c.checkAuth(&scraper.Error{Reason: scraper.ReasonTimeout})
+	if last, ok := authChains.get(authChainKey{chain: "chain", target: c.target}); !ok || !last.suspect {
+		t.Fatalf("Expected the auth to be kept as suspect after a timeout, got %+v", last)
+	}
+	c = newCollector()
+	if err := c.selectAuth(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := agent.requests.Load(); c.authName != "public_v2" || got != 3 {
+		t.Errorf("Expected a probe of the remembered auth, got %s after %d requests", c.authName, got)
+	}
+
+	// Once it stops working, the other auths are tried.
+	authChains.set(authChainKey{chain: "chain", target: c.target}, "private_v2")
+	c = newCollector()
+	c.checkAuth(&scraper.Error{Reason: scraper.ReasonTimeout})
+	if err := c.selectAuth(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := agent.requests.Load(); c.authName != "public_v2" || got != 5 {
+		t.Errorf("Expected to move to the working auth, got %s after %d requests", c.authName, got)
+	}
+
+	// Probes fit into the scrape deadline.
+	module.WalkParams.Timeout = 10 * time.Second
+	c = newCollector()
+	c.WithAuthChain("other", auths[:1])
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.selectAuth(ctx); err == nil {
+		t.Error("Expected an error when no auth works")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the probe to end at the scrape deadline, took %s", elapsed)
+	}
+}
+
+func TestAuthChainLoadsTriedAuths(t *testing.T) {
+	agent := newFakeAgent(t, "public")
+	module := config.DefaultModule
+	module.WalkParams.Timeout = 100 * time.Millisecond
+	retries := 0
+	module.WalkParams.Retries = &retries
+	loaded := map[string]int{}
+	lazy := func(name string, auth *config.Auth, err error) *NamedAuth {
+		return NewLazyNamedAuth(name, &config.Auth{Version: 2}, func(context.Context) (*config.Auth, error) {
+			loaded[name]++
+			return auth, err
+		})
+	}
+	auths := []*NamedAuth{
+		lazy("broken_v2", nil, errors.New("error reading secret file")),
+		lazy("public_v2", &config.Auth{Version: 2, Community: "public"}, nil),
+		lazy("private_v2", &config.Auth{Version: 2, Community: "private"}, nil),
+	}
+	newCollector := func() *Collector {
+		c := New(context.Background(), agent.conn.LocalAddr().String(), "lazy", "", "", "", auths[0].Auth,
+			[]*NamedModule{NewNamedModule("system", &module)}, promslog.NewNopLogger(), Metrics{}, 1, false)
+		c.WithAuthChain("lazy", auths)
+		return c
+	}
+
+	// An auth whose secrets can't be loaded is skipped, and the auths after
+	// the one that works are not loaded.
+	c := newCollector()
+	if err := c.selectAuth(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.authName != "public_v2" || c.auth.Community != "public" {
+		t.Errorf("Expected the auth after the broken one, got %s", c.authName)
+	}
+	if loaded["broken_v2"] != 1 || loaded["public_v2"] != 1 || loaded["private_v2"] != 0 {
+		t.Errorf("Expected only the tried auths to be loaded, got %v", loaded)
+	}
+
+	// Only the remembered auth is loaded afterwards.
+	c = newCollector()
+	if err := c.selectAuth(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if loaded["broken_v2"] != 1 || loaded["public_v2"] != 2 || loaded["private_v2"] != 0 {
+		t.Errorf("Expected only the remembered auth to be loaded, got %v", loaded)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// How often expired entries are removed from the result cache.
+const cacheSweepInterval = time.Minute
+
+// resultCacheKey identifies the results of scraping a module from a target.
+// Scrapes with the same key are coalesced as well.
+type resultCacheKey struct {
+	target        string
+	auth          string
+	snmpContext   string
+	snmpEngineID  string
+	sourceAddress string
+	module        string
+	// The walk parameters a profile may override, as formatted by
+	// walkParamsKey.
+	walkParams string
+}
+
+// newResultCacheKey returns the key of the results of scraping module with
+// the collector.
+func (c Collector) newResultCacheKey(module *NamedModule) resultCacheKey {
+	return resultCacheKey{
+		target:        c.target,
+		auth:          c.authName,
+		snmpContext:   c.snmpContext,
+		snmpEngineID:  c.snmpEngineID,
+		sourceAddress: c.sourceAddress,
+		module:        module.name,
+		walkParams:    walkParamsKey(module.WalkParams),
+	}
+}
+
+func walkParamsKey(p config.WalkParams) string {
+	retries := -1
+	if p.Retries != nil {
+		retries = *p.Retries
+	}
+	return fmt.Sprintf("%d/%d/%s", p.MaxRepetitions, retries, p.Timeout)
+}
+
+func (k resultCacheKey) String() string {
+	return strings.Join([]string{k.target, k.auth, k.snmpContext, k.snmpEngineID, k.sourceAddress, k.module, k.walkParams}, "\x00")
+}
+
+type resultCacheEntry struct {
+	results ScrapeResults
+	time    time.Time
+	expires time.Time
+}
+
+// resultCache keeps the raw results of recent scrapes, so that scrapes of the
+// same target and module within the cache TTL of the module, such as those of
+// HA Prometheus pairs, are served from memory.
+type resultCache struct {
+	mu        sync.Mutex
+	entries   map[resultCacheKey]resultCacheEntry
+	lastSweep time.Time
+}
+
+var scrapeResultCache = newResultCache()
+
+func newResultCache() *resultCache {
+	return &resultCache{entries: make(map[resultCacheKey]resultCacheEntry)}
+}
+
+// get returns the cached results for key and the time they were scraped, if
+// they have not expired.
+func (c *resultCache) get(key resultCacheKey, now time.Time) (ScrapeResults, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return ScrapeResults{}, time.Time{}, false
+	}
+	return e.results, e.time, true
+}
+
+// put caches results scraped at now for ttl. Results are never modified after
+// they are scraped, so they are shared with the scrapes they are served to.
+func (c *resultCache) put(key resultCacheKey, results ScrapeResults, now time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) >= cacheSweepInterval {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = resultCacheEntry{results: results, time: now, expires: now.Add(ttl)}
+}
+
+// flush drops all cached results.
+func (c *resultCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+// FlushResultCache drops the cached results of all scrapes and the cached
+// subtrees of modules with refresh intervals, e.g. once the configuration they
+// were scraped with is reloaded.
+func FlushResultCache() {
+	scrapeResultCache.flush()
+	refreshedSubtrees.flush()
+}
@@ -0,0 +1,309 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+func TestResultCache(t *testing.T) {
+	cache := newResultCache()
+	key := resultCacheKey{target: "10.0.0.1", auth: "public_v2", module: "if_mib"}
+	now := time.Now()
+	results := ScrapeResults{pdus: []gosnmp.SnmpPDU{{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.OctetString, Value: "router1"}}}
+
+	if _, _, ok := cache.get(key, now); ok {
+		t.Fatal("Expected a miss on an empty cache")
+	}
+	cache.put(key, results, now, time.Minute)
+	got, scraped, ok := cache.get(key, now.Add(30*time.Second))
+	if !ok || len(got.pdus) != 1 || !scraped.Equal(now) {
+		t.Fatalf("Expected a hit scraped at %s, got %v %s %v", now, got, scraped, ok)
+	}
+	if _, _, ok := cache.get(resultCacheKey{target: "10.0.0.1", auth: "private_v2", module: "if_mib"}, now); ok {
+		t.Error("Expected a miss for another auth")
+	}
+	if _, _, ok := cache.get(key, now.Add(time.Minute)); ok {
+		t.Error("Expected a miss after the TTL")
+	}
+
+	other := key
+	other.walkParams = walkParamsKey(config.WalkParams{MaxRepetitions: 5})
+	if _, _, ok := cache.get(other, now); ok {
+		t.Error("Expected a miss for other walk parameters")
+	}
+
+	// Expired entries are swept on a later put.
+	cache.put(resultCacheKey{target: "10.0.0.2"}, results, now.Add(2*cacheSweepInterval), time.Minute)
+	if _, ok := cache.entries[key]; ok {
+		t.Error("Expected the expired entry to be swept")
+	}
+
+	cache.put(key, results, now, time.Minute)
+	cache.flush()
+	if _, _, ok := cache.get(key, now); ok {
+		t.Error("Expected a miss after the cache was flushed")
+	}
+}
+
+func TestScrapeCache(t *testing.T) {
+	module := config.DefaultModule
+	module.Walk = []string{"1.3.6.1.2.1.1"}
+	module.WalkParams.CacheTTL = time.Minute
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.1": {{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.OctetString, Value: "router1"}},
+	})
+	c := Collector{
+		target:   "cache-test",
+		authName: "public_v2",
+		auth:     &config.Auth{Version: 2},
+		metrics:  Metrics{SNMPInflight: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"})},
+	}
+	nm := NewNamedModule("system", &module)
+
+	for i := range 2 {
+		ch := make(chan prometheus.Metric, 1)
+		results, err := c.scrape(context.Background(), ch, promslog.NewNopLogger(), mock, nil, nil, nm, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(results.pdus) != 1 {
+			t.Errorf("Scrape %d: expected 1 PDU, got %d", i, len(results.pdus))
+		}
+		if len(ch) != 1 {
+			t.Errorf("Scrape %d: expected the cache age metric", i)
+		}
+		// Only the scrape that walked reports subtree telemetry.
+		if len(results.subtrees) != 1-i {
+			t.Errorf("Scrape %d: expected %d subtree stats, got %v", i, 1-i, results.subtrees)
+		}
+	}
+	if walks := mock.CallWalk(); len(walks) != 1 {
+		t.Errorf("Expected the second scrape to be served from cache, got walks %v", walks)
+	}
+}
+
+// blockingScraper blocks walks until released.
+type blockingScraper struct {
+	scraper.SNMPScraper
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.SNMPScraper.WalkAll(oid)
+}
+
+func (b blockingScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	pdus, err := b.WalkAll(oid)
+	for _, pdu := range pdus {
+		if err := fn(pdu); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func TestScrapeCoalescing(t *testing.T) {
+	module := config.DefaultModule
+	module.Walk = []string{"1.3.6.1.2.1.1"}
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.1": {{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.OctetString, Value: "router1"}},
+	})
+	client := blockingScraper{SNMPScraper: mock, started: make(chan struct{}, 2), release: make(chan struct{})}
+	coalesced := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_coalesced"})
+	c := Collector{
+		target:   "coalesce-test",
+		authName: "public_v2",
+		auth:     &config.Auth{Version: 2},
+		metrics: Metrics{
+			SNMPInflight:  prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}),
+			SNMPCoalesced: coalesced,
+		},
+	}
+	nm := NewNamedModule("system", &module)
+
+	type result struct {
+		results ScrapeResults
+		err     error
+	}
+	done := make(chan result, 2)
+	scrape := func() {
+		results, err := c.scrape(context.Background(), make(chan prometheus.Metric, 1), promslog.NewNopLogger(), client, nil, nil, nm, nil)
+		done <- result{results, err}
+	}
+	joined := make(chan struct{}, 1)
+	scrapeFlights.joined = func() { joined <- struct{}{} }
+	t.Cleanup(func() { scrapeFlights.joined = nil })
+	go scrape()
+	<-client.started
+	go scrape()
+	<-joined
+	close(client.release)
+
+	subtrees := 0
+	for range 2 {
+		r := <-done
+		if r.err != nil || len(r.results.pdus) != 1 {
+			t.Errorf("Unexpected result: %v %v", r.results, r.err)
+		}
+		subtrees += len(r.results.subtrees)
+	}
+	if subtrees != 1 {
+		t.Errorf("Expected subtree stats only for the scrape that walked, got %d", subtrees)
+	}
+	if walks := mock.CallWalk(); len(walks) != 1 {
+		t.Errorf("Expected one walk, got %v", walks)
+	}
+	if got := testutil.ToFloat64(coalesced); got != 1 {
+		t.Errorf("Expected 1 coalesced scrape, got %v", got)
+	}
+
+	// Nothing is kept once the scrape has finished.
+	client.started = make(chan struct{}, 1)
+	scrape()
+	<-done
+	if walks := mock.CallWalk(); len(walks) != 2 {
+		t.Errorf("Expected a new walk after the shared scrape finished, got %v", walks)
+	}
+
+	// A scrape does not join one that ends before its own deadline, and
+	// scrapes that join one stop waiting once their context is done.
+	first := blockingScraper{SNMPScraper: scraper.NewMockSNMPScraper(nil, nil), started: make(chan struct{}, 1), release: make(chan struct{})}
+	second := blockingScraper{SNMPScraper: scraper.NewMockSNMPScraper(nil, nil), started: make(chan struct{}, 1), release: make(chan struct{})}
+	scrapeWith := func(ctx context.Context, client scraper.SNMPScraper) {
+		results, err := c.scrape(ctx, make(chan prometheus.Metric, 1), promslog.NewNopLogger(), client, nil, nil, nm, nil)
+		done <- result{results, err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	go scrapeWith(ctx, first)
+	<-first.started
+	go scrapeWith(context.Background(), second)
+	<-second.started
+	ctx, cancel = context.WithCancel(context.Background())
+	go scrapeWith(ctx, client)
+	<-joined
+	cancel()
+	if r := <-done; r.err != context.Canceled {
+		t.Errorf("Expected the cancelled scrape to stop waiting, got %v %v", r.results, r.err)
+	}
+	close(first.release)
+	close(second.release)
+	for range 2 {
+		if r := <-done; r.err != nil {
+			t.Errorf("Unexpected error: %v", r.err)
+		}
+	}
+}
+
+// contextScraper blocks walks until released, and fails them if the context
+// the session was given is done by then, like gosnmp does.
+type contextScraper struct {
+	blockingScraper
+	g gosnmp.GoSNMP
+}
+
+func (c *contextScraper) SetOptions(fns ...func(*gosnmp.GoSNMP)) {
+	for _, fn := range fns {
+		fn(&c.g)
+	}
+}
+
+func (c *contextScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	c.started <- struct{}{}
+	<-c.release
+	if err := c.g.Context.Err(); err != nil {
+		return nil, err
+	}
+	return c.SNMPScraper.WalkAll(oid)
+}
+
+func (c *contextScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	pdus, err := c.WalkAll(oid)
+	for _, pdu := range pdus {
+		if err := fn(pdu); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func TestScrapeCoalescingLeaderCancelled(t *testing.T) {
+	module := config.DefaultModule
+	module.Walk = []string{"1.3.6.1.2.1.1"}
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.1": {{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.OctetString, Value: "router1"}},
+	})
+	c := Collector{
+		target:   "coalesce-cancel-test",
+		authName: "public_v2",
+		auth:     &config.Auth{Version: 2},
+		metrics: Metrics{
+			SNMPInflight:  prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}),
+			SNMPCoalesced: prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		},
+	}
+	nm := NewNamedModule("system", &module)
+
+	// The session of the scrape that started the flight runs with its
+	// context, like sessions created by the collector do.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &contextScraper{blockingScraper: blockingScraper{SNMPScraper: mock, started: make(chan struct{}, 1), release: make(chan struct{})}}
+	client.SetOptions(func(g *gosnmp.GoSNMP) { g.Context = ctx })
+
+	type result struct {
+		results ScrapeResults
+		err     error
+	}
+	done := make(chan result, 2)
+	scrape := func(ctx context.Context) {
+		results, err := c.scrape(ctx, make(chan prometheus.Metric, 1), promslog.NewNopLogger(), client, nil, nil, nm, nil)
+		done <- result{results, err}
+	}
+	joined := make(chan struct{}, 1)
+	scrapeFlights.joined = func() { joined <- struct{}{} }
+	t.Cleanup(func() { scrapeFlights.joined = nil })
+	go scrape(ctx)
+	<-client.started
+	go scrape(context.Background())
+	<-joined
+
+	// The scrapes that joined the flight are not failed once the one that
+	// started it goes away.
+	cancel()
+	close(client.release)
+	for range 2 {
+		if r := <-done; r.err != nil || len(r.results.pdus) != 1 {
+			t.Errorf("Unexpected result: %v %v", r.results, r.err)
+		}
+	}
+	// The session is bound back to the context of its scrape.
+	if client.g.Context != ctx {
+		t.Error("Expected the session to be bound back to the context of its scrape")
+	}
+}
@@ -17,12 +17,14 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
@@ -41,6 +43,12 @@ var (
 	srcAddress             = kingpin.Flag("snmp.source-address", "Source address to send snmp from in the format 'address:port' to use when connecting targets. If the port parameter is empty or '0', as in '127.0.0.1:' or '[::1]:0', a source port number is automatically (random) chosen.").Default("").String()
 )
 
+// NewScraper creates the sessions to targets. It is a variable so that tests
+// can scrape mock targets.
+var NewScraper = func(logger *slog.Logger, target, sourceAddress string, debug bool) (scraper.SNMPScraper, error) {
+	return scraper.NewGoSNMP(logger, target, sourceAddress, debug)
+}
+
 // Types preceded by an enum with their actual type.
 var combinedTypeMapping = map[string]map[int]string{
 	"InetAddress": {
@@ -86,10 +94,131 @@ func listToOid(l []int) string {
 
 type ScrapeResults struct {
 	pdus []gosnmp.SnmpPDU
+	// Where the PDUs go instead of pdus when the module is streamed.
+	stream *pduStream
+	errors []scrapeError
+	// The OIDs in errors.
+	failed map[string]bool
+	// The OIDs that were planned to be fetched, after dynamic filters.
+	get  []string
+	walk []string
+	// OIDs the target does not support, which return no PDU.
+	unsupported []unsupportedOID
+	// The telemetry of each subtree walked and get batch, in order.
+	subtrees []subtreeStats
+}
+
+// unsupportedOID is an OID the target reported as not existing.
+type unsupportedOID struct {
+	oid string
+	// NoSuchObject, NoSuchInstance, EndOfMibView or, for SNMPv1, NoSuchName.
+	status string
+}
+
+// scrapeError records an OID that could not be fetched when a module is
+// scraped with partial_results enabled, that was skipped once the scrape
+// deadline had passed, or that the target failed on its own in a get.
+type scrapeError struct {
+	oid    string
+	reason scraper.ErrorReason
+}
+
+// recordFailure notes that the given OIDs could not be fetched. An OID that
+// already failed, such as one fetched for several metrics, is noted once with
+// the reason it first failed with.
+func (r *ScrapeResults) recordFailure(reason scraper.ErrorReason, oids ...string) {
+	for _, oid := range oids {
+		if r.failed[oid] {
+			continue
+		}
+		if r.failed == nil {
+			r.failed = map[string]bool{}
+		}
+		r.failed[oid] = true
+		r.errors = append(r.errors, scrapeError{oid: oid, reason: reason})
+	}
+}
+
+// addPDUs adds PDUs to the results. It fails once the results hold more than
+// maxPDUs, unless it is 0.
+func (r *ScrapeResults) addPDUs(maxPDUs int, pdus ...gosnmp.SnmpPDU) error {
+	if r.stream != nil {
+		for _, pdu := range pdus {
+			if err := r.stream.add(pdu); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	r.pdus = append(r.pdus, pdus...)
+	if maxPDUs > 0 && len(r.pdus) > maxPDUs {
+		return pduLimitError(maxPDUs)
+	}
+	return nil
+}
+
+// pduCount returns the number of PDUs returned by the target.
+func (r *ScrapeResults) pduCount() int {
+	if r.stream != nil {
+		r.stream.mu.Lock()
+		defer r.stream.mu.Unlock()
+		return r.stream.count
+	}
+	return len(r.pdus)
+}
+
+// budgetExhausted reports whether the scrape deadline has passed.
+func budgetExhausted(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
 }
 
-func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, module *config.Module, logger *slog.Logger, metrics Metrics) (ScrapeResults, error) {
-	results := ScrapeResults{}
+// fitToBudget reduces the retries, and if need be the timeout, of a request so
+// that all attempts complete within the remaining scrape budget.
+func fitToBudget(remaining, timeout time.Duration, retries int) (time.Duration, int) {
+	if timeout <= 0 || remaining >= timeout*time.Duration(retries+1) {
+		return timeout, retries
+	}
+	attempts := int(remaining / timeout)
+	if attempts == 0 {
+		return remaining, 0
+	}
+	return timeout, attempts - 1
+}
+
+// planRequest configures the next request to fit into the scrape deadline,
+// if there is one.
+func planRequest(ctx context.Context, snmp scraper.SNMPScraper, walkParams config.WalkParams) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	retries := 0
+	if walkParams.Retries != nil {
+		retries = *walkParams.Retries
+	}
+	timeout, retries := fitToBudget(time.Until(deadline), walkParams.Timeout, retries)
+	snmp.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Timeout = timeout
+		g.Retries = retries
+	})
+}
+
+// ScrapeTarget scrapes a module on one session.
+func ScrapeTarget(ctx context.Context, snmp scraper.SNMPScraper, target string, auth *config.Auth, module *config.Module, logger *slog.Logger, metrics Metrics) (ScrapeResults, error) {
+	return scrapeTarget(ctx, snmp, nil, nil, target, auth, NewNamedModule("", module), logger, metrics, nil)
+}
+
+// scrapeTarget scrapes a module, walking its subtrees in parallel on
+// sessions from openSession if the module has a walk_concurrency. If stream
+// is not nil, the PDUs are passed to it as they are received rather than
+// returned in the results. counter counts the packets sent on snmp for the
+// subtree telemetry, which has no packet counts without it.
+func scrapeTarget(ctx context.Context, snmp scraper.SNMPScraper, counter *packetCounter, openSession sessionOpener, target string, auth *config.Auth, module *NamedModule, logger *slog.Logger, metrics Metrics, stream *pduStream) (ScrapeResults, error) {
+	results := ScrapeResults{stream: stream}
+	plan, err := module.compiled()
+	if err != nil {
+		return results, err
+	}
 	// Evaluate rules.
 	newGet := module.Get
 	newWalk := module.Walk
@@ -101,8 +230,12 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 	allowedIndicesByTarget := map[string][]string{}
 	var filteredTargets []string
 
-	for _, filter := range module.Filters {
+	for i, filter := range module.Filters {
+		if budgetExhausted(ctx) {
+			break
+		}
 		allowedList := []string{}
+		planRequest(ctx, snmp, module.WalkParams)
 		pdus, err := snmp.WalkAll(filter.Oid)
 		// Do not try to filter anything if we had errors.
 		if err != nil {
@@ -110,7 +243,7 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 			continue
 		}
 
-		allowedList = filterAllowedIndices(logger, filter, pdus, allowedList, metrics)
+		allowedList = filterAllowedIndices(logger, filter, plan.filterValues[i], pdus, allowedList, metrics)
 
 		// Update config to get only index and not walk them.
 		newWalk = updateWalkConfig(newWalk, filter, logger)
@@ -134,6 +267,9 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 		newGet = addAllowedIndices(singleTarget, allowedIndicesByTarget[targetOid], logger, newGet)
 	}
 
+	results.get = newGet
+	results.walk = newWalk
+
 	version := auth.Version
 	getOids := newGet
 	maxOids := int(module.WalkParams.MaxRepetitions)
@@ -142,43 +278,124 @@ func ScrapeTarget(snmp scraper.SNMPScraper, target string, auth *config.Auth, mo
 		maxOids = 1
 	}
 	for len(getOids) > 0 {
+		if budgetExhausted(ctx) {
+			logger.Info("Scrape budget exhausted, skipping remaining gets", "oids", len(getOids))
+			results.recordFailure(scraper.ReasonBudgetExhausted, getOids...)
+			break
+		}
 		oids := min(len(getOids), maxOids)
-
-		packet, err := snmp.Get(getOids[:oids])
+		measured, pdus := counter.measure("get", getOids[0]), results.pduCount()
+		err := getBatch(ctx, snmp, target, version, getOids[:oids], module.Module, logger, &results)
+		results.subtrees = append(results.subtrees, measured(results.pduCount()-pdus))
 		if err != nil {
 			return results, err
 		}
-		// SNMPv1 will return packet error for unsupported OIDs.
-		if packet.Error == gosnmp.NoSuchName && version == 1 {
-			logger.Debug("OID not supported by target", "oids", getOids[0])
-			getOids = getOids[oids:]
-			continue
-		}
-		// Response received with errors.
-		// TODO: "stringify" gosnmp errors instead of showing error code.
-		if packet.Error != gosnmp.NoError {
-			return results, fmt.Errorf("error reported by target %s: Error Status %d", target, packet.Error)
-		}
-		for _, v := range packet.Variables {
-			if v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance || v.Type == gosnmp.EndOfMibView {
-				logger.Debug("OID not supported by target", "oids", v.Name)
-				continue
-			}
-			results.pdus = append(results.pdus, v)
-		}
 		getOids = getOids[oids:]
 	}
 
-	for _, subtree := range newWalk {
-		pdus, err := snmp.WalkAll(subtree)
-		if err != nil {
+	walks := walkSubtrees(ctx, snmp, counter, openSession, newWalk, module.WalkParams, len(results.pdus), logger, stream)
+	for i, subtree := range newWalk {
+		w := walks[i]
+		if w.walked {
+			results.subtrees = append(results.subtrees, w.stats)
+		}
+		switch {
+		case !w.walked:
+			logger.Info("Scrape budget exhausted, skipping remaining walks", "oids", newWalk[i:])
+			results.recordFailure(scraper.ReasonBudgetExhausted, newWalk[i:]...)
+			return results, nil
+		case w.err == nil:
+		case w.budgetExhausted:
+			// Keep whatever was returned before the deadline.
+			results.recordFailure(scraper.ReasonBudgetExhausted, subtree)
+		case !module.WalkParams.PartialResults || scraper.Reason(w.err) == scraper.ReasonPDULimit:
+			return results, w.err
+		default:
+			// Keep whatever was returned before the walk failed.
+			reason := scraper.Reason(w.err)
+			logger.Info("Error walking subtree, skipping", "oid", subtree, "pdus", len(w.pdus), "reason", reason, "err", w.err)
+			results.recordFailure(reason, subtree)
+		}
+		if err := results.addPDUs(module.WalkParams.MaxPDUs, w.pdus...); err != nil {
 			return results, err
 		}
-		results.pdus = append(results.pdus, pdus...)
 	}
 	return results, nil
 }
 
+// getBatch gets a batch of OIDs. When the target fails the batch with tooBig,
+// genErr or badValue, the batch is split in half and each half is retried, so
+// that a response that is too big shrinks and an OID the target cannot return
+// is isolated, rather than losing every OID of the batch. Isolated OIDs are
+// recorded as failed without failing the module.
+func getBatch(ctx context.Context, snmp scraper.SNMPScraper, target string, version int, oids []string, module *config.Module, logger *slog.Logger, results *ScrapeResults) error {
+	if budgetExhausted(ctx) {
+		results.recordFailure(scraper.ReasonBudgetExhausted, oids...)
+		return nil
+	}
+	planRequest(ctx, snmp, module.WalkParams)
+	packet, err := snmp.Get(oids)
+	if err != nil {
+		if budgetExhausted(ctx) {
+			results.recordFailure(scraper.ReasonBudgetExhausted, oids...)
+			return nil
+		}
+		if !module.WalkParams.PartialResults {
+			return err
+		}
+		reason := scraper.Reason(err)
+		logger.Info("Error getting OIDs, skipping", "oids", oids, "reason", reason, "err", err)
+		results.recordFailure(reason, oids...)
+		return nil
+	}
+	// SNMPv1 will return packet error for unsupported OIDs.
+	if packet.Error == gosnmp.NoSuchName && version == 1 {
+		logger.Debug("OID not supported by target", "oids", oids[0])
+		results.unsupported = append(results.unsupported, unsupportedOID{oid: oids[0], status: packet.Error.String()})
+		return nil
+	}
+	// Response received with errors.
+	if packet.Error != gosnmp.NoError {
+		reason := scraper.ErrorStatusReason(packet.Error)
+		if bisectable(packet.Error) && len(oids) > 1 {
+			logger.Debug("Error reported by target, splitting batch", "oids", oids, "error_status", packet.Error)
+			half := len(oids) / 2
+			if err := getBatch(ctx, snmp, target, version, oids[:half], module, logger, results); err != nil {
+				return err
+			}
+			return getBatch(ctx, snmp, target, version, oids[half:], module, logger, results)
+		}
+		if bisectable(packet.Error) {
+			logger.Warn("OID rejected by target, skipping", "oid", oids[0], "reason", reason, "error_status", packet.Error)
+			results.recordFailure(reason, oids[0])
+			return nil
+		}
+		if !module.WalkParams.PartialResults {
+			return &scraper.Error{Reason: reason, Err: fmt.Errorf("error reported by target %s: Error Status %s", target, packet.Error)}
+		}
+		logger.Info("Error reported by target, skipping", "oids", oids, "reason", reason, "error_status", packet.Error)
+		results.recordFailure(reason, oids...)
+		return nil
+	}
+	for _, v := range packet.Variables {
+		if v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance || v.Type == gosnmp.EndOfMibView {
+			logger.Debug("OID not supported by target", "oids", v.Name)
+			results.unsupported = append(results.unsupported, unsupportedOID{oid: strings.TrimPrefix(v.Name, "."), status: v.Type.String()})
+			continue
+		}
+		if err := results.addPDUs(module.WalkParams.MaxPDUs, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bisectable reports whether a get failed with the error status may succeed
+// for part of its OIDs.
+func bisectable(status gosnmp.SNMPError) bool {
+	return status == gosnmp.TooBig || status == gosnmp.GenErr || status == gosnmp.BadValue
+}
+
 // intersectIndices returns the indices present in both a and b, preserving
 // the order of a.
 func intersectIndices(a, b []string) []string {
@@ -195,15 +412,17 @@ func intersectIndices(a, b []string) []string {
 	return result
 }
 
-func filterAllowedIndices(logger *slog.Logger, filter config.DynamicFilter, pdus []gosnmp.SnmpPDU, allowedList []string, metrics Metrics) []string {
+// filterAllowedIndices adds the indices of the PDUs whose value matches one of
+// the compiled values of the filter to allowedList.
+func filterAllowedIndices(logger *slog.Logger, filter config.DynamicFilter, values []*regexp.Regexp, pdus []gosnmp.SnmpPDU, allowedList []string, metrics Metrics) []string {
 	logger.Debug("Evaluating rule for oid", "oid", filter.Oid)
 	for _, pdu := range pdus {
 		found := false
-		for _, val := range filter.Values {
-			snmpval := pduValueAsString(&pdu, "DisplayString", "", metrics)
+		snmpval := pduValueAsString(&pdu, "DisplayString", "", metrics)
+		for _, val := range values {
 			logger.Debug("evaluating filters", "config value", val, "snmp value", snmpval)
 
-			if regexp.MustCompile(val).MatchString(snmpval) {
+			if val.MatchString(snmpval) {
 				found = true
 				break
 			}
@@ -267,7 +486,10 @@ func addAllowedIndices(filter config.DynamicFilter, allowedList []string, logger
 }
 
 type MetricNode struct {
-	metric *config.Metric
+	metric *metricPlan
+	// Whether the PDUs underneath are read by the lookups or combined types
+	// of a metric.
+	retain bool
 
 	children map[int]*MetricNode
 }
@@ -276,19 +498,28 @@ type MetricNode struct {
 func buildMetricTree(metrics []*config.Metric) *MetricNode {
 	metricTree := &MetricNode{children: map[int]*MetricNode{}}
 	for _, metric := range metrics {
-		head := metricTree
-		for _, o := range oidToList(metric.Oid) {
-			_, ok := head.children[o]
-			if !ok {
-				head.children[o] = &MetricNode{children: map[int]*MetricNode{}}
-			}
-			head = head.children[o]
+		plan := newMetricPlan(metric)
+		metricTree.node(metric.Oid).metric = plan
+		for _, oid := range plan.retainedOids() {
+			metricTree.node(oid).retain = true
 		}
-		head.metric = metric
 	}
 	return metricTree
 }
 
+// node returns the node of oid, adding it if needed.
+func (n *MetricNode) node(oid string) *MetricNode {
+	head := n
+	for _, o := range oidToList(oid) {
+		_, ok := head.children[o]
+		if !ok {
+			head.children[o] = &MetricNode{children: map[int]*MetricNode{}}
+		}
+		head = head.children[o]
+	}
+	return head
+}
+
 type Metrics struct {
 	SNMPCollectionDuration *prometheus.HistogramVec
 	SNMPUnexpectedPduType  prometheus.Counter
@@ -296,13 +527,23 @@ type Metrics struct {
 	SNMPPackets            prometheus.Counter
 	SNMPRetries            prometheus.Counter
 	SNMPInflight           prometheus.Gauge
+	SNMPCoalesced          prometheus.Counter
+	SNMPSessionQueueDepth  prometheus.Gauge
+	SNMPSessionWait        prometheus.Histogram
+	SNMPSessionRejections  prometheus.Counter
+	SNMPSessionsReused     prometheus.Counter
 }
 
 type NamedModule struct {
 	*config.Module
 	name string
+
+	planOnce sync.Once
+	plan     *ModulePlan
+	planErr  error
 }
 
+// NewNamedModule returns a module whose plan is compiled on first use.
 func NewNamedModule(name string, module *config.Module) *NamedModule {
 	return &NamedModule{
 		Module: module,
@@ -310,33 +551,65 @@ func NewNamedModule(name string, module *config.Module) *NamedModule {
 	}
 }
 
+// NewCompiledModule returns a module with a plan compiled from the same
+// module configuration, e.g. when the configuration was loaded. Only the
+// walk parameters of module may differ from those the plan was compiled
+// from. A nil plan is compiled on first use.
+func NewCompiledModule(name string, module *config.Module, plan *ModulePlan) *NamedModule {
+	m := NewNamedModule(name, module)
+	if plan != nil {
+		m.planOnce.Do(func() {
+			m.plan = plan
+		})
+	}
+	return m
+}
+
+// compiled returns the plan of the module, compiling it if needed.
+func (m *NamedModule) compiled() (*ModulePlan, error) {
+	m.planOnce.Do(func() {
+		m.plan, m.planErr = CompileModule(m.Module)
+	})
+	return m.plan, m.planErr
+}
+
 type Collector struct {
-	ctx          context.Context
-	target       string
-	auth         *config.Auth
-	authName     string
-	modules      []*NamedModule
-	logger       *slog.Logger
-	metrics      Metrics
-	concurrency  int
-	snmpContext  string
-	snmpEngineID string
-	debugSNMP    bool
+	ctx           context.Context
+	target        string
+	auth          *config.Auth
+	authName      string
+	modules       []*NamedModule
+	logger        *slog.Logger
+	metrics       Metrics
+	concurrency   int
+	snmpContext   string
+	snmpEngineID  string
+	sourceAddress string
+	debugSNMP     bool
+	authChain     string
+	chainAuths    []*NamedAuth
+	shared        *sharedWalks
 }
 
-func New(ctx context.Context, target, authName, snmpContext, snmpEngineID string, auth *config.Auth, modules []*NamedModule, logger *slog.Logger, metrics Metrics, conc int, debugSNMP bool) *Collector {
+// New returns a collector for a target. An empty sourceAddress uses the
+// --snmp.source-address flag.
+func New(ctx context.Context, target, authName, snmpContext, snmpEngineID, sourceAddress string, auth *config.Auth, modules []*NamedModule, logger *slog.Logger, metrics Metrics, conc int, debugSNMP bool) *Collector {
+	if sourceAddress == "" {
+		sourceAddress = *srcAddress
+	}
 	return &Collector{
-		ctx:          ctx,
-		target:       target,
-		authName:     authName,
-		auth:         auth,
-		modules:      modules,
-		snmpContext:  snmpContext,
-		snmpEngineID: snmpEngineID,
-		logger:       logger.With("source_address", *srcAddress),
-		metrics:      metrics,
-		concurrency:  conc,
-		debugSNMP:    debugSNMP,
+		ctx:           ctx,
+		target:        target,
+		authName:      authName,
+		auth:          auth,
+		modules:       modules,
+		snmpContext:   snmpContext,
+		snmpEngineID:  snmpEngineID,
+		sourceAddress: sourceAddress,
+		logger:        logger.With("source_address", sourceAddress),
+		metrics:       metrics,
+		concurrency:   conc,
+		debugSNMP:     debugSNMP,
 	}
 }
 
@@ -345,49 +618,63 @@ func (c Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
 }
 
-func (c Collector) collect(ch chan<- prometheus.Metric, logger *slog.Logger, client scraper.SNMPScraper, module *NamedModule) {
-	var (
-		packets uint64
-		retries uint64
-	)
-	client.SetOptions(
-		// Set the metrics options.
-		func(g *gosnmp.GoSNMP) {
-			var sent time.Time
-			g.OnSent = func(x *gosnmp.GoSNMP) {
-				sent = time.Now()
-				c.metrics.SNMPPackets.Inc()
-				packets++
+// walkOptions returns the option that sets the walk parameters of a module.
+func walkOptions(walkParams config.WalkParams) func(*gosnmp.GoSNMP) {
+	return func(g *gosnmp.GoSNMP) {
+		g.Retries = *walkParams.Retries
+		g.Timeout = walkParams.Timeout
+		g.MaxRepetitions = walkParams.MaxRepetitions
+		g.UseUnconnectedUDPSocket = walkParams.UseUnconnectedUDPSocket
+		if walkParams.AllowNonIncreasingOIDs {
+			g.AppOpts = map[string]any{
+				"c": true,
 			}
-			g.OnRecv = func(x *gosnmp.GoSNMP) {
-				c.metrics.SNMPDuration.Observe(time.Since(sent).Seconds())
-			}
-			g.OnRetry = func(x *gosnmp.GoSNMP) {
-				c.metrics.SNMPRetries.Inc()
-				retries++
-			}
-		},
-		// Set the Walk options.
-		func(g *gosnmp.GoSNMP) {
-			g.Retries = *module.WalkParams.Retries
-			g.Timeout = module.WalkParams.Timeout
-			g.MaxRepetitions = module.WalkParams.MaxRepetitions
-			g.UseUnconnectedUDPSocket = module.WalkParams.UseUnconnectedUDPSocket
-			if module.WalkParams.AllowNonIncreasingOIDs {
-				g.AppOpts = map[string]any{
-					"c": true,
-				}
-			}
-		},
-	)
+		}
+	}
+}
+
+func (c Collector) collect(ctx context.Context, ch chan<- prometheus.Metric, logger *slog.Logger, client scraper.SNMPScraper, module *NamedModule) {
+	var packets, retries atomic.Uint64
+	// Set the metrics options. Each session has its own send time.
+	metricsOptions := func(g *gosnmp.GoSNMP) {
+		var sent time.Time
+		g.OnSent = func(x *gosnmp.GoSNMP) {
+			sent = time.Now()
+			c.metrics.SNMPPackets.Inc()
+			packets.Add(1)
+		}
+		g.OnRecv = func(x *gosnmp.GoSNMP) {
+			c.metrics.SNMPDuration.Observe(time.Since(sent).Seconds())
+		}
+		g.OnRetry = func(x *gosnmp.GoSNMP) {
+			c.metrics.SNMPRetries.Inc()
+			retries.Add(1)
+		}
+	}
+	client.SetOptions(metricsOptions, walkOptions(module.WalkParams))
+	c.adaptRepetitions(client, module)
 	start := time.Now()
 	moduleLabel := prometheus.Labels{"module": module.name}
-	c.metrics.SNMPInflight.Inc()
-	results, err := ScrapeTarget(client, c.target, c.auth, module.Module, logger, c.metrics)
-	c.metrics.SNMPInflight.Dec()
+	plan, err := module.compiled()
+	if err != nil {
+		logger.Info("Error compiling module", "err", err)
+		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error compiling module", nil, moduleLabel), err)
+		return
+	}
+	openSession := c.sessionOpener(logger, module, metricsOptions, walkOptions(module.WalkParams))
+	var stream *pduStream
+	if module.WalkParams.Streaming {
+		stream = newPDUStream(plan, module.WalkParams.MaxPDUs, ch, logger, c.metrics)
+	}
+	// The hooks of the session were just replaced, so the packets are
+	// counted on top of them once.
+	results, err := c.scrape(ctx, ch, logger, client, countPackets(client), openSession, module, stream)
 	if err != nil {
-		logger.Info("Error scraping target", "err", err)
-		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error scraping target", nil, moduleLabel), err)
+		c.checkAuth(err)
+		reason := scraper.Reason(err)
+		logger.Info("Error scraping target", "reason", reason, "err", err)
+		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error scraping target", nil, moduleLabel),
+			fmt.Errorf("%s: %w", reason, err))
 		return
 	}
 	ch <- prometheus.MustNewConstMetric(
@@ -397,39 +684,59 @@ func (c Collector) collect(ch chan<- prometheus.Metric, logger *slog.Logger, cli
 	ch <- prometheus.MustNewConstMetric(
 		prometheus.NewDesc("snmp_scrape_packets_sent", "Packets sent for get, bulkget, and walk; including retries.", nil, moduleLabel),
 		prometheus.GaugeValue,
-		float64(packets))
+		float64(packets.Load()))
 	ch <- prometheus.MustNewConstMetric(
 		prometheus.NewDesc("snmp_scrape_packets_retried", "Packets retried for get, bulkget, and walk.", nil, moduleLabel),
 		prometheus.GaugeValue,
-		float64(retries))
+		float64(retries.Load()))
 	ch <- prometheus.MustNewConstMetric(
 		prometheus.NewDesc("snmp_scrape_pdus_returned", "PDUs returned from get, bulkget, and walk.", nil, moduleLabel),
 		prometheus.GaugeValue,
-		float64(len(results.pdus)))
-
-	oidToPdu := make(map[string]gosnmp.SnmpPDU, len(results.pdus))
-	for _, pdu := range results.pdus {
-		oidToPdu[pdu.Name[1:]] = pdu
-	}
-
-	metricTree := buildMetricTree(module.Metrics)
-	// Look for metrics that match each pdu.
-	for oid, pdu := range oidToPdu {
-		head := metricTree
-		oidList := oidToList(oid)
-		for i, o := range oidList {
-			var ok bool
-			head, ok = head.children[o]
-			if !ok {
-				break
-			}
-			if head.metric != nil {
-				// Found a match.
-				samples := pduToSamples(oidList[i+1:], &pdu, head.metric, oidToPdu, logger, c.metrics)
-				for _, sample := range samples {
-					ch <- sample
+		float64(results.pduCount()))
+	reasons := map[scraper.ErrorReason]bool{}
+	for _, e := range results.errors {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_subtree_errors", "Subtrees and OIDs that could not be fetched, with the error reason.", []string{"oid", "reason"}, moduleLabel),
+			prometheus.GaugeValue,
+			1, e.oid, string(e.reason))
+		reasons[e.reason] = true
+	}
+	for reason := range reasons {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_error_info", "Reasons for SNMP errors encountered during the scrape.", []string{"reason"}, moduleLabel),
+			prometheus.GaugeValue,
+			1, string(reason))
+	}
+	if module.WalkParams.SubtreeTelemetry {
+		sendSubtreeStats(ch, plan, results.subtrees, moduleLabel)
+	}
+
+	if stream != nil {
+		stream.finish()
+	} else {
+		oidToPdu := make(map[string]gosnmp.SnmpPDU, len(results.pdus))
+		for _, pdu := range results.pdus {
+			oidToPdu[pdu.Name[1:]] = pdu
+		}
+
+		// Look for metrics that match each pdu.
+		for oid, pdu := range oidToPdu {
+			head := plan.metricTree
+			oidList := oidToList(oid)
+			for i, o := range oidList {
+				var ok bool
+				head, ok = head.children[o]
+				if !ok {
+					break
+				}
+				if head.metric != nil {
+					// Found a match.
+					samples := pduToSamples(oidList[i+1:], &pdu, head.metric, oidToPdu, logger, c.metrics)
+					for _, sample := range samples {
+						ch <- sample
+					}
+					break
 				}
-				break
 			}
 		}
 	}
@@ -439,55 +746,224 @@ func (c Collector) collect(ch chan<- prometheus.Metric, logger *slog.Logger, cli
 		time.Since(start).Seconds())
 }
 
+// scrape returns the results of scraping a module, from the result cache if
+// the module has a cache TTL. Concurrent identical scrapes share the results
+// of the one in flight, which uses the client of the first, bound to the
+// context of the flight for as long as it lasts. Results that were not
+// scraped by this scrape have no subtree telemetry, which is only reported
+// along with the walks it measured.
+// Streamed modules are always scraped, as their PDUs are not kept.
+func (c Collector) scrape(ctx context.Context, ch chan<- prometheus.Metric, logger *slog.Logger, client scraper.SNMPScraper, counter *packetCounter, openSession sessionOpener, module *NamedModule, stream *pduStream) (ScrapeResults, error) {
+	if stream != nil {
+		c.metrics.SNMPInflight.Inc()
+		defer c.metrics.SNMPInflight.Dec()
+		return scrapeTarget(ctx, c.moduleClient(ctx, client, module, logger), counter, openSession, c.target, c.auth, module, logger, c.metrics, stream)
+	}
+	ttl := module.WalkParams.CacheTTL
+	cacheAgeDesc := prometheus.NewDesc("snmp_scrape_cache_age_seconds", "Age of the cached results the scrape was served from, 0 if the target was scraped.", nil, prometheus.Labels{"module": module.name})
+	key := c.newResultCacheKey(module)
+	if ttl > 0 {
+		if results, scraped, ok := scrapeResultCache.get(key, time.Now()); ok {
+			logger.Debug("Serving scrape results from cache", "scraped", scraped)
+			ch <- prometheus.MustNewConstMetric(cacheAgeDesc, prometheus.GaugeValue, time.Since(scraped).Seconds())
+			results.subtrees = nil
+			return results, nil
+		}
+	}
+
+	results, err, shared := scrapeFlights.do(ctx, key.String(), func(ctx context.Context) (ScrapeResults, error) {
+		c.metrics.SNMPInflight.Inc()
+		defer c.metrics.SNMPInflight.Dec()
+		defer bindContext(client, ctx)()
+		results, err := scrapeTarget(ctx, c.moduleClient(ctx, client, module, logger), counter, openSession, c.target, c.auth, module, logger, c.metrics, nil)
+		// Incomplete results are not cached, so that the next scrape retries.
+		if ttl > 0 && err == nil && len(results.errors) == 0 {
+			scrapeResultCache.put(key, results, time.Now(), ttl)
+		}
+		return results, err
+	})
+	if shared {
+		logger.Debug("Sharing results of an identical scrape in flight")
+		c.metrics.SNMPCoalesced.Inc()
+		results.subtrees = nil
+	}
+	if err != nil {
+		return ScrapeResults{}, err
+	}
+	if ttl > 0 {
+		ch <- prometheus.MustNewConstMetric(cacheAgeDesc, prometheus.GaugeValue, 0)
+	}
+	return results, nil
+}
+
+// moduleClient returns the client that scrapes a module with client, which
+// serves the walks the module shares with the other modules of the request,
+// waited for until ctx is done, and the subtrees it refreshes less often than
+// it is scraped.
+func (c Collector) moduleClient(ctx context.Context, client scraper.SNMPScraper, module *NamedModule, logger *slog.Logger) scraper.SNMPScraper {
+	return c.refreshed(c.shared.client(ctx, client, module), module, logger)
+}
+
+// bindContext makes the requests of the session run with ctx, until the
+// returned function binds it back to the context it had.
+func bindContext(client scraper.SNMPScraper, ctx context.Context) func() {
+	var previous context.Context
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		previous, g.Context = g.Context, ctx
+	})
+	return func() {
+		client.SetOptions(func(g *gosnmp.GoSNMP) {
+			g.Context = previous
+		})
+	}
+}
+
+// newClient creates a client for the target with the auth, context and
+// engine ID of the collector. With a session pool, an idle session to the
+// target is reused if there is one, in which case Connect does nothing.
+func (c Collector) newClient(ctx context.Context, logger *slog.Logger) (scraper.SNMPScraper, error) {
+	// Set UseUnconnectedSocket option if at least one module has it set
+	useUnconnectedUDPSocket := false
+	for _, m := range c.modules {
+		if m.WalkParams.UseUnconnectedUDPSocket {
+			useUnconnectedUDPSocket = true
+			break
+		}
+	}
+	pool := pooledSessions()
+	// Sessions with packet debugging log to the logger of their scrape.
+	if !pool.enabled() || c.debugSNMP {
+		return c.newSession(ctx, logger, useUnconnectedUDPSocket)
+	}
+	key := sessionPoolKey{
+		target:                  c.target,
+		sourceAddress:           c.sourceAddress,
+		auth:                    c.authName,
+		snmpContext:             c.snmpContext,
+		snmpEngineID:            c.snmpEngineID,
+		useUnconnectedUDPSocket: useUnconnectedUDPSocket,
+	}
+	if session, ok := pool.get(key, *c.auth, time.Now()); ok {
+		logger.Debug("Reusing pooled session")
+		c.metrics.SNMPSessionsReused.Inc()
+		// Only the state of the previous scrape is reset, the session keeps
+		// its auth and, for SNMPv3, the engine it discovered.
+		session.SetOptions(func(g *gosnmp.GoSNMP) {
+			g.Context = ctx
+			g.OnSent, g.OnRecv, g.OnRetry = nil, nil, nil
+			g.AppOpts = nil
+		})
+		session.SetLogger(logger)
+		// The target may have closed the session while it was idle, such as
+		// a TCP connection, in which case a fresh one is opened.
+		reopen := func() (scraper.SNMPScraper, error) {
+			logger.Debug("Replacing pooled session the target closed")
+			session, err := c.newSession(ctx, logger, useUnconnectedUDPSocket)
+			if err != nil {
+				return nil, err
+			}
+			// The engine client of the reused session stays in place.
+			if e, ok := session.(*engineClient); ok {
+				session = e.SNMPScraper
+			}
+			if err := session.Connect(); err != nil {
+				return nil, err
+			}
+			return session, nil
+		}
+		client := &pooledClient{SNMPScraper: session, pool: pool, key: key, auth: *c.auth, reused: true, reopen: reopen}
+		if c.auth.Version != 3 {
+			return client, nil
+		}
+		return &engineClient{SNMPScraper: client, cache: engines, key: engineCacheKey{target: c.target, auth: c.authName}, auth: *c.auth}, nil
+	}
+	client, err := c.newSession(ctx, logger, useUnconnectedUDPSocket)
+	if err != nil {
+		return nil, err
+	}
+	// The session to put back in the pool is the one under the engine
+	// client, which stores the engine of the target before the session is
+	// given back.
+	if e, ok := client.(*engineClient); ok {
+		e.SNMPScraper = &pooledClient{SNMPScraper: e.SNMPScraper, pool: pool, key: key, auth: *c.auth}
+		return e, nil
+	}
+	return &pooledClient{SNMPScraper: client, pool: pool, key: key, auth: *c.auth}, nil
+}
+
+// newSession creates a session to the target.
+func (c Collector) newSession(ctx context.Context, logger *slog.Logger, useUnconnectedUDPSocket bool) (scraper.SNMPScraper, error) {
+	client, err := NewScraper(logger, c.target, c.sourceAddress, c.debugSNMP)
+	if err != nil {
+		return nil, err
+	}
+	// Set EngineID option if one is configured and we're using SNMPv3
+	if c.snmpEngineID != "" && c.auth.Version == 3 {
+		// Convert the SNMP Engine ID to a byte string
+		sEID, err := hex.DecodeString(c.snmpEngineID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode snmpEngineID %q as hex: %w", c.snmpEngineID, err)
+		}
+		// Set the options.
+		client.SetOptions(func(g *gosnmp.GoSNMP) {
+			g.ContextEngineID = string(sEID)
+		})
+	}
+	// Set the options.
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		g.Context = ctx
+		g.UseUnconnectedUDPSocket = useUnconnectedUDPSocket
+		c.auth.ConfigureSNMP(g, c.snmpContext)
+	})
+	if c.auth.Version != 3 {
+		return client, nil
+	}
+	// Skip the engine discovery if the engine of the target is known.
+	key := engineCacheKey{target: c.target, auth: c.authName}
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		engines.restore(key, *c.auth, g, time.Now())
+	})
+	return &engineClient{SNMPScraper: client, cache: engines, key: key, auth: *c.auth}, nil
+}
+
 // Collect implements Prometheus.Collector.
 func (c Collector) Collect(ch chan<- prometheus.Metric) {
 	wg := sync.WaitGroup{}
 	workerCount := max(c.concurrency, 1)
 	ctx, cancel := context.WithCancel(c.ctx)
 	defer cancel()
+	if err := c.selectAuth(ctx); err != nil {
+		c.logger.Info("Error selecting auth", "auth_chain", c.authChain, "err", err)
+		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error selecting auth", nil, nil), err)
+		return
+	}
+	if c.authChain != "" {
+		ch <- prometheus.MustNewConstMetric(snmpAuthInfoDesc, prometheus.GaugeValue, 1, c.authName, c.authChain)
+	}
+	c.shared = newSharedWalks(c.modules)
 	workerChan := make(chan *NamedModule)
 	for i := 0; i < workerCount; i++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
 			logger := c.logger.With("worker", i)
-			client, err := scraper.NewGoSNMP(logger, c.target, *srcAddress, c.debugSNMP)
+			release, err := sessions().acquire(ctx, c.target, c.metrics)
+			if err != nil {
+				logger.Info("Failed to open snmp session", "err", err)
+				cancel()
+				ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error waiting for the session limits", nil, nil), err)
+				return
+			}
+			defer release()
+			client, err := c.newClient(ctx, logger)
 			if err != nil {
 				logger.Info("Failed to create snmp scrape client", "err", err)
 				cancel()
 				ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error during initialisation of the Worker", nil, nil), err)
 				return
 			}
-			// Set UseUnconnectedSocket option if at least one module has it set
-			useUnconnectedUDPSocket := false
-			for _, m := range c.modules {
-				if m.WalkParams.UseUnconnectedUDPSocket {
-					useUnconnectedUDPSocket = true
-					break
-				}
-			}
-			// Set EngineID option if one is configured and we're using SNMPv3
-			if c.snmpEngineID != "" && c.auth.Version == 3 {
-				// Convert the SNMP Engine ID to a byte string
-				sEID, err := hex.DecodeString(c.snmpEngineID)
-				if err != nil {
-					logger.Debug("Failed to decode snmpEngineID as hex", "engineID", c.snmpEngineID, "err", err)
-					cancel()
-					return
-				}
-				// Set the options.
-				client.SetOptions(func(g *gosnmp.GoSNMP) {
-					g.ContextEngineID = string(sEID)
-				})
-			}
-			// Set the options.
-			client.SetOptions(func(g *gosnmp.GoSNMP) {
-				g.Context = ctx
-				g.UseUnconnectedUDPSocket = useUnconnectedUDPSocket
-				c.auth.ConfigureSNMP(g, c.snmpContext)
-			})
 			if err = client.Connect(); err != nil {
-				logger.Info("Error connecting to target", "err", err)
+				logger.Info("Error connecting to target", "reason", scraper.Reason(err), "err", err)
 				ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error connecting to target", nil, nil), err)
 				cancel()
 				return
@@ -497,7 +973,7 @@ func (c Collector) Collect(ch chan<- prometheus.Metric) {
 				_logger := logger.With("module", m.name)
 				_logger.Debug("Starting scrape")
 				start := time.Now()
-				c.collect(ch, _logger, client, m)
+				c.collect(ctx, ch, _logger, client, m)
 				duration := time.Since(start).Seconds()
 				_logger.Debug("Finished scrape", "duration_seconds", duration)
 				c.metrics.SNMPCollectionDuration.WithLabelValues(m.name).Observe(duration)
@@ -520,6 +996,23 @@ func (c Collector) Collect(ch chan<- prometheus.Metric) {
 	}
 	close(workerChan)
 	wg.Wait()
+
+	for _, m := range c.modules {
+		if !m.WalkParams.AdaptiveMaxRepetitions {
+			continue
+		}
+		if v, ok := c.repetitions(m).LastMaxRepetitions(); ok {
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc("snmp_adaptive_max_repetitions", "Max repetitions of the last walk of the target by a module with adaptive_max_repetitions, 0 if it was walked with GETNEXT.", nil, prometheus.Labels{"module": m.name}),
+				prometheus.GaugeValue, float64(v))
+		}
+	}
+	if c.auth.Version == 3 {
+		if e, ok := engines.get(engineCacheKey{target: c.target, auth: c.authName}, *c.auth); ok {
+			ch <- prometheus.MustNewConstMetric(snmpEngineBootsDesc, prometheus.GaugeValue, float64(e.boots))
+			ch <- prometheus.MustNewConstMetric(snmpEngineTimeDesc, prometheus.GaugeValue, float64(e.engineTime(time.Now())))
+		}
+	}
 }
 
 func getPduValue(pdu *gosnmp.SnmpPDU) float64 {
@@ -615,19 +1108,14 @@ func parseNtpTimestamp(pdu *gosnmp.SnmpPDU) (float64, error) {
 	return float64(t.Unix()), nil
 }
 
-func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, oidToPdu map[string]gosnmp.SnmpPDU, logger *slog.Logger, metrics Metrics) []prometheus.Metric {
+func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *metricPlan, oidToPdu map[string]gosnmp.SnmpPDU, logger *slog.Logger, metrics Metrics) []prometheus.Metric {
 	var err error
 	// The part of the OID that is the indexes.
-	labels := indexesToLabels(indexOids, metric, oidToPdu, metrics)
+	labels, _ := indexesToLabels(indexOids, metric, oidToPdu, metrics)
 
 	value := getPduValue(pdu)
 
-	labelnames := make([]string, 0, len(labels)+1)
-	labelvalues := make([]string, 0, len(labels)+1)
-	for k, v := range labels {
-		labelnames = append(labelnames, k)
-		labelvalues = append(labelvalues, v)
-	}
+	labelvalues := metric.labelValues(labels)
 
 	var t prometheus.ValueType
 	switch metric.Type {
@@ -646,7 +1134,7 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 		}
 	case "ParseDateAndTime":
 		t = prometheus.GaugeValue
-		value, err = parseDateAndTimeWithPattern(metric, pdu, metrics)
+		value, err = parseDateAndTimeWithPattern(metric.Metric, pdu, metrics)
 		if err != nil {
 			logger.Debug("Error parsing ParseDateAndTime", "err", err)
 			return []prometheus.Metric{}
@@ -659,11 +1147,11 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 			return []prometheus.Metric{}
 		}
 	case "EnumAsInfo":
-		return enumAsInfo(metric, int(value), labelnames, labelvalues)
+		return enumAsInfo(metric, int(value), labelvalues)
 	case "EnumAsStateSet":
-		return enumAsStateSet(metric, int(value), labelnames, labelvalues)
+		return enumAsStateSet(metric, int(value), labelvalues)
 	case "Bits":
-		return bits(metric, pdu.Value, labelnames, labelvalues)
+		return bits(metric, pdu.Value, labelvalues)
 	default:
 		// It's some form of string.
 		t = prometheus.GaugeValue
@@ -672,7 +1160,7 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 
 		if typeMapping, ok := combinedTypeMapping[metricType]; ok {
 			// Lookup associated sub type in previous object.
-			prevOid := fmt.Sprintf("%s.%s", getPrevOid(metric.Oid), listToOid(indexOids))
+			prevOid := fmt.Sprintf("%s.%s", metric.prevOid, listToOid(indexOids))
 			if prevPdu, ok := oidToPdu[prevOid]; ok {
 				val := int(getPduValue(&prevPdu))
 				if t, ok := typeMapping[val]; ok {
@@ -688,12 +1176,11 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 		}
 
 		if len(metric.RegexpExtracts) > 0 {
-			return applyRegexExtracts(metric, pduValueAsString(pdu, metricType, metric.DisplayHint, metrics), labelnames, labelvalues, logger)
+			return applyRegexExtracts(metric, pduValueAsString(pdu, metricType, metric.DisplayHint, metrics), labelvalues, logger)
 		}
 		// For strings we put the value as a label with the same name as the metric.
 		// If the name is already an index, we do not need to set it again.
 		if _, ok := labels[metric.Name]; !ok {
-			labelnames = append(labelnames, metric.Name)
 			labelvalues = append(labelvalues, pduValueAsString(pdu, metricType, metric.DisplayHint, metrics))
 		}
 	}
@@ -703,8 +1190,7 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 	}
 	value += metric.Offset
 
-	sample, err := prometheus.NewConstMetric(prometheus.NewDesc(metric.Name, metric.Help, labelnames, nil),
-		t, value, labelvalues...)
+	sample, err := prometheus.NewConstMetric(metric.desc, t, value, labelvalues...)
 	if err != nil {
 		sample = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstMetric", nil, nil),
 			fmt.Errorf("error for metric %s with labels %v from indexOids %v: %w", metric.Name, labelvalues, indexOids, err))
@@ -713,7 +1199,7 @@ func pduToSamples(indexOids []int, pdu *gosnmp.SnmpPDU, metric *config.Metric, o
 	return []prometheus.Metric{sample}
 }
 
-func applyRegexExtracts(metric *config.Metric, pduValue string, labelnames, labelvalues []string, logger *slog.Logger) []prometheus.Metric {
+func applyRegexExtracts(metric *metricPlan, pduValue string, labelvalues []string, logger *slog.Logger) []prometheus.Metric {
 	results := []prometheus.Metric{}
 	for name, strMetricSlice := range metric.RegexpExtracts {
 		for _, strMetric := range strMetricSlice {
@@ -732,8 +1218,7 @@ func applyRegexExtracts(metric *config.Metric, pduValue string, labelnames, labe
 				v *= metric.Scale
 			}
 			v += metric.Offset
-			newMetric, err := prometheus.NewConstMetric(prometheus.NewDesc(metric.Name+name, metric.Help+" (regex extracted)", labelnames, nil),
-				prometheus.GaugeValue, v, labelvalues...)
+			newMetric, err := prometheus.NewConstMetric(metric.extractDescs[name], prometheus.GaugeValue, v, labelvalues...)
 			if err != nil {
 				newMetric = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstMetric for regex_extract", nil, nil),
 					fmt.Errorf("error for metric %s with labels %v: %w", metric.Name+name, labelvalues, err))
@@ -745,25 +1230,20 @@ func applyRegexExtracts(metric *config.Metric, pduValue string, labelnames, labe
 	return results
 }
 
-func enumAsInfo(metric *config.Metric, value int, labelnames, labelvalues []string) []prometheus.Metric {
+func enumAsInfo(metric *metricPlan, value int, labelvalues []string) []prometheus.Metric {
 	// Lookup enum, default to the value.
 	state, ok := metric.EnumValues[int(value)]
 	if !ok {
 		state = strconv.Itoa(int(value))
 	}
-	// If the metric name is already a label (e.g. it is also a table index with
-	// type EnumAsInfo), the enum string is already captured there and we must not
-	// add it again or Prometheus will reject the duplicate label.
-	for _, ln := range labelnames {
-		if ln == metric.Name {
-			return []prometheus.Metric{}
-		}
+	// There is no descriptor if the metric name is already a label, which
+	// has the enum string.
+	if metric.desc == nil {
+		return []prometheus.Metric{}
 	}
-	labelnames = append(labelnames, metric.Name)
 	labelvalues = append(labelvalues, state)
 
-	newMetric, err := prometheus.NewConstMetric(prometheus.NewDesc(metric.Name+"_info", metric.Help+" (EnumAsInfo)", labelnames, nil),
-		prometheus.GaugeValue, 1.0, labelvalues...)
+	newMetric, err := prometheus.NewConstMetric(metric.desc, prometheus.GaugeValue, 1.0, labelvalues...)
 	if err != nil {
 		newMetric = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstMetric for EnumAsInfo", nil, nil),
 			fmt.Errorf("error for metric %s with labels %v: %w", metric.Name, labelvalues, err))
@@ -771,8 +1251,7 @@ func enumAsInfo(metric *config.Metric, value int, labelnames, labelvalues []stri
 	return []prometheus.Metric{newMetric}
 }
 
-func enumAsStateSet(metric *config.Metric, value int, labelnames, labelvalues []string) []prometheus.Metric {
-	labelnames = append(labelnames, metric.Name)
+func enumAsStateSet(metric *metricPlan, value int, labelvalues []string) []prometheus.Metric {
 	results := []prometheus.Metric{}
 
 	state, ok := metric.EnumValues[value]
@@ -780,8 +1259,7 @@ func enumAsStateSet(metric *config.Metric, value int, labelnames, labelvalues []
 		// Fallback to using the value.
 		state = strconv.Itoa(value)
 	}
-	newMetric, err := prometheus.NewConstMetric(prometheus.NewDesc(metric.Name, metric.Help+" (EnumAsStateSet)", labelnames, nil),
-		prometheus.GaugeValue, 1.0, append(labelvalues, state)...)
+	newMetric, err := prometheus.NewConstMetric(metric.desc, prometheus.GaugeValue, 1.0, append(labelvalues, state)...)
 	if err != nil {
 		newMetric = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstMetric for EnumAsStateSet", nil, nil),
 			fmt.Errorf("error for metric %s with labels %v: %w", metric.Name, labelvalues, err))
@@ -792,8 +1270,7 @@ func enumAsStateSet(metric *config.Metric, value int, labelnames, labelvalues []
 		if k == value {
 			continue
 		}
-		newMetric, err := prometheus.NewConstMetric(prometheus.NewDesc(metric.Name, metric.Help+" (EnumAsStateSet)", labelnames, nil),
-			prometheus.GaugeValue, 0.0, append(labelvalues, v)...)
+		newMetric, err := prometheus.NewConstMetric(metric.desc, prometheus.GaugeValue, 0.0, append(labelvalues, v)...)
 		if err != nil {
 			newMetric = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstMetric for EnumAsStateSet", nil, nil),
 				fmt.Errorf("error for metric %s with labels %v: %w", metric.Name, labelvalues, err))
@@ -803,13 +1280,12 @@ func enumAsStateSet(metric *config.Metric, value int, labelnames, labelvalues []
 	return results
 }
 
-func bits(metric *config.Metric, value any, labelnames, labelvalues []string) []prometheus.Metric {
+func bits(metric *metricPlan, value any, labelvalues []string) []prometheus.Metric {
 	bytes, ok := value.([]byte)
 	if !ok {
 		return []prometheus.Metric{prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "BITS type was not a BISTRING on the wire.", nil, nil),
 			fmt.Errorf("error for metric %s with labels %v: %T", metric.Name, labelvalues, value))}
 	}
-	labelnames = append(labelnames, metric.Name)
 	results := []prometheus.Metric{}
 
 	for k, v := range metric.EnumValues {
@@ -820,8 +1296,7 @@ func bits(metric *config.Metric, value any, labelnames, labelvalues []string) []
 				bit = 1.0
 			}
 		}
-		newMetric, err := prometheus.NewConstMetric(prometheus.NewDesc(metric.Name, metric.Help+" (Bits)", labelnames, nil),
-			prometheus.GaugeValue, bit, append(labelvalues, v)...)
+		newMetric, err := prometheus.NewConstMetric(metric.desc, prometheus.GaugeValue, bit, append(labelvalues, v)...)
 		if err != nil {
 			newMetric = prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error calling NewConstMetric for Bits", nil, nil),
 				fmt.Errorf("error for metric %s with labels %v: %w", metric.Name, labelvalues, err))
@@ -1012,9 +1487,13 @@ func getPrevOid(oid string) string {
 	return strings.Join(oids, ".")
 }
 
-func indexesToLabels(indexOids []int, metric *config.Metric, oidToPdu map[string]gosnmp.SnmpPDU, metrics Metrics) map[string]string {
+// indexesToLabels returns the labels of a PDU from its index and lookups, and
+// the OID each lookup of the metric looked up, empty for lookups that only
+// remove a label.
+func indexesToLabels(indexOids []int, metric *metricPlan, oidToPdu map[string]gosnmp.SnmpPDU, metrics Metrics) (map[string]string, []string) {
 	labels := map[string]string{}
 	labelOids := map[string][]int{}
+	lookupOids := make([]string, len(metric.lookups))
 
 	// Covert indexes to useful strings.
 	for _, index := range metric.Indexes {
@@ -1029,7 +1508,7 @@ func indexesToLabels(indexOids []int, metric *config.Metric, oidToPdu map[string
 	}
 
 	// Perform lookups.
-	for _, lookup := range metric.Lookups {
+	for i, lookup := range metric.lookups {
 		if len(lookup.Labels) == 0 {
 			delete(labels, lookup.Labelname)
 			continue
@@ -1038,11 +1517,12 @@ func indexesToLabels(indexOids []int, metric *config.Metric, oidToPdu map[string
 		for _, label := range lookup.Labels {
 			oid = fmt.Sprintf("%s.%s", oid, listToOid(labelOids[label]))
 		}
+		lookupOids[i] = oid
 		if pdu, ok := oidToPdu[oid]; ok {
 			t := lookup.Type
 			if typeMapping, ok := combinedTypeMapping[lookup.Type]; ok {
 				// Lookup associated sub type in previous object.
-				prevOid := getPrevOid(lookup.Oid)
+				prevOid := lookup.prevOid
 				for _, label := range lookup.Labels {
 					prevOid = fmt.Sprintf("%s.%s", prevOid, listToOid(labelOids[label]))
 				}
@@ -1069,5 +1549,5 @@ func indexesToLabels(indexOids []int, metric *config.Metric, oidToPdu map[string
 		}
 	}
 
-	return labels
+	return labels, lookupOids
 }
@@ -14,14 +14,18 @@
 package collector
 
 import (
+	"context"
 	"errors"
+	"log/slog"
 	"reflect"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
 	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
 	io_prometheus_client "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/promslog"
 
@@ -52,7 +56,7 @@ func TestPduToSample(t *testing.T) {
 					"Extension": {
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile(".*"),
+								Regexp: regexp.MustCompile(".*"),
 							},
 							Value: "5",
 						},
@@ -78,7 +82,7 @@ func TestPduToSample(t *testing.T) {
 					"Extension": {
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile(".*"),
+								Regexp: regexp.MustCompile(".*"),
 							},
 							Value: "",
 						},
@@ -101,7 +105,7 @@ func TestPduToSample(t *testing.T) {
 					"Extension": {
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile("(will_not_match)"),
+								Regexp: regexp.MustCompile("(will_not_match)"),
 							},
 							Value: "",
 						},
@@ -124,7 +128,7 @@ func TestPduToSample(t *testing.T) {
 					"Status": {
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile(".*"),
+								Regexp: regexp.MustCompile(".*"),
 							},
 							Value: "5",
 						},
@@ -149,7 +153,7 @@ func TestPduToSample(t *testing.T) {
 					"Blank": {
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile("^XXXX$"),
+								Regexp: regexp.MustCompile("^XXXX$"),
 							},
 							Value: "4",
 						},
@@ -157,7 +161,7 @@ func TestPduToSample(t *testing.T) {
 					"Extension": {
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile(".*"),
+								Regexp: regexp.MustCompile(".*"),
 							},
 							Value: "5",
 						},
@@ -165,19 +169,19 @@ func TestPduToSample(t *testing.T) {
 					"MultipleRegexes": {
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile("^XXXX$"),
+								Regexp: regexp.MustCompile("^XXXX$"),
 							},
 							Value: "123",
 						},
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile("123.*"),
+								Regexp: regexp.MustCompile("123.*"),
 							},
 							Value: "999",
 						},
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile(".*"),
+								Regexp: regexp.MustCompile(".*"),
 							},
 							Value: "777",
 						},
@@ -185,7 +189,7 @@ func TestPduToSample(t *testing.T) {
 					"Template": {
 						{
 							Regex: config.Regexp{
-								regexp.MustCompile(`(\d.\d+)`),
+								Regexp: regexp.MustCompile(`(\d.\d+)`),
 							},
 							Value: "$1",
 						},
@@ -213,7 +217,7 @@ func TestPduToSample(t *testing.T) {
 				RegexpExtracts: map[string][]config.RegexpExtract{
 					"": {
 						{
-							Regex: config.Regexp{regexp.MustCompile(`(.*)`)},
+							Regex: config.Regexp{Regexp: regexp.MustCompile(`(.*)`)},
 							Value: "$1",
 						},
 					},
@@ -238,7 +242,7 @@ func TestPduToSample(t *testing.T) {
 				RegexpExtracts: map[string][]config.RegexpExtract{
 					"": {
 						{
-							Regex: config.Regexp{regexp.MustCompile(`(.*)`)},
+							Regex: config.Regexp{Regexp: regexp.MustCompile(`(.*)`)},
 							Value: "$1",
 						},
 					},
@@ -428,7 +432,7 @@ func TestPduToSample(t *testing.T) {
 				Help:    "Help string",
 				Indexes: []*config.Index{{Labelname: "foo", Type: "DisplayString"}},
 				RegexpExtracts: map[string][]config.RegexpExtract{
-					"": {{Value: "1", Regex: config.Regexp{regexp.MustCompile(".*")}}},
+					"": {{Value: "1", Regex: config.Regexp{Regexp: regexp.MustCompile(".*")}}},
 				},
 			},
 			oidToPdu:        make(map[string]gosnmp.SnmpPDU),
@@ -620,7 +624,7 @@ func TestPduToSample(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		metrics := pduToSamples(c.indexOids, c.pdu, c.metric, c.oidToPdu, promslog.NewNopLogger(), Metrics{})
+		metrics := pduToSamples(c.indexOids, c.pdu, newMetricPlan(c.metric), c.oidToPdu, promslog.NewNopLogger(), Metrics{})
 		metric := &io_prometheus_client.Metric{}
 		expected := map[string]struct{}{}
 		for _, e := range c.expectedMetrics {
@@ -1315,7 +1319,7 @@ func TestIndexesToLabels(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got := indexesToLabels(c.oid, &c.metric, c.oidToPdu, Metrics{})
+		got, _ := indexesToLabels(c.oid, newMetricPlan(&c.metric), c.oidToPdu, Metrics{})
 		if !reflect.DeepEqual(got, c.result) {
 			t.Errorf("indexesToLabels(%v, %v, %v): got %v, want %v", c.oid, c.metric, c.oidToPdu, got, c.result)
 		}
@@ -1365,7 +1369,11 @@ func TestFilterAllowedIndices(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		got := filterAllowedIndices(promslog.NewNopLogger(), c.filter, pdus, c.allowedList, Metrics{})
+		plan, err := CompileModule(&config.Module{Filters: []config.DynamicFilter{c.filter}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := filterAllowedIndices(promslog.NewNopLogger(), c.filter, plan.filterValues[0], pdus, c.allowedList, Metrics{})
 		if !reflect.DeepEqual(got, c.result) {
 			t.Errorf("filterAllowedIndices(%v): got %v, want %v", c.filter, got, c.result)
 		}
@@ -1658,7 +1666,7 @@ func TestScrapeTarget(t *testing.T) {
 		tt := c
 		t.Run(tt.name, func(t *testing.T) {
 			mock := scraper.NewMockSNMPScraper(tt.getResponse, tt.walkResponses)
-			results, err := ScrapeTarget(mock, "someTarget", auth, tt.module, promslog.NewNopLogger(), Metrics{})
+			results, err := ScrapeTarget(context.Background(), mock, "someTarget", auth, tt.module, promslog.NewNopLogger(), Metrics{})
 			if err != nil {
 				t.Errorf("ScrapeTarget returned an error: %v", err)
 			}
@@ -1681,3 +1689,268 @@ func TestScrapeTarget(t *testing.T) {
 		})
 	}
 }
+
+func TestScrapeTargetPartialResults(t *testing.T) {
+	module := &config.Module{
+		Get:  []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.5.0"},
+		Walk: []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.4.1.9.9.13", "1.3.6.1.2.1.31.1.1.1.18"},
+		WalkParams: config.WalkParams{
+			MaxRepetitions: 1,
+			PartialResults: true,
+		},
+	}
+	getResponse := map[string]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.1.5.0": {Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.1.5.0", Value: "router1"},
+	}
+	walkResponses := map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1.2": {
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+		},
+		"1.3.6.1.4.1.9.9.13": {
+			{Type: gosnmp.Integer, Name: ".1.3.6.1.4.1.9.9.13.1.3.1.3.1", Value: 42},
+		},
+		"1.3.6.1.2.1.31.1.1.1.18": {
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.31.1.1.1.18.1", Value: "uplink"},
+		},
+	}
+	timeout := errors.New("request timeout (after 3 retries)")
+
+	mock := scraper.NewMockSNMPScraper(getResponse, walkResponses)
+	mock.GetErrors = map[string]error{"1.3.6.1.2.1.1.1.0": timeout}
+	mock.WalkErrors = map[string]error{"1.3.6.1.4.1.9.9.13": timeout}
+
+	results, err := ScrapeTarget(context.Background(), mock, "someTarget", &config.Auth{Version: 2}, module, promslog.NewNopLogger(), Metrics{})
+	if err != nil {
+		t.Fatalf("ScrapeTarget returned an error: %v", err)
+	}
+	expectPdus := []gosnmp.SnmpPDU{
+		{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.1.5.0", Value: "router1"},
+		{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+		{Type: gosnmp.Integer, Name: ".1.3.6.1.4.1.9.9.13.1.3.1.3.1", Value: 42},
+		{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.31.1.1.1.18.1", Value: "uplink"},
+	}
+	if !reflect.DeepEqual(results.pdus, expectPdus) {
+		t.Errorf("Expected PDUs %v, got %v", expectPdus, results.pdus)
+	}
+	expectErrors := []scrapeError{
+		{oid: "1.3.6.1.2.1.1.1.0", reason: "timeout"},
+		{oid: "1.3.6.1.4.1.9.9.13", reason: "timeout"},
+	}
+	if !reflect.DeepEqual(results.errors, expectErrors) {
+		t.Errorf("Expected errors %v, got %v", expectErrors, results.errors)
+	}
+
+	// Without partial_results the first failure fails the module.
+	module.WalkParams.PartialResults = false
+	mock = scraper.NewMockSNMPScraper(getResponse, walkResponses)
+	mock.WalkErrors = map[string]error{"1.3.6.1.4.1.9.9.13": timeout}
+	if _, err := ScrapeTarget(context.Background(), mock, "someTarget", &config.Auth{Version: 2}, module, promslog.NewNopLogger(), Metrics{}); err == nil {
+		t.Error("Expected ScrapeTarget to fail without partial_results")
+	}
+}
+
+// testMetrics returns exporter metrics that are not registered anywhere.
+func testMetrics() Metrics {
+	return Metrics{
+		SNMPCollectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test"}, []string{"module"}),
+		SNMPUnexpectedPduType:  prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		SNMPDuration:           prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test"}),
+		SNMPPackets:            prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		SNMPRetries:            prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		SNMPInflight:           prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}),
+		SNMPCoalesced:          prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		SNMPSessionQueueDepth:  prometheus.NewGauge(prometheus.GaugeOpts{Name: "test"}),
+		SNMPSessionWait:        prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test"}),
+		SNMPSessionRejections:  prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+		SNMPSessionsReused:     prometheus.NewCounter(prometheus.CounterOpts{Name: "test"}),
+	}
+}
+
+// useScraper makes collectors scrape client instead of the target.
+func useScraper(t *testing.T, client scraper.SNMPScraper) {
+	newScraper := NewScraper
+	t.Cleanup(func() { NewScraper = newScraper })
+	NewScraper = func(*slog.Logger, string, string, bool) (scraper.SNMPScraper, error) {
+		return client, nil
+	}
+}
+
+// errorInfo collects c and returns the reasons in snmp_scrape_error_info by
+// module, and the number of invalid samples.
+func errorInfo(t *testing.T, c prometheus.Collector) (map[string][]string, int) {
+	t.Helper()
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	reasons, invalid := map[string][]string{}, 0
+	for m := range ch {
+		var out io_prometheus_client.Metric
+		if err := m.Write(&out); err != nil {
+			invalid++
+			continue
+		}
+		if !strings.Contains(m.Desc().String(), `"snmp_scrape_error_info"`) {
+			continue
+		}
+		labels := map[string]string{}
+		for _, l := range out.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		reasons[labels["module"]] = append(reasons[labels["module"]], labels["reason"])
+	}
+	return reasons, invalid
+}
+
+func TestCollectErrorInfo(t *testing.T) {
+	walkParams := config.DefaultWalkParams
+	partial := walkParams
+	partial.PartialResults = true
+	modules := []*NamedModule{
+		NewNamedModule("system", &config.Module{Get: []string{"1.3.6.1.2.1.1.5.0"}, WalkParams: walkParams}),
+		NewNamedModule("if_mib", &config.Module{Walk: []string{"1.3.6.1.2.1.2"}, WalkParams: partial}),
+	}
+	auth := &config.Auth{Version: 2, Community: "public"}
+
+	// Modules with partial_results report the reasons of the OIDs that
+	// failed, while a module without it fails the scrape.
+	timeout := errors.New("request timeout (after 3 retries)")
+	mock := scraper.NewMockSNMPScraper(nil, nil)
+	mock.GetErrors = map[string]error{"1.3.6.1.2.1.1.5.0": timeout}
+	mock.WalkErrors = map[string]error{"1.3.6.1.2.1.2": timeout}
+	useScraper(t, mock)
+	c := New(context.Background(), "10.0.0.1", "public_v2", "", "", "", auth, modules, promslog.NewNopLogger(), testMetrics(), 1, false)
+	reasons, invalid := errorInfo(t, c)
+	if !reflect.DeepEqual(reasons, map[string][]string{"if_mib": {"timeout"}}) || invalid != 1 {
+		t.Errorf("Expected a timeout for the if_mib module and a failed system module, got %v and %d invalid samples", reasons, invalid)
+	}
+}
+
+func TestLearnedRepetitions(t *testing.T) {
+	c := Collector{target: "10.0.0.1", authName: "public_v2"}
+	ifMIB := NewNamedModule("if_mib", &config.Module{})
+	if c.repetitions(ifMIB) != c.repetitions(ifMIB) {
+		t.Error("Expected the same repetitions for the same target, module and auth")
+	}
+	if c.repetitions(ifMIB) == c.repetitions(NewNamedModule("system", &config.Module{})) {
+		t.Error("Expected other repetitions for another module")
+	}
+	other := c
+	other.authName = "v3_readonly"
+	if c.repetitions(ifMIB) == other.repetitions(ifMIB) {
+		t.Error("Expected other repetitions for another auth")
+	}
+}
+
+func TestScrapeTargetBisectGets(t *testing.T) {
+	module := &config.Module{
+		Get:        []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.2.0", "1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.4.0", "1.3.6.1.2.1.1.5.0"},
+		WalkParams: config.WalkParams{MaxRepetitions: 5},
+	}
+	getResponse := map[string]gosnmp.SnmpPDU{}
+	for _, oid := range module.Get {
+		getResponse[oid] = gosnmp.SnmpPDU{Type: gosnmp.Integer, Name: "." + oid, Value: 1}
+	}
+
+	mock := scraper.NewMockSNMPScraper(getResponse, nil)
+	mock.GetErrorStatuses = map[string]gosnmp.SNMPError{"1.3.6.1.2.1.1.4.0": gosnmp.GenErr}
+	results, err := ScrapeTarget(context.Background(), mock, "someTarget", &config.Auth{Version: 2}, module, promslog.NewNopLogger(), Metrics{})
+	if err != nil {
+		t.Fatalf("ScrapeTarget returned an error: %v", err)
+	}
+	if len(results.pdus) != 4 {
+		t.Errorf("Expected the 4 other OIDs to be returned, got %v", results.pdus)
+	}
+	expectErrors := []scrapeError{{oid: "1.3.6.1.2.1.1.4.0", reason: "gen_err"}}
+	if !reflect.DeepEqual(results.errors, expectErrors) {
+		t.Errorf("Expected errors %v, got %v", expectErrors, results.errors)
+	}
+	// The batch of 5 is split into 2 and 3, then the 3 into 1 and 2, and
+	// the 2 into 1 and 1.
+	expectGets := 5 + 2 + 3 + 1 + 2 + 1 + 1
+	if got := len(mock.CallGet()); got != expectGets {
+		t.Errorf("Expected %d OIDs to be requested, got %d: %v", expectGets, got, mock.CallGet())
+	}
+
+	// Other error statuses still fail the module.
+	mock = scraper.NewMockSNMPScraper(getResponse, nil)
+	mock.GetErrorStatuses = map[string]gosnmp.SNMPError{"1.3.6.1.2.1.1.4.0": gosnmp.NoAccess}
+	if _, err := ScrapeTarget(context.Background(), mock, "someTarget", &config.Auth{Version: 2}, module, promslog.NewNopLogger(), Metrics{}); err == nil {
+		t.Error("Expected ScrapeTarget to fail")
+	}
+}
+
+func TestFitToBudget(t *testing.T) {
+	cases := []struct {
+		remaining   time.Duration
+		timeout     time.Duration
+		retries     int
+		wantTimeout time.Duration
+		wantRetries int
+	}{
+		{remaining: time.Minute, timeout: 5 * time.Second, retries: 3, wantTimeout: 5 * time.Second, wantRetries: 3},
+		{remaining: 12 * time.Second, timeout: 5 * time.Second, retries: 3, wantTimeout: 5 * time.Second, wantRetries: 1},
+		{remaining: 5 * time.Second, timeout: 5 * time.Second, retries: 3, wantTimeout: 5 * time.Second, wantRetries: 0},
+		{remaining: 2 * time.Second, timeout: 5 * time.Second, retries: 3, wantTimeout: 2 * time.Second, wantRetries: 0},
+	}
+	for _, c := range cases {
+		timeout, retries := fitToBudget(c.remaining, c.timeout, c.retries)
+		if timeout != c.wantTimeout || retries != c.wantRetries {
+			t.Errorf("fitToBudget(%s, %s, %d): got (%s, %d), want (%s, %d)",
+				c.remaining, c.timeout, c.retries, timeout, retries, c.wantTimeout, c.wantRetries)
+		}
+	}
+}
+
+func TestScrapeTargetBudgetExhausted(t *testing.T) {
+	module := &config.Module{
+		Get:  []string{"1.3.6.1.2.1.1.1.0"},
+		Walk: []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.31.1.1.1.18"},
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	mock := scraper.NewMockSNMPScraper(nil, nil)
+	results, err := ScrapeTarget(ctx, mock, "someTarget", &config.Auth{Version: 2}, module, promslog.NewNopLogger(), Metrics{})
+	if err != nil {
+		t.Fatalf("ScrapeTarget returned an error: %v", err)
+	}
+	if len(mock.CallGet()) != 0 || len(mock.CallWalk()) != 0 {
+		t.Errorf("Expected no requests once the budget is exhausted, got gets %v and walks %v", mock.CallGet(), mock.CallWalk())
+	}
+	expectErrors := []scrapeError{
+		{oid: "1.3.6.1.2.1.1.1.0", reason: scraper.ReasonBudgetExhausted},
+		{oid: "1.3.6.1.2.1.2.2.1.2", reason: scraper.ReasonBudgetExhausted},
+		{oid: "1.3.6.1.2.1.31.1.1.1.18", reason: scraper.ReasonBudgetExhausted},
+	}
+	if !reflect.DeepEqual(results.errors, expectErrors) {
+		t.Errorf("Expected errors %v, got %v", expectErrors, results.errors)
+	}
+}
+
+func TestCollectSubtreeErrorsOnce(t *testing.T) {
+	walkParams := config.DefaultWalkParams
+	walkParams.PartialResults = true
+	// The OID is fetched for two metrics, and fails both times.
+	modules := []*NamedModule{
+		NewNamedModule("system", &config.Module{Get: []string{"1.3.6.1.2.1.1.5.0", "1.3.6.1.2.1.1.5.0"}, WalkParams: walkParams}),
+	}
+	auth := &config.Auth{Version: 2, Community: "public"}
+	mock := scraper.NewMockSNMPScraper(nil, nil)
+	mock.GetErrors = map[string]error{"1.3.6.1.2.1.1.5.0": errors.New("request timeout (after 3 retries)")}
+	useScraper(t, mock)
+	c := New(context.Background(), "10.0.0.1", "public_v2", "", "", "", auth, modules, promslog.NewNopLogger(), testMetrics(), 1, false)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error gathering the scrape: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() == "snmp_scrape_subtree_errors" && len(f.GetMetric()) != 1 {
+			t.Errorf("Expected the failed OID once, got %d samples", len(f.GetMetric()))
+		}
+	}
+}
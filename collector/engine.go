@@ -0,0 +1,194 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// How long the engine of a target that is no longer scraped is remembered.
+const engineCacheTTL = time.Hour
+
+var (
+	snmpEngineBootsDesc = prometheus.NewDesc("snmp_engine_boots", "Number of times the SNMPv3 engine of the target has restarted, as last reported by it.", nil, nil)
+	snmpEngineTimeDesc  = prometheus.NewDesc("snmp_engine_time_seconds", "Seconds since the SNMPv3 engine of the target last restarted.", nil, nil)
+)
+
+// engineCacheKey identifies the SNMPv3 engine of a target, as seen by an auth.
+type engineCacheKey struct {
+	target string
+	auth   string
+}
+
+// engineCacheEntry is what was learned about the engine of a target, with
+// the keys of the auth localized to it.
+type engineCacheEntry struct {
+	// The auth the keys were localized for, so that entries are not used
+	// once the auth has changed.
+	auth       config.Auth
+	engineID   string
+	boots      uint32
+	time       uint32
+	seen       time.Time
+	secretKey  []byte
+	privacyKey []byte
+}
+
+// engineTime returns the engine time at now, assuming the engine clock
+// advanced at the same rate as ours.
+func (e engineCacheEntry) engineTime(now time.Time) uint32 {
+	return e.time + uint32(now.Sub(e.seen)/time.Second)
+}
+
+// engineCache remembers the SNMPv3 engines of targets across scrapes, so that
+// each scrape does not start with an engine discovery and the localization of
+// the keys.
+type engineCache struct {
+	mu        sync.Mutex
+	entries   map[engineCacheKey]engineCacheEntry
+	lastSweep time.Time
+}
+
+var engines = newEngineCache()
+
+func newEngineCache() *engineCache {
+	return &engineCache{entries: make(map[engineCacheKey]engineCacheEntry)}
+}
+
+func (c *engineCache) get(key engineCacheKey, auth config.Auth) (engineCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.auth != auth {
+		return engineCacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *engineCache) put(key engineCacheKey, e engineCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.seen.Sub(c.lastSweep) >= cacheSweepInterval {
+		for k, old := range c.entries {
+			if e.seen.Sub(old.seen) >= engineCacheTTL {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = e.seen
+	}
+	c.entries[key] = e
+}
+
+func (c *engineCache) delete(key engineCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// restore sets up the security parameters of a v3 client with the engine
+// of the target, if known.
+func (c *engineCache) restore(key engineCacheKey, auth config.Auth, g *gosnmp.GoSNMP, now time.Time) {
+	usm, ok := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if !ok {
+		return
+	}
+	e, ok := c.get(key, auth)
+	if !ok {
+		return
+	}
+	usm.AuthoritativeEngineID = e.engineID
+	usm.AuthoritativeEngineBoots = e.boots
+	usm.AuthoritativeEngineTime = e.engineTime(now)
+	usm.SecretKey = e.secretKey
+	usm.PrivacyKey = e.privacyKey
+	if g.ContextEngineID == "" {
+		g.ContextEngineID = e.engineID
+	}
+}
+
+// store remembers the engine a v3 client last talked to.
+func (c *engineCache) store(key engineCacheKey, auth config.Auth, g *gosnmp.GoSNMP, now time.Time) {
+	usm, ok := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if !ok {
+		return
+	}
+	// The parameters are only read once the client is done with them.
+	e := usm.Copy().(*gosnmp.UsmSecurityParameters)
+	if e.AuthoritativeEngineID == "" {
+		return
+	}
+	c.put(key, engineCacheEntry{
+		auth:       auth,
+		engineID:   e.AuthoritativeEngineID,
+		boots:      e.AuthoritativeEngineBoots,
+		time:       e.AuthoritativeEngineTime,
+		seen:       now,
+		secretKey:  e.SecretKey,
+		privacyKey: e.PrivacyKey,
+	})
+}
+
+// engineClient is a v3 client that stores the engine of the target in the
+// engine cache once it is closed, unless a request failed in a way that
+// suggests the cached engine is stale.
+type engineClient struct {
+	scraper.SNMPScraper
+	cache *engineCache
+	key   engineCacheKey
+	auth  config.Auth
+	stale bool
+}
+
+func (e *engineClient) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	packet, err := e.SNMPScraper.Get(oids)
+	e.check(err)
+	return packet, err
+}
+
+func (e *engineClient) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	pdus, err := e.SNMPScraper.WalkAll(oid)
+	e.check(err)
+	return pdus, err
+}
+
+func (e *engineClient) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	err := e.SNMPScraper.Walk(oid, fn)
+	e.check(err)
+	return err
+}
+
+func (e *engineClient) check(err error) {
+	switch scraper.Reason(err) {
+	case scraper.ReasonNotInTimeWindow, scraper.ReasonUnknownEngineID, scraper.ReasonAuthFailure:
+		e.stale = true
+	}
+}
+
+func (e *engineClient) Close() error {
+	if e.stale {
+		e.cache.delete(e.key)
+	} else {
+		e.SetOptions(func(g *gosnmp.GoSNMP) {
+			e.cache.store(e.key, e.auth, g, time.Now())
+		})
+	}
+	return e.SNMPScraper.Close()
+}
@@ -0,0 +1,120 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+func TestEngineCache(t *testing.T) {
+	cache := newEngineCache()
+	key := engineCacheKey{target: "10.0.0.1", auth: "v3"}
+	auth := config.Auth{Version: 3, SecurityLevel: "authPriv", Username: "user", Password: "password", AuthProtocol: "SHA", PrivPassword: "privpassword", PrivProtocol: "AES"}
+	now := time.Now()
+
+	// A client that has discovered the engine of the target.
+	discovered := &gosnmp.GoSNMP{}
+	auth.ConfigureSNMP(discovered, "")
+	usm := discovered.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	usm.AuthoritativeEngineID = "\x80\x00\x1f\x88\x80engine"
+	usm.AuthoritativeEngineBoots = 7
+	usm.AuthoritativeEngineTime = 1000
+	if err := usm.InitSecurityKeys(); err != nil {
+		t.Fatal(err)
+	}
+	cache.store(key, auth, discovered, now)
+
+	// A later client starts with the engine and keys.
+	g := &gosnmp.GoSNMP{}
+	auth.ConfigureSNMP(g, "")
+	cache.restore(key, auth, g, now.Add(30*time.Second))
+	got := g.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if got.AuthoritativeEngineID != usm.AuthoritativeEngineID || got.AuthoritativeEngineBoots != 7 || got.AuthoritativeEngineTime != 1030 {
+		t.Errorf("Unexpected engine %q boots %d time %d", got.AuthoritativeEngineID, got.AuthoritativeEngineBoots, got.AuthoritativeEngineTime)
+	}
+	if !bytes.Equal(got.SecretKey, usm.SecretKey) || !bytes.Equal(got.PrivacyKey, usm.PrivacyKey) || len(got.SecretKey) == 0 {
+		t.Error("Expected the localized keys to be restored")
+	}
+	if g.ContextEngineID != usm.AuthoritativeEngineID {
+		t.Errorf("Expected the context engine ID to default to the engine, got %q", g.ContextEngineID)
+	}
+
+	// Keys localized for another password are not used.
+	changed := auth
+	changed.Password = "otherpassword"
+	g = &gosnmp.GoSNMP{}
+	changed.ConfigureSNMP(g, "")
+	cache.restore(key, changed, g, now)
+	if got := g.SecurityParameters.(*gosnmp.UsmSecurityParameters); got.AuthoritativeEngineID != "" || got.SecretKey != nil {
+		t.Error("Expected no engine for a changed auth")
+	}
+
+	// Nothing is stored for a client that did not discover the engine.
+	undiscovered := &gosnmp.GoSNMP{}
+	auth.ConfigureSNMP(undiscovered, "")
+	cache.store(engineCacheKey{target: "10.0.0.2", auth: "v3"}, auth, undiscovered, now)
+	if _, ok := cache.get(engineCacheKey{target: "10.0.0.2", auth: "v3"}, auth); ok {
+		t.Error("Expected no engine for a client without one")
+	}
+
+	// Engines of targets that are no longer scraped are swept.
+	cache.store(engineCacheKey{target: "10.0.0.3", auth: "v3"}, auth, discovered, now.Add(engineCacheTTL))
+	if _, ok := cache.get(key, auth); ok {
+		t.Error("Expected the engine to be swept")
+	}
+}
+
+// failingScraper fails every request with an error.
+type failingScraper struct {
+	scraper.SNMPScraper
+	err error
+}
+
+func (f failingScraper) Get([]string) (*gosnmp.SnmpPacket, error) {
+	return nil, f.err
+}
+
+func TestEngineClientInvalidation(t *testing.T) {
+	auth := config.Auth{Version: 3, Username: "user"}
+	key := engineCacheKey{target: "10.0.0.1", auth: "v3"}
+	for _, c := range []struct {
+		err   error
+		stale bool
+	}{
+		{&scraper.Error{Reason: scraper.ReasonNotInTimeWindow, Err: gosnmp.ErrNotInTimeWindow}, true},
+		{&scraper.Error{Reason: scraper.ReasonUnknownEngineID, Err: gosnmp.ErrUnknownEngineID}, true},
+		{&scraper.Error{Reason: scraper.ReasonTimeout, Err: gosnmp.ErrNotInTimeWindow}, false},
+	} {
+		cache := newEngineCache()
+		cache.put(key, engineCacheEntry{auth: auth, engineID: "engine", seen: time.Now()})
+		client := &engineClient{
+			SNMPScraper: failingScraper{SNMPScraper: scraper.NewMockSNMPScraper(nil, nil), err: c.err},
+			cache:       cache,
+			key:         key,
+			auth:        auth,
+		}
+		client.Get([]string{"1.3.6.1.2.1.1.1.0"})
+		client.Close()
+		if _, ok := cache.get(key, auth); ok == c.stale {
+			t.Errorf("%v: expected the engine to be invalidated: %v", c.err, c.stale)
+		}
+	}
+}
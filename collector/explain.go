@@ -0,0 +1,231 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// ExplainedIndex is an index of a PDU decoded into a label.
+type ExplainedIndex struct {
+	Labelname string `json:"labelname"`
+	Type      string `json:"type"`
+	OID       string `json:"oid"`
+	Value     string `json:"value"`
+}
+
+// ExplainedLookup is a lookup performed for a PDU.
+type ExplainedLookup struct {
+	Labelname string `json:"labelname"`
+	// OID is the OID that was looked up, empty if the lookup only removes
+	// the label.
+	OID string `json:"oid,omitempty"`
+	// Found is whether the looked up OID was fetched.
+	Found bool   `json:"found"`
+	Value string `json:"value"`
+}
+
+// ExplainedPDU is how a PDU that matched a metric was turned into samples.
+type ExplainedPDU struct {
+	OID       string            `json:"oid"`
+	Metric    string            `json:"metric"`
+	MetricOID string            `json:"metric_oid"`
+	Type      string            `json:"type"`
+	Indexes   []ExplainedIndex  `json:"indexes,omitempty"`
+	Lookups   []ExplainedLookup `json:"lookups,omitempty"`
+	// Samples in the text exposition format.
+	Samples []string `json:"samples"`
+	// Errors of samples that could not be created.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// EmptyLookup is a lookup that resolved to an empty label.
+type EmptyLookup struct {
+	PDU       string `json:"pdu"`
+	Labelname string `json:"labelname"`
+	OID       string `json:"oid"`
+}
+
+// UnsupportedOID is an OID the target reported as not existing.
+type UnsupportedOID struct {
+	OID    string `json:"oid"`
+	Status string `json:"status"`
+}
+
+// ModuleExplanation is how the PDUs of a module were turned into samples.
+type ModuleExplanation struct {
+	Module string         `json:"module"`
+	PDUs   []ExplainedPDU `json:"pdus"`
+	// Unmatched are the PDUs that matched no metric and were not used by a
+	// lookup.
+	Unmatched    []string         `json:"unmatched"`
+	Unsupported  []UnsupportedOID `json:"unsupported"`
+	EmptyLookups []EmptyLookup    `json:"empty_lookups"`
+	Errors       []RawError       `json:"errors,omitempty"`
+	Error        string           `json:"error,omitempty"`
+}
+
+// Explain scrapes each module of the collector in turn, like Raw, and reports
+// how each PDU was turned into samples.
+func (c Collector) Explain() ([]ModuleExplanation, error) {
+	modules := make([]ModuleExplanation, 0, len(c.modules))
+	err := c.scrapeEach(func(m *NamedModule, plan *ModulePlan, results ScrapeResults, err error) {
+		e := explainResults(plan, results, c.logger.With("module", m.name), c.metrics)
+		e.Module = m.name
+		if err != nil {
+			e.Error = fmt.Sprintf("%s: %s", scraper.Reason(err), err)
+		}
+		modules = append(modules, e)
+	})
+	return modules, err
+}
+
+func explainResults(plan *ModulePlan, results ScrapeResults, logger *slog.Logger, metrics Metrics) ModuleExplanation {
+	e := ModuleExplanation{
+		PDUs:         []ExplainedPDU{},
+		Unmatched:    []string{},
+		Unsupported:  []UnsupportedOID{},
+		EmptyLookups: []EmptyLookup{},
+	}
+	for _, u := range results.unsupported {
+		e.Unsupported = append(e.Unsupported, UnsupportedOID{OID: u.oid, Status: u.status})
+	}
+	for _, se := range results.errors {
+		e.Errors = append(e.Errors, RawError{OID: se.oid, Reason: string(se.reason)})
+	}
+
+	oidToPdu := make(map[string]gosnmp.SnmpPDU, len(results.pdus))
+	for _, pdu := range results.pdus {
+		oidToPdu[pdu.Name[1:]] = pdu
+	}
+	lookedUp := map[string]bool{}
+	var unmatched []string
+	seen := make(map[string]bool, len(results.pdus))
+	// PDUs are explained in the order they were fetched.
+	for _, pdu := range results.pdus {
+		oid := pdu.Name[1:]
+		if seen[oid] {
+			continue
+		}
+		seen[oid] = true
+		metric, indexOids := matchMetric(plan.metricTree, oidToList(oid))
+		if metric == nil {
+			unmatched = append(unmatched, oid)
+			continue
+		}
+		p := ExplainedPDU{
+			OID:       oid,
+			Metric:    metric.Name,
+			MetricOID: metric.Oid,
+			Type:      metric.Type,
+			Indexes:   explainIndexes(indexOids, metric.Metric),
+			Lookups:   explainLookups(indexOids, metric, oidToPdu, metrics),
+			Samples:   []string{},
+		}
+		for _, l := range p.Lookups {
+			if l.Found {
+				lookedUp[l.OID] = true
+			}
+			if l.OID != "" && l.Value == "" {
+				e.EmptyLookups = append(e.EmptyLookups, EmptyLookup{PDU: oid, Labelname: l.Labelname, OID: l.OID})
+			}
+		}
+		for _, sample := range pduToSamples(indexOids, &pdu, metric, oidToPdu, logger, metrics) {
+			m := &dto.Metric{}
+			if err := sample.Write(m); err != nil {
+				p.Errors = append(p.Errors, err.Error())
+				continue
+			}
+			p.Samples = append(p.Samples, formatSample(metric.nameOf(sample.Desc()), m))
+		}
+		e.PDUs = append(e.PDUs, p)
+	}
+	for _, oid := range unmatched {
+		if !lookedUp[oid] {
+			e.Unmatched = append(e.Unmatched, oid)
+		}
+	}
+	return e
+}
+
+// explainIndexes decodes the indexes of a PDU the same way indexesToLabels
+// does.
+func explainIndexes(indexOids []int, metric *config.Metric) []ExplainedIndex {
+	var indexes []ExplainedIndex
+	for _, index := range metric.Indexes {
+		str, subOid, remainingOids := indexOidsAsString(indexOids, index.Type, index.FixedSize, index.Implied, index.EnumValues)
+		indexes = append(indexes, ExplainedIndex{
+			Labelname: index.Labelname,
+			Type:      index.Type,
+			OID:       listToOid(subOid),
+			Value:     strings.ToValidUTF8(str, "�"),
+		})
+		indexOids = remainingOids
+	}
+	return indexes
+}
+
+// explainLookups reports the OID each lookup of a PDU used, and the value of
+// the label that came out of indexesToLabels.
+func explainLookups(indexOids []int, metric *metricPlan, oidToPdu map[string]gosnmp.SnmpPDU, metrics Metrics) []ExplainedLookup {
+	if len(metric.lookups) == 0 {
+		return nil
+	}
+	labels, oids := indexesToLabels(indexOids, metric, oidToPdu, metrics)
+	lookups := make([]ExplainedLookup, 0, len(metric.lookups))
+	for i, lookup := range metric.lookups {
+		if oids[i] == "" {
+			lookups = append(lookups, ExplainedLookup{Labelname: lookup.Labelname})
+			continue
+		}
+		_, found := oidToPdu[oids[i]]
+		lookups = append(lookups, ExplainedLookup{Labelname: lookup.Labelname, OID: oids[i], Found: found, Value: labels[lookup.Labelname]})
+	}
+	return lookups
+}
+
+// formatSample renders a sample in the text exposition format.
+func formatSample(name string, m *dto.Metric) string {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(m.Label) > 0 {
+		b.WriteByte('{')
+		for i, l := range m.Label {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=%q", l.GetName(), l.GetValue())
+		}
+		b.WriteByte('}')
+	}
+	var value float64
+	switch {
+	case m.Gauge != nil:
+		value = m.Gauge.GetValue()
+	case m.Counter != nil:
+		value = m.Counter.GetValue()
+	case m.Untyped != nil:
+		value = m.Untyped.GetValue()
+	}
+	fmt.Fprintf(&b, " %g", value)
+	return b.String()
+}
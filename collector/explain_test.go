@@ -0,0 +1,104 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+func TestExplainResults(t *testing.T) {
+	module := config.DefaultModule
+	module.Get = []string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.9.0"}
+	module.Walk = []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.2.2.1.10", "1.3.6.1.2.1.99"}
+	module.Metrics = []*config.Metric{
+		{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"},
+		{
+			Name:    "ifInOctets",
+			Oid:     "1.3.6.1.2.1.2.2.1.10",
+			Type:    "counter",
+			Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}},
+			Lookups: []*config.Lookup{{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"}},
+		},
+	}
+	mock := scraper.NewMockSNMPScraper(
+		map[string]gosnmp.SnmpPDU{
+			"1.3.6.1.2.1.1.3.0": {Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(100)},
+		},
+		map[string][]gosnmp.SnmpPDU{
+			"1.3.6.1.2.1.2.2.1.2": {
+				{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: "eth0"},
+			},
+			"1.3.6.1.2.1.2.2.1.10": {
+				{Name: ".1.3.6.1.2.1.2.2.1.10.1", Type: gosnmp.Counter32, Value: uint(10)},
+				{Name: ".1.3.6.1.2.1.2.2.1.10.2", Type: gosnmp.Counter32, Value: uint(20)},
+			},
+			"1.3.6.1.2.1.99": {
+				{Name: ".1.3.6.1.2.1.99.1.0", Type: gosnmp.Integer, Value: 1},
+			},
+		},
+	)
+	results, err := ScrapeTarget(context.Background(), mock, "someTarget", &config.Auth{Version: 2}, &module, promslog.NewNopLogger(), Metrics{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	plan, err := CompileModule(&module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := explainResults(plan, results, promslog.NewNopLogger(), Metrics{})
+
+	want := ModuleExplanation{
+		PDUs: []ExplainedPDU{
+			{
+				OID:       "1.3.6.1.2.1.1.3.0",
+				Metric:    "sysUpTime",
+				MetricOID: "1.3.6.1.2.1.1.3",
+				Type:      "gauge",
+				Samples:   []string{"sysUpTime 100"},
+			},
+			{
+				OID:       "1.3.6.1.2.1.2.2.1.10.1",
+				Metric:    "ifInOctets",
+				MetricOID: "1.3.6.1.2.1.2.2.1.10",
+				Type:      "counter",
+				Indexes:   []ExplainedIndex{{Labelname: "ifIndex", Type: "gauge", OID: "1", Value: "1"}},
+				Lookups:   []ExplainedLookup{{Labelname: "ifDescr", OID: "1.3.6.1.2.1.2.2.1.2.1", Found: true, Value: "eth0"}},
+				Samples:   []string{`ifInOctets{ifDescr="eth0",ifIndex="1"} 10`},
+			},
+			{
+				OID:       "1.3.6.1.2.1.2.2.1.10.2",
+				Metric:    "ifInOctets",
+				MetricOID: "1.3.6.1.2.1.2.2.1.10",
+				Type:      "counter",
+				Indexes:   []ExplainedIndex{{Labelname: "ifIndex", Type: "gauge", OID: "2", Value: "2"}},
+				Lookups:   []ExplainedLookup{{Labelname: "ifDescr", OID: "1.3.6.1.2.1.2.2.1.2.2", Value: ""}},
+				Samples:   []string{`ifInOctets{ifDescr="",ifIndex="2"} 20`},
+			},
+		},
+		Unmatched:    []string{"1.3.6.1.2.1.99.1.0"},
+		Unsupported:  []UnsupportedOID{{OID: "1.3.6.1.2.1.1.9.0", Status: "NoSuchObject"}},
+		EmptyLookups: []EmptyLookup{{PDU: "1.3.6.1.2.1.2.2.1.10.2", Labelname: "ifDescr", OID: "1.3.6.1.2.1.2.2.1.2.2"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected explanation:\ngot  %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// scrapeFlight is a scrape of a module in flight, whose results are shared
+// with the identical scrapes that start before it finishes.
+type scrapeFlight struct {
+	// The deadline of the scrape, zero without one.
+	deadline time.Time
+	done     chan struct{}
+	results  ScrapeResults
+	err      error
+}
+
+// covers reports whether the flight lasts as long as a scrape with the
+// deadline may, so that the scrape is not cut short by sharing it.
+func (f *scrapeFlight) covers(deadline time.Time) bool {
+	if f.deadline.IsZero() {
+		return true
+	}
+	return !deadline.IsZero() && !deadline.After(f.deadline)
+}
+
+// flightGroup coalesces concurrent scrapes of the same target and module.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*scrapeFlight
+	// joined is called when a scrape joins one in flight, for tests.
+	joined func()
+}
+
+var scrapeFlights = &flightGroup{flights: make(map[string]*scrapeFlight)}
+
+// do runs scrape, unless an identical scrape in flight with a deadline no
+// earlier than that of ctx can be shared, in which case its results are
+// waited for until ctx is done. scrape runs with the deadline of ctx but is
+// not cancelled along with it, so that the scrapes sharing it are not failed
+// when the one that started it goes away.
+func (g *flightGroup) do(ctx context.Context, key string, scrape func(ctx context.Context) (ScrapeResults, error)) (ScrapeResults, error, bool) {
+	deadline, _ := ctx.Deadline()
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok && f.covers(deadline) {
+		g.mu.Unlock()
+		if g.joined != nil {
+			g.joined()
+		}
+		select {
+		case <-f.done:
+			return f.results, f.err, true
+		case <-ctx.Done():
+			return ScrapeResults{}, ctx.Err(), true
+		}
+	}
+	// Later scrapes join this flight rather than one that ends earlier.
+	f := &scrapeFlight{deadline: deadline, done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+		g.mu.Unlock()
+		close(f.done)
+	}()
+
+	flightCtx := context.WithoutCancel(ctx)
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		flightCtx, cancel = context.WithDeadline(flightCtx, deadline)
+		defer cancel()
+	}
+	f.results, f.err = scrape(flightCtx)
+	return f.results, f.err, false
+}
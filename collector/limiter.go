@@ -0,0 +1,151 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+var (
+	maxSessions          = kingpin.Flag("snmp.max-sessions", "Maximum number of SNMP sessions open at the same time across all scrapes, 0 for no limit.").Default("0").Int()
+	maxSessionsPerTarget = kingpin.Flag("snmp.max-sessions-per-target", "Maximum number of SNMP sessions open to one target at the same time, 0 for no limit.").Default("0").Int()
+	maxQueuedSessions    = kingpin.Flag("snmp.max-queued-sessions", "Maximum number of SNMP sessions waiting for the session limits. Scrapes beyond that are rejected.").Default("100").Int()
+
+	// sessions is created on first use, after the flags are parsed.
+	sessions = sync.OnceValue(func() *sessionLimiter {
+		return newSessionLimiter(*maxSessions, *maxSessionsPerTarget, *maxQueuedSessions)
+	})
+
+	errSessionQueueFull = errors.New("too many SNMP sessions waiting for the session limits")
+)
+
+// sessionLimiter bounds the number of SNMP sessions open at the same time,
+// both overall and per target. Sessions that cannot be opened yet wait in a
+// bounded queue, in order of arrival.
+type sessionLimiter struct {
+	mu        sync.Mutex
+	global    int
+	perTarget int
+	maxQueue  int
+	open      int
+	targets   map[string]int
+	queue     []*sessionWaiter
+}
+
+type sessionWaiter struct {
+	target string
+	ready  chan struct{}
+}
+
+func newSessionLimiter(global, perTarget, maxQueue int) *sessionLimiter {
+	return &sessionLimiter{
+		global:    global,
+		perTarget: perTarget,
+		maxQueue:  maxQueue,
+		targets:   make(map[string]int),
+	}
+}
+
+// acquire waits until a session to target may be opened. The returned
+// function must be called once the session is closed.
+func (l *sessionLimiter) acquire(ctx context.Context, target string, metrics Metrics) (func(), error) {
+	release := func() { l.release(target) }
+	l.mu.Lock()
+	if l.available(target) {
+		l.take(target)
+		l.mu.Unlock()
+		return release, nil
+	}
+	if len(l.queue) >= l.maxQueue {
+		l.mu.Unlock()
+		metrics.SNMPSessionRejections.Inc()
+		return nil, errSessionQueueFull
+	}
+	w := &sessionWaiter{target: target, ready: make(chan struct{})}
+	l.queue = append(l.queue, w)
+	l.mu.Unlock()
+
+	metrics.SNMPSessionQueueDepth.Inc()
+	defer metrics.SNMPSessionQueueDepth.Dec()
+	start := time.Now()
+	defer func() { metrics.SNMPSessionWait.Observe(time.Since(start).Seconds()) }()
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	select {
+	case <-w.ready:
+		// The session was granted while the context was canceled.
+		l.mu.Unlock()
+		l.release(target)
+	default:
+		l.queue = slices.DeleteFunc(l.queue, func(q *sessionWaiter) bool { return q == w })
+		l.mu.Unlock()
+	}
+	return nil, ctx.Err()
+}
+
+// tryAcquire is like acquire, but fails rather than waits if a session to
+// target cannot be opened right away, or if other sessions are waiting.
+func (l *sessionLimiter) tryAcquire(target string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) > 0 || !l.available(target) {
+		return nil, false
+	}
+	l.take(target)
+	return func() { l.release(target) }, true
+}
+
+func (l *sessionLimiter) release(target string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open--
+	if l.targets[target]--; l.targets[target] <= 0 {
+		delete(l.targets, target)
+	}
+	// Wake the waiters that can now proceed, in order. Waiters for targets
+	// that are at their limit do not hold up the others.
+	for i := 0; i < len(l.queue); {
+		w := l.queue[i]
+		if l.global > 0 && l.open >= l.global {
+			return
+		}
+		if !l.available(w.target) {
+			i++
+			continue
+		}
+		l.take(w.target)
+		close(w.ready)
+		l.queue = slices.Delete(l.queue, i, i+1)
+	}
+}
+
+func (l *sessionLimiter) available(target string) bool {
+	return (l.global <= 0 || l.open < l.global) && (l.perTarget <= 0 || l.targets[target] < l.perTarget)
+}
+
+func (l *sessionLimiter) take(target string) {
+	l.open++
+	l.targets[target]++
+}
@@ -0,0 +1,153 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func limiterTestMetrics() Metrics {
+	return Metrics{
+		SNMPSessionQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_depth"}),
+		SNMPSessionWait:       prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_wait"}),
+		SNMPSessionRejections: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_rejections"}),
+	}
+}
+
+// acquireAsync starts acquiring a session and returns the channel its
+// release function is sent on.
+func acquireAsync(t *testing.T, l *sessionLimiter, target string, metrics Metrics) chan func() {
+	t.Helper()
+	ch := make(chan func(), 1)
+	go func() {
+		release, err := l.acquire(context.Background(), target, metrics)
+		if err != nil {
+			t.Errorf("Unexpected error acquiring session to %s: %v", target, err)
+			return
+		}
+		ch <- release
+	}()
+	return ch
+}
+
+func waitQueued(t *testing.T, l *sessionLimiter, n int) {
+	t.Helper()
+	for range 100 {
+		l.mu.Lock()
+		queued := len(l.queue)
+		l.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected %d queued sessions", n)
+}
+
+func TestSessionLimiter(t *testing.T) {
+	metrics := limiterTestMetrics()
+	l := newSessionLimiter(2, 1, 2)
+	ctx := context.Background()
+
+	releaseA, err := l.acquire(ctx, "a", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The per-target limit is reached for a, but not the global limit.
+	a2 := acquireAsync(t, l, "a", metrics)
+	waitQueued(t, l, 1)
+	releaseB, err := l.acquire(ctx, "b", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Now the global limit is reached as well.
+	c := acquireAsync(t, l, "c", metrics)
+	waitQueued(t, l, 2)
+	if got := testutil.ToFloat64(metrics.SNMPSessionQueueDepth); got != 2 {
+		t.Errorf("Expected a queue depth of 2, got %v", got)
+	}
+	if _, err := l.acquire(ctx, "d", metrics); !errors.Is(err, errSessionQueueFull) {
+		t.Errorf("Expected the queue to be full, got %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.SNMPSessionRejections); got != 1 {
+		t.Errorf("Expected 1 rejection, got %v", got)
+	}
+
+	// Releasing b lets c proceed, while the second session to a still waits.
+	releaseB()
+	(<-c)()
+	select {
+	case <-a2:
+		t.Fatal("Expected the second session to a to wait")
+	default:
+	}
+	releaseA()
+	(<-a2)()
+
+	if l.open != 0 || len(l.targets) != 0 || len(l.queue) != 0 {
+		t.Errorf("Expected the limiter to be empty, got %d open, %v, %d queued", l.open, l.targets, len(l.queue))
+	}
+}
+
+func TestSessionLimiterCanceled(t *testing.T) {
+	metrics := limiterTestMetrics()
+	l := newSessionLimiter(1, 0, 10)
+	release, err := l.acquire(context.Background(), "a", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx, "b", metrics); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to pass while waiting, got %v", err)
+	}
+	if len(l.queue) != 0 {
+		t.Errorf("Expected the canceled session to leave the queue")
+	}
+	release()
+	if l.open != 0 {
+		t.Errorf("Expected no open sessions, got %d", l.open)
+	}
+}
+
+func TestSessionLimiterTryAcquire(t *testing.T) {
+	metrics := limiterTestMetrics()
+	l := newSessionLimiter(0, 2, 10)
+	release, ok := l.tryAcquire("a")
+	if !ok {
+		t.Fatal("Expected a session to be available")
+	}
+	release2, err := l.acquire(context.Background(), "a", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.tryAcquire("a"); ok {
+		t.Error("Expected the per-target limit to be reached")
+	}
+	// Waiting sessions are not overtaken.
+	waiting := acquireAsync(t, l, "a", metrics)
+	waitQueued(t, l, 1)
+	release()
+	(<-waiting)()
+	release2()
+	if l.open != 0 {
+		t.Errorf("Expected no open sessions, got %d", l.open)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// ModulePlan is what scraping a module needs that only depends on the
+// configuration of the module, compiled once when the configuration is
+// loaded. It is not modified once compiled, so scrapes share it.
+type ModulePlan struct {
+	metricTree *MetricNode
+	// The regexes of the values of each dynamic filter, in the order of the
+	// filters of the module.
+	filterValues [][]*regexp.Regexp
+}
+
+// CompileModule compiles the plan of a module. It fails if a dynamic filter
+// has a value that is not a valid regex.
+func CompileModule(module *config.Module) (*ModulePlan, error) {
+	plan := &ModulePlan{metricTree: buildMetricTree(module.Metrics)}
+	for _, filter := range module.Filters {
+		values := make([]*regexp.Regexp, 0, len(filter.Values))
+		for _, value := range filter.Values {
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q of the filter on %s: %w", value, filter.Oid, err)
+			}
+			values = append(values, re)
+		}
+		plan.filterValues = append(plan.filterValues, values)
+	}
+	return plan, nil
+}
+
+// metricPlan is a metric along with the descriptors of its samples and the
+// OIDs its lookups are based on.
+type metricPlan struct {
+	*config.Metric
+	// The names of the index and lookup labels, in the order of the values
+	// from labelValues.
+	labelnames []string
+	// The descriptor of the samples of the metric, nil if the metric has none.
+	desc *prometheus.Desc
+	// The name of the samples of desc.
+	sampleName string
+	// The descriptors of the regex extracts of a string metric, by name.
+	extractDescs map[string]*prometheus.Desc
+	// The OID before the metric, for types that are read from it.
+	prevOid string
+	lookups []lookupPlan
+	// Whether the samples of a PDU need other PDUs, which may be fetched
+	// after it.
+	deferred bool
+}
+
+type lookupPlan struct {
+	*config.Lookup
+	// The OID before the lookup, for types that are read from it.
+	prevOid string
+}
+
+func newMetricPlan(metric *config.Metric) *metricPlan {
+	p := &metricPlan{Metric: metric, prevOid: getPrevOid(metric.Oid)}
+	// The labels are those set by indexesToLabels.
+	for _, index := range metric.Indexes {
+		p.labelnames = appendLabelname(p.labelnames, index.Labelname)
+	}
+	for _, lookup := range metric.Lookups {
+		p.lookups = append(p.lookups, lookupPlan{Lookup: lookup, prevOid: getPrevOid(lookup.Oid)})
+		if len(lookup.Labels) == 0 {
+			p.labelnames = slices.DeleteFunc(p.labelnames, func(n string) bool { return n == lookup.Labelname })
+		} else {
+			p.labelnames = appendLabelname(p.labelnames, lookup.Labelname)
+		}
+	}
+	_, combined := combinedTypeMapping[metric.Type]
+	p.deferred = combined || slices.ContainsFunc(metric.Lookups, func(l *config.Lookup) bool { return len(l.Labels) > 0 })
+
+	// Samples with the value as a label have the metric name as its name.
+	withValue := append(slices.Clip(p.labelnames), metric.Name)
+
+	p.sampleName = metric.Name
+	switch metric.Type {
+	case "counter", "gauge", "Float", "Double", "DateAndTime", "ParseDateAndTime", "NTPTimeStamp":
+		p.desc = prometheus.NewDesc(metric.Name, metric.Help, p.labelnames, nil)
+	case "EnumAsInfo":
+		// If the metric name is already a label (e.g. it is also a table
+		// index with type EnumAsInfo), the enum string is already captured
+		// there and adding it again would duplicate the label.
+		if !slices.Contains(p.labelnames, metric.Name) {
+			p.sampleName = metric.Name + "_info"
+			p.desc = prometheus.NewDesc(p.sampleName, metric.Help+" (EnumAsInfo)", withValue, nil)
+		}
+	case "EnumAsStateSet":
+		p.desc = prometheus.NewDesc(metric.Name, metric.Help+" (EnumAsStateSet)", withValue, nil)
+	case "Bits":
+		p.desc = prometheus.NewDesc(metric.Name, metric.Help+" (Bits)", withValue, nil)
+	default:
+		// It's some form of string.
+		if len(metric.RegexpExtracts) > 0 {
+			p.extractDescs = make(map[string]*prometheus.Desc, len(metric.RegexpExtracts))
+			for name := range metric.RegexpExtracts {
+				p.extractDescs[name] = prometheus.NewDesc(metric.Name+name, metric.Help+" (regex extracted)", p.labelnames, nil)
+			}
+		} else if slices.Contains(p.labelnames, metric.Name) {
+			// If the name is already an index, it is not set again.
+			p.desc = prometheus.NewDesc(metric.Name, metric.Help, p.labelnames, nil)
+		} else {
+			p.desc = prometheus.NewDesc(metric.Name, metric.Help, withValue, nil)
+		}
+	}
+	return p
+}
+
+// nameOf returns the name of the samples of the metric with the descriptor,
+// empty if the metric has no such samples.
+func (p *metricPlan) nameOf(desc *prometheus.Desc) string {
+	if desc == p.desc {
+		return p.sampleName
+	}
+	for name, d := range p.extractDescs {
+		if d == desc {
+			return p.Name + name
+		}
+	}
+	return ""
+}
+
+func appendLabelname(labelnames []string, name string) []string {
+	if slices.Contains(labelnames, name) {
+		return labelnames
+	}
+	return append(labelnames, name)
+}
+
+// retainedOids returns the OIDs of the columns the samples of the metric read
+// other than its own.
+func (p *metricPlan) retainedOids() []string {
+	var oids []string
+	if _, ok := combinedTypeMapping[p.Type]; ok {
+		oids = append(oids, p.prevOid)
+	}
+	for _, lookup := range p.lookups {
+		if len(lookup.Labels) == 0 {
+			continue
+		}
+		oids = append(oids, lookup.Oid)
+		if _, ok := combinedTypeMapping[lookup.Type]; ok {
+			oids = append(oids, lookup.prevOid)
+		}
+	}
+	return oids
+}
+
+// labelValues returns the values of the labels of the metric, in the order
+// of labelnames.
+func (p *metricPlan) labelValues(labels map[string]string) []string {
+	values := make([]string, 0, len(p.labelnames)+1)
+	for _, name := range p.labelnames {
+		values = append(values, labels[name])
+	}
+	return values
+}
@@ -0,0 +1,88 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+func TestMetricPlan(t *testing.T) {
+	metric := &config.Metric{
+		Name: "ifOperStatus",
+		Oid:  "1.3.6.1.2.1.2.2.1.8",
+		Type: "gauge",
+		Indexes: []*config.Index{
+			{Labelname: "ifIndex", Type: "gauge"},
+		},
+		Lookups: []*config.Lookup{
+			{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"},
+			{Labels: []string{}, Labelname: "ifIndex"},
+		},
+	}
+	p := newMetricPlan(metric)
+	if want := []string{"ifDescr"}; !reflect.DeepEqual(p.labelnames, want) {
+		t.Errorf("Expected labels %v, got %v", want, p.labelnames)
+	}
+	if p.prevOid != "1.3.6.1.2.1.2.2.1.7" || p.lookups[0].prevOid != "1.3.6.1.2.1.2.2.1.1" {
+		t.Errorf("Unexpected previous OIDs %s and %s", p.prevOid, p.lookups[0].prevOid)
+	}
+	if got := p.labelValues(map[string]string{"ifDescr": "eth0"}); !reflect.DeepEqual(got, []string{"eth0"}) {
+		t.Errorf("Unexpected label values %v", got)
+	}
+
+	// A string metric has its value as a label.
+	p = newMetricPlan(&config.Metric{Name: "sysName", Oid: "1.3.6.1.2.1.1.5", Type: "DisplayString"})
+	if desc := p.desc.String(); !strings.Contains(desc, "variableLabels: {sysName}") {
+		t.Errorf("Expected the value as a label, got %s", desc)
+	}
+
+	// Samples are named after the descriptor they were created with.
+	p = newMetricPlan(&config.Metric{Name: "ifType", Oid: "1.3.6.1.2.1.2.2.1.3", Type: "EnumAsInfo"})
+	if name := p.nameOf(p.desc); name != "ifType_info" {
+		t.Errorf("Expected the name of the info metric, got %q", name)
+	}
+	p = newMetricPlan(&config.Metric{Name: "sysDescr", Oid: "1.3.6.1.2.1.1.1", Type: "DisplayString", RegexpExtracts: map[string][]config.RegexpExtract{"Version": nil}})
+	if name := p.nameOf(p.extractDescs["Version"]); name != "sysDescrVersion" {
+		t.Errorf("Expected the name of the regex extract, got %q", name)
+	}
+}
+
+func TestCompileModule(t *testing.T) {
+	module := &config.Module{
+		Filters: []config.DynamicFilter{
+			{Oid: "1.3.6.1.2.1.2.2.1.7", Values: []string{"1", "^eth"}},
+		},
+	}
+	plan, err := CompileModule(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.filterValues) != 1 || len(plan.filterValues[0]) != 2 {
+		t.Errorf("Expected the filter values to be compiled, got %v", plan.filterValues)
+	}
+	module.Filters[0].Values = []string{"(up"}
+	if _, err := CompileModule(module); err == nil {
+		t.Error("Expected an invalid value to fail")
+	}
+
+	module.Filters[0].Values = []string{"1"}
+	plan, err = NewCompiledModule("if_mib", module, nil).compiled()
+	if err != nil || plan == nil || plan.metricTree == nil {
+		t.Errorf("Expected a module without a plan to be compiled on first use, got %v %v", plan, err)
+	}
+}
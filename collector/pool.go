@@ -0,0 +1,259 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+var (
+	sessionPoolSize        = kingpin.Flag("snmp.session-pool-size", "Maximum number of idle SNMP sessions kept open to be reused by later scrapes, 0 to close sessions after each scrape.").Default("0").Int()
+	sessionPoolIdleTimeout = kingpin.Flag("snmp.session-pool-idle-timeout", "How long an idle SNMP session is kept open in the session pool.").Default("1m").Duration()
+
+	// pooledSessions is created on first use, after the flags are parsed.
+	pooledSessions = sync.OnceValue(func() *sessionPool {
+		p := newSessionPool(*sessionPoolSize, *sessionPoolIdleTimeout)
+		if p.enabled() {
+			go func() {
+				for now := range time.Tick(p.idleTimeout / 2) {
+					p.expire(now)
+				}
+			}()
+		}
+		return p
+	})
+)
+
+// sessionPoolKey identifies the sessions that can be reused for a scrape.
+// The target includes the transport.
+type sessionPoolKey struct {
+	target                  string
+	sourceAddress           string
+	auth                    string
+	snmpContext             string
+	snmpEngineID            string
+	useUnconnectedUDPSocket bool
+}
+
+type idleSession struct {
+	client scraper.SNMPScraper
+	// The auth the session was configured with, as the auth of the key may
+	// change when the configuration is reloaded.
+	auth  config.Auth
+	since time.Time
+}
+
+// sessionPool keeps connected sessions open between scrapes, so that later
+// scrapes of the same target with the same auth skip the connect. Sessions
+// are only put back once a scrape is done with them, and only if none of
+// their requests failed.
+type sessionPool struct {
+	size        int
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[sessionPoolKey][]idleSession
+	n    int
+}
+
+func newSessionPool(size int, idleTimeout time.Duration) *sessionPool {
+	return &sessionPool{size: size, idleTimeout: idleTimeout, idle: make(map[sessionPoolKey][]idleSession)}
+}
+
+func (p *sessionPool) enabled() bool {
+	return p.size > 0 && p.idleTimeout > 0
+}
+
+// get takes the most recently used idle session for key out of the pool.
+// Sessions configured with another auth are closed.
+func (p *sessionPool) get(key sessionPoolKey, auth config.Auth, now time.Time) (scraper.SNMPScraper, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for sessions := p.idle[key]; len(sessions) > 0; sessions = p.idle[key] {
+		s := sessions[len(sessions)-1]
+		p.remove(key, len(sessions)-1)
+		if s.auth != auth || now.Sub(s.since) >= p.idleTimeout {
+			s.client.Close()
+			continue
+		}
+		return s.client, true
+	}
+	return nil, false
+}
+
+// put gives a session back to the pool. Once the pool is full, the session
+// that has been idle the longest is closed.
+func (p *sessionPool) put(key sessionPoolKey, client scraper.SNMPScraper, auth config.Auth, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.n >= p.size {
+		var (
+			oldestKey sessionPoolKey
+			oldest    *idleSession
+		)
+		for k, sessions := range p.idle {
+			// The sessions of a key are in the order they were put back.
+			if oldest == nil || sessions[0].since.Before(oldest.since) {
+				oldestKey, oldest = k, &sessions[0]
+			}
+		}
+		oldest.client.Close()
+		p.remove(oldestKey, 0)
+	}
+	p.idle[key] = append(p.idle[key], idleSession{client: client, auth: auth, since: now})
+	p.n++
+}
+
+// expire closes the sessions that have been idle for longer than the idle
+// timeout.
+func (p *sessionPool) expire(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, sessions := range p.idle {
+		for len(sessions) > 0 && now.Sub(sessions[0].since) >= p.idleTimeout {
+			sessions[0].client.Close()
+			p.remove(key, 0)
+			sessions = p.idle[key]
+		}
+	}
+}
+
+func (p *sessionPool) remove(key sessionPoolKey, i int) {
+	sessions := slices.Delete(p.idle[key], i, i+1)
+	if len(sessions) == 0 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = sessions
+	}
+	p.n--
+}
+
+// pooledClient is a session from the session pool, or to be put in it. It is
+// given back to the pool once closed, unless a request on it failed, as the
+// session may be broken or the engine of the target may have changed.
+type pooledClient struct {
+	scraper.SNMPScraper
+	pool *sessionPool
+	key  sessionPoolKey
+	auth config.Auth
+	// Whether the session is already connected.
+	reused bool
+	failed bool
+	// reopen opens a fresh session in place of a reused one whose first
+	// request failed at the transport level, as the target may have closed
+	// it while it was idle.
+	reopen func() (scraper.SNMPScraper, error)
+	// The settings made on a reused session before its first request, made
+	// again on the session that replaces it.
+	settings []func(scraper.SNMPScraper)
+	used     bool
+}
+
+func (p *pooledClient) Connect() error {
+	if p.reused {
+		return nil
+	}
+	err := p.SNMPScraper.Connect()
+	p.failed = err != nil
+	return err
+}
+
+func (p *pooledClient) SetOptions(fns ...func(*gosnmp.GoSNMP)) {
+	p.setting(func(s scraper.SNMPScraper) { s.SetOptions(fns...) })
+}
+
+func (p *pooledClient) SetAdaptiveRepetitions(a *scraper.AdaptiveRepetitions) {
+	p.setting(func(s scraper.SNMPScraper) { s.SetAdaptiveRepetitions(a) })
+}
+
+func (p *pooledClient) SetLogger(logger *slog.Logger) {
+	p.setting(func(s scraper.SNMPScraper) { s.SetLogger(logger) })
+}
+
+func (p *pooledClient) setting(set func(scraper.SNMPScraper)) {
+	if p.reused && !p.used {
+		p.settings = append(p.settings, set)
+	}
+	set(p.SNMPScraper)
+}
+
+// retry reports whether a request that failed with err is to be made again,
+// which is the case for the first request on a reused session once it has
+// been replaced by a fresh one. Requests that already returned PDUs are not.
+func (p *pooledClient) retry(err error, returned bool) bool {
+	first := !p.used
+	p.used = true
+	if err == nil || returned || !first || !p.reused || p.reopen == nil || !scraper.IsTransportError(err) {
+		return false
+	}
+	session, openErr := p.reopen()
+	if openErr != nil {
+		return false
+	}
+	p.SNMPScraper.Close()
+	p.SNMPScraper, p.reused = session, false
+	for _, set := range p.settings {
+		set(session)
+	}
+	p.settings = nil
+	return true
+}
+
+func (p *pooledClient) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	packet, err := p.SNMPScraper.Get(oids)
+	if p.retry(err, false) {
+		packet, err = p.SNMPScraper.Get(oids)
+	}
+	p.failed = p.failed || err != nil
+	return packet, err
+}
+
+func (p *pooledClient) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	pdus, err := p.SNMPScraper.WalkAll(oid)
+	if p.retry(err, len(pdus) > 0) {
+		pdus, err = p.SNMPScraper.WalkAll(oid)
+	}
+	p.failed = p.failed || err != nil
+	return pdus, err
+}
+
+func (p *pooledClient) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	returned := false
+	err := p.SNMPScraper.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		returned = true
+		return fn(pdu)
+	})
+	if p.retry(err, returned) {
+		err = p.SNMPScraper.Walk(oid, fn)
+	}
+	p.failed = p.failed || err != nil
+	return err
+}
+
+func (p *pooledClient) Close() error {
+	if p.failed {
+		return p.SNMPScraper.Close()
+	}
+	p.pool.put(p.key, p.SNMPScraper, p.auth, time.Now())
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// closeCountingScraper counts how often it is closed, and the options set on
+// it.
+type closeCountingScraper struct {
+	scraper.SNMPScraper
+	closed  int
+	options int
+}
+
+func (c *closeCountingScraper) Close() error {
+	c.closed++
+	return nil
+}
+
+// SetOptions counts the options set on the session.
+func (c *closeCountingScraper) SetOptions(fns ...func(*gosnmp.GoSNMP)) {
+	c.options += len(fns)
+}
+
+func newPoolSession() *closeCountingScraper {
+	return &closeCountingScraper{SNMPScraper: scraper.NewMockSNMPScraper(nil, nil)}
+}
+
+func TestSessionPool(t *testing.T) {
+	pool := newSessionPool(2, time.Minute)
+	auth := config.Auth{Community: "public", Version: 2}
+	key := sessionPoolKey{target: "10.0.0.1", auth: "public_v2"}
+	now := time.Now()
+
+	a := newPoolSession()
+	pool.put(key, a, auth, now)
+	if got, ok := pool.get(key, auth, now.Add(time.Second)); !ok || got != a {
+		t.Fatalf("Expected the idle session back, got %v %v", got, ok)
+	}
+	if _, ok := pool.get(key, auth, now); ok {
+		t.Fatal("Expected a session to be handed out only once")
+	}
+	if _, ok := pool.get(sessionPoolKey{target: "tcp://10.0.0.1", auth: "public_v2"}, auth, now); ok {
+		t.Error("Expected no session for another transport")
+	}
+
+	// Sessions of an auth that changed are closed.
+	pool.put(key, a, auth, now)
+	if _, ok := pool.get(key, config.Auth{Community: "private", Version: 2}, now); ok || a.closed != 1 {
+		t.Errorf("Expected the session of the old auth to be closed, got %v, closed %d times", ok, a.closed)
+	}
+
+	// So are sessions that have been idle for too long.
+	b := newPoolSession()
+	pool.put(key, b, auth, now)
+	if _, ok := pool.get(key, auth, now.Add(time.Minute)); ok || b.closed != 1 {
+		t.Errorf("Expected the idle session to be closed, got %v, closed %d times", ok, b.closed)
+	}
+
+	// Once the pool is full, the session idle the longest is closed.
+	c, d, e := newPoolSession(), newPoolSession(), newPoolSession()
+	pool.put(key, c, auth, now)
+	pool.put(sessionPoolKey{target: "10.0.0.2", auth: "public_v2"}, d, auth, now.Add(time.Second))
+	pool.put(key, e, auth, now.Add(2*time.Second))
+	if c.closed != 1 || d.closed != 0 || e.closed != 0 || pool.n != 2 {
+		t.Errorf("Expected the oldest session to be closed, closed %d, %d and %d times, %d idle", c.closed, d.closed, e.closed, pool.n)
+	}
+
+	pool.expire(now.Add(time.Minute + time.Second))
+	if d.closed != 1 || e.closed != 0 || pool.n != 1 {
+		t.Errorf("Expected the expired session to be closed, closed %d and %d times, %d idle", d.closed, e.closed, pool.n)
+	}
+}
+
+func TestPooledClient(t *testing.T) {
+	pool := newSessionPool(2, time.Minute)
+	auth := config.Auth{Community: "public", Version: 2}
+	key := sessionPoolKey{target: "10.0.0.1", auth: "public_v2"}
+
+	session := newPoolSession()
+	client := &pooledClient{SNMPScraper: session, pool: pool, key: key, auth: auth}
+	if _, err := client.Get([]string{"1.3.6.1.2.1.1.5.0"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client.Close()
+	if session.closed != 0 || pool.n != 1 {
+		t.Fatalf("Expected the session to be put back, closed %d times, %d idle", session.closed, pool.n)
+	}
+
+	// Sessions on which a request failed are closed.
+	reused, ok := pool.get(key, auth, time.Now())
+	if !ok {
+		t.Fatal("Expected the pooled session")
+	}
+	mock := scraper.NewMockSNMPScraper(nil, nil)
+	mock.WalkErrors = map[string]error{"1.3.6.1.2.1.2": errors.New("timeout")}
+	reused.(*closeCountingScraper).SNMPScraper = mock
+	client = &pooledClient{SNMPScraper: reused, pool: pool, key: key, auth: auth, reused: true}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Expected a reused session not to connect again, got %v", err)
+	}
+	if _, err := client.WalkAll("1.3.6.1.2.1.2"); err == nil {
+		t.Fatal("Expected the walk to fail")
+	}
+	client.Close()
+	if session.closed != 1 || pool.n != 0 {
+		t.Errorf("Expected the failed session to be closed, closed %d times, %d idle", session.closed, pool.n)
+	}
+}
+
+func TestPooledClientReopen(t *testing.T) {
+	pool := newSessionPool(2, time.Minute)
+	auth := config.Auth{Community: "public", Version: 2}
+	key := sessionPoolKey{target: "tcp://10.0.0.1", auth: "public_v2"}
+
+	// The first request on a reused session the target closed is made again
+	// on a fresh session, with the options set on the reused one.
+	closed := newPoolSession()
+	mock := scraper.NewMockSNMPScraper(nil, nil)
+	mock.GetErrors = map[string]error{"1.3.6.1.2.1.1.5.0": fmt.Errorf("error getting target: %w", syscall.ECONNRESET)}
+	closed.SNMPScraper = mock
+	fresh := newPoolSession()
+	reopened := 0
+	reopen := func() (scraper.SNMPScraper, error) {
+		reopened++
+		return fresh, nil
+	}
+	client := &pooledClient{SNMPScraper: closed, pool: pool, key: key, auth: auth, reused: true, reopen: reopen}
+	client.SetOptions(func(*gosnmp.GoSNMP) {}, func(*gosnmp.GoSNMP) {})
+	if _, err := client.Get([]string{"1.3.6.1.2.1.1.5.0"}); err != nil {
+		t.Fatalf("Expected the request to succeed on a fresh session, got %v", err)
+	}
+	if reopened != 1 || closed.closed != 1 || fresh.options != 2 {
+		t.Errorf("Expected the closed session to be replaced with the same options, reopened %d times, closed %d times, %d options", reopened, closed.closed, fresh.options)
+	}
+	client.Close()
+	if got, ok := pool.get(key, auth, time.Now()); !ok || got != fresh {
+		t.Errorf("Expected the fresh session to be put back, got %v %v", got, ok)
+	}
+
+	// Other errors, and transport errors past the first request, are not
+	// retried.
+	for _, errs := range []map[string]error{
+		{"1.3.6.1.2.1.1.5.0": errors.New("request timeout (after 3 retries)")},
+		{"1.3.6.1.2.1.1.6.0": fmt.Errorf("error getting target: %w", syscall.ECONNRESET)},
+	} {
+		mock := scraper.NewMockSNMPScraper(nil, nil)
+		mock.GetErrors = errs
+		reopened = 0
+		client := &pooledClient{SNMPScraper: mock, pool: pool, key: key, auth: auth, reused: true, reopen: reopen}
+		_, err1 := client.Get([]string{"1.3.6.1.2.1.1.5.0"})
+		_, err2 := client.Get([]string{"1.3.6.1.2.1.1.6.0"})
+		if err1 == nil && err2 == nil || reopened != 0 {
+			t.Errorf("Expected the failed request not to be retried, reopened %d times", reopened)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// RawPDU is a PDU as it was returned by the target.
+type RawPDU struct {
+	OID  string `json:"oid"`
+	Type string `json:"type"`
+	// Value is the value as decoded by gosnmp, with octet strings in hex.
+	Value any `json:"value"`
+	// Decoded is the value as it would be rendered in a label, using the
+	// type and display hint of the metric the OID belongs to, if any.
+	Decoded string `json:"decoded"`
+}
+
+// RawError is an OID that could not be fetched.
+type RawError struct {
+	OID    string `json:"oid"`
+	Reason string `json:"reason"`
+}
+
+// RawModule is what scraping a module fetched from the target, before any
+// PDU is turned into samples.
+type RawModule struct {
+	Module string `json:"module"`
+	// Get and Walk are the OIDs that were fetched, after dynamic filters.
+	Get    []string   `json:"get"`
+	Walk   []string   `json:"walk"`
+	PDUs   []RawPDU   `json:"pdus"`
+	Errors []RawError `json:"errors,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// Raw scrapes each module of the collector in turn and returns the PDUs as
+// they were returned by the target. The result cache is bypassed, so that
+// the target is always queried.
+func (c Collector) Raw() ([]RawModule, error) {
+	modules := make([]RawModule, 0, len(c.modules))
+	err := c.scrapeEach(func(m *NamedModule, plan *ModulePlan, results ScrapeResults, err error) {
+		raw := RawModule{
+			Module: m.name,
+			Get:    results.get,
+			Walk:   results.walk,
+			PDUs:   rawPDUs(results.pdus, plan, c.metrics),
+		}
+		for _, e := range results.errors {
+			raw.Errors = append(raw.Errors, RawError{OID: e.oid, Reason: string(e.reason)})
+		}
+		if err != nil {
+			raw.Error = fmt.Sprintf("%s: %s", scraper.Reason(err), err)
+		}
+		modules = append(modules, raw)
+	})
+	return modules, err
+}
+
+// scrapeEach scrapes the modules of the collector in turn on one session,
+// bypassing the result cache, and passes the plan and the results of each to
+// f. The plan is nil for a module that does not compile, which has no results.
+func (c Collector) scrapeEach(f func(m *NamedModule, plan *ModulePlan, results ScrapeResults, err error)) error {
+	if err := c.selectAuth(c.ctx); err != nil {
+		return err
+	}
+	release, err := sessions().acquire(c.ctx, c.target, c.metrics)
+	if err != nil {
+		return err
+	}
+	defer release()
+	client, err := c.newClient(c.ctx, c.logger)
+	if err != nil {
+		return err
+	}
+	if err := client.Connect(); err != nil {
+		return fmt.Errorf("error connecting to target: %w", err)
+	}
+	defer client.Close()
+
+	counter := countPackets(client)
+	c.shared = newSharedWalks(c.modules)
+	for _, m := range c.modules {
+		plan, err := m.compiled()
+		if err != nil {
+			f(m, nil, ScrapeResults{}, err)
+			continue
+		}
+		logger := c.logger.With("module", m.name)
+		client := c.moduleClient(c.ctx, client, m, logger)
+		client.SetOptions(walkOptions(m.WalkParams))
+		c.adaptRepetitions(client, m)
+		openSession := c.sessionOpener(logger, m, walkOptions(m.WalkParams))
+		results, err := scrapeTarget(c.ctx, client, counter, openSession, c.target, c.auth, m, logger, c.metrics, nil)
+		if err != nil {
+			c.checkAuth(err)
+		}
+		f(m, plan, results, err)
+	}
+	return nil
+}
+
+func rawPDUs(pdus []gosnmp.SnmpPDU, plan *ModulePlan, m Metrics) []RawPDU {
+	raw := make([]RawPDU, 0, len(pdus))
+	for _, pdu := range pdus {
+		var typ, displayHint string
+		if metric, _ := matchMetric(plan.metricTree, oidToList(pdu.Name[1:])); metric != nil {
+			// Only types that can be rendered as a label are used.
+			if config.RenderableIndexTypes[metric.Type] {
+				typ = metric.Type
+			}
+			displayHint = metric.DisplayHint
+		}
+		value := pdu.Value
+		if b, ok := value.([]byte); ok {
+			value = hex.EncodeToString(b)
+		}
+		raw = append(raw, RawPDU{
+			OID:     pdu.Name[1:],
+			Type:    pdu.Type.String(),
+			Value:   value,
+			Decoded: pduValueAsString(&pdu, typ, displayHint, m),
+		})
+	}
+	return raw
+}
+
+// matchMetric returns the metric an OID belongs to and the index part of the
+// OID, or nil if there is no such metric.
+func matchMetric(head *MetricNode, oid []int) (*metricPlan, []int) {
+	for i, o := range oid {
+		var ok bool
+		head, ok = head.children[o]
+		if !ok {
+			return nil, nil
+		}
+		if head.metric != nil {
+			return head.metric, oid[i+1:]
+		}
+	}
+	return nil, nil
+}
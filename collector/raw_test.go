@@ -0,0 +1,78 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+func TestRawPDUs(t *testing.T) {
+	module := config.DefaultModule
+	module.Walk = []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.2.2.1.6"}
+	module.Filters = []config.DynamicFilter{{
+		Oid:     "1.3.6.1.2.1.2.2.1.8",
+		Targets: []string{"1.3.6.1.2.1.2.2.1.2"},
+		Values:  []string{"1"},
+	}}
+	module.Metrics = []*config.Metric{
+		{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"},
+		{Name: "ifPhysAddress", Oid: "1.3.6.1.2.1.2.2.1.6", Type: "PhysAddress48"},
+	}
+	mock := scraper.NewMockSNMPScraper(
+		map[string]gosnmp.SnmpPDU{
+			"1.3.6.1.2.1.2.2.1.2.1": {Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("eth0")},
+		},
+		map[string][]gosnmp.SnmpPDU{
+			"1.3.6.1.2.1.2.2.1.8": {
+				{Name: ".1.3.6.1.2.1.2.2.1.8.1", Type: gosnmp.Integer, Value: 1},
+				{Name: ".1.3.6.1.2.1.2.2.1.8.2", Type: gosnmp.Integer, Value: 2},
+			},
+			"1.3.6.1.2.1.2.2.1.6": {
+				{Name: ".1.3.6.1.2.1.2.2.1.6.1", Type: gosnmp.OctetString, Value: []byte{0, 0x1b, 0x21, 0x3c, 0x9d, 0xf8}},
+			},
+		},
+	)
+
+	results, err := ScrapeTarget(context.Background(), mock, "someTarget", &config.Auth{Version: 2}, &module, promslog.NewNopLogger(), Metrics{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The filter turns the walk of ifDescr into a get of the interfaces that are up.
+	if want := []string{"1.3.6.1.2.1.2.2.1.2.1"}; !reflect.DeepEqual(results.get, want) {
+		t.Errorf("Expected get plan %v, got %v", want, results.get)
+	}
+	if want := []string{"1.3.6.1.2.1.2.2.1.6"}; !reflect.DeepEqual(results.walk, want) {
+		t.Errorf("Expected walk plan %v, got %v", want, results.walk)
+	}
+
+	want := []RawPDU{
+		{OID: "1.3.6.1.2.1.2.2.1.2.1", Type: "OctetString", Value: "65746830", Decoded: "eth0"},
+		{OID: "1.3.6.1.2.1.2.2.1.6.1", Type: "OctetString", Value: "001b213c9df8", Decoded: "00:1B:21:3C:9D:F8"},
+	}
+	plan, err := CompileModule(&module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rawPDUs(results.pdus, plan, Metrics{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected raw PDUs:\ngot  %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// subtreeCacheKey identifies the PDUs of a subtree walked on a target.
+type subtreeCacheKey struct {
+	target        string
+	auth          string
+	snmpContext   string
+	snmpEngineID  string
+	sourceAddress string
+	oid           string
+}
+
+type subtreeCacheEntry struct {
+	pdus    []gosnmp.SnmpPDU
+	time    time.Time
+	expires time.Time
+}
+
+// subtreeCache keeps the PDUs of the subtrees that modules refresh less often
+// than they are scraped, until they are due to be walked again.
+type subtreeCache struct {
+	mu        sync.Mutex
+	entries   map[subtreeCacheKey]subtreeCacheEntry
+	lastSweep time.Time
+}
+
+var refreshedSubtrees = newSubtreeCache()
+
+func newSubtreeCache() *subtreeCache {
+	return &subtreeCache{entries: make(map[subtreeCacheKey]subtreeCacheEntry)}
+}
+
+// get returns the cached PDUs of a subtree and the time it was walked, if it
+// is not due for a refresh.
+func (c *subtreeCache) get(key subtreeCacheKey, now time.Time) ([]gosnmp.SnmpPDU, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return nil, time.Time{}, false
+	}
+	return e.pdus, e.time, true
+}
+
+// put caches the PDUs of a subtree walked at now until the next refresh. The
+// PDUs are never modified, so they are shared with the scrapes they are
+// served to.
+func (c *subtreeCache) put(key subtreeCacheKey, pdus []gosnmp.SnmpPDU, now time.Time, interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) >= cacheSweepInterval {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = subtreeCacheEntry{pdus: pdus, time: now, expires: now.Add(interval)}
+}
+
+// flush drops all cached subtrees.
+func (c *subtreeCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+// refreshed returns a client for a module that serves the subtrees with a
+// refresh interval from the cache of the target until they are due.
+func (c Collector) refreshed(client scraper.SNMPScraper, module *NamedModule, logger *slog.Logger) scraper.SNMPScraper {
+	if len(module.RefreshIntervals) == 0 {
+		return client
+	}
+	return &refreshClient{
+		SNMPScraper: client,
+		key: subtreeCacheKey{
+			target:        c.target,
+			auth:          c.authName,
+			snmpContext:   c.snmpContext,
+			snmpEngineID:  c.snmpEngineID,
+			sourceAddress: c.sourceAddress,
+		},
+		intervals: module.RefreshIntervals,
+		logger:    logger,
+	}
+}
+
+// refreshClient is the client of a module with refresh intervals.
+type refreshClient struct {
+	scraper.SNMPScraper
+	// The key of the cached subtrees, without the OID.
+	key       subtreeCacheKey
+	intervals map[string]time.Duration
+	logger    *slog.Logger
+}
+
+// cached returns the cached PDUs of oid, if it has a refresh interval and is
+// not due.
+func (r *refreshClient) cached(oid string) ([]gosnmp.SnmpPDU, bool) {
+	key := r.key
+	key.oid = oid
+	pdus, walked, ok := refreshedSubtrees.get(key, time.Now())
+	if ok {
+		r.logger.Debug("Serving subtree from cache", "oid", oid, "walked", walked)
+	}
+	return pdus, ok
+}
+
+func (r *refreshClient) put(oid string, pdus []gosnmp.SnmpPDU, interval time.Duration) {
+	key := r.key
+	key.oid = oid
+	refreshedSubtrees.put(key, pdus, time.Now(), interval)
+}
+
+func (r *refreshClient) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	interval, ok := r.intervals[oid]
+	if !ok {
+		return r.SNMPScraper.WalkAll(oid)
+	}
+	if pdus, ok := r.cached(oid); ok {
+		return pdus, nil
+	}
+	pdus, err := r.SNMPScraper.WalkAll(oid)
+	// Failed walks are walked again on the next scrape.
+	if err == nil {
+		r.put(oid, pdus, interval)
+	}
+	return pdus, err
+}
+
+func (r *refreshClient) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	interval, ok := r.intervals[oid]
+	if !ok {
+		return r.SNMPScraper.Walk(oid, fn)
+	}
+	if pdus, ok := r.cached(oid); ok {
+		for _, pdu := range pdus {
+			if err := fn(pdu); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var pdus []gosnmp.SnmpPDU
+	err := r.SNMPScraper.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		pdus = append(pdus, pdu)
+		return fn(pdu)
+	})
+	if err == nil {
+		r.put(oid, pdus, interval)
+	}
+	return err
+}
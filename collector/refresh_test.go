@@ -0,0 +1,126 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+func TestRefreshIntervals(t *testing.T) {
+	module := NewNamedModule("if_mib", &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2.2.1.10", "1.3.6.1.2.1.31.1.1.1.1"},
+		Filters: []config.DynamicFilter{
+			{Oid: "1.3.6.1.2.1.2.2.1.7", Targets: []string{"1.3.6.1.2.1.2.2.1.10"}, Values: []string{"1"}},
+		},
+		RefreshIntervals: map[string]time.Duration{
+			"1.3.6.1.2.1.31.1.1.1.1": time.Hour,
+			"1.3.6.1.2.1.2.2.1.7":    time.Hour,
+		},
+	})
+	walkResponses := map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1.7": {
+			{Name: ".1.3.6.1.2.1.2.2.1.7.1", Type: gosnmp.Integer, Value: 1},
+			{Name: ".1.3.6.1.2.1.2.2.1.7.2", Type: gosnmp.Integer, Value: 2},
+		},
+		"1.3.6.1.2.1.31.1.1.1.1": {
+			{Name: ".1.3.6.1.2.1.31.1.1.1.1.1", Type: gosnmp.OctetString, Value: []byte("lo")},
+			{Name: ".1.3.6.1.2.1.31.1.1.1.1.2", Type: gosnmp.OctetString, Value: []byte("eth0")},
+		},
+	}
+	getResponses := map[string]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1.10.1": {Name: ".1.3.6.1.2.1.2.2.1.10.1", Type: gosnmp.Counter32, Value: uint(100)},
+	}
+	c := Collector{target: "refresh-test", authName: "public_v2", auth: &config.Auth{Version: 2}}
+	scrape := func(mock scraper.SNMPScraper) ScrapeResults {
+		t.Helper()
+		results, err := scrapeTarget(context.Background(), c.refreshed(mock, module, promslog.NewNopLogger()), nil, nil, c.target, c.auth, module, promslog.NewNopLogger(), Metrics{}, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return results
+	}
+
+	mock := scraper.NewMockSNMPScraper(getResponses, walkResponses)
+	first := scrape(mock)
+	if walks := mock.CallWalk(); len(walks) != 2 {
+		t.Fatalf("Expected the filter and ifName to be walked, got %v", walks)
+	}
+
+	// The subtrees are served from the cache, and the filter still applies.
+	mock = scraper.NewMockSNMPScraper(getResponses, walkResponses)
+	second := scrape(mock)
+	if walks := mock.CallWalk(); len(walks) != 0 {
+		t.Errorf("Expected no walks before the refresh is due, got %v", walks)
+	}
+	if !reflect.DeepEqual(second.pdus, first.pdus) || !reflect.DeepEqual(mock.CallGet(), []string{"1.3.6.1.2.1.2.2.1.10.1"}) {
+		t.Errorf("Expected the same results as the first scrape, got %v and gets %v", second.pdus, mock.CallGet())
+	}
+
+	// Other targets have their own cache.
+	c.target = "refresh-test-2"
+	mock = scraper.NewMockSNMPScraper(getResponses, walkResponses)
+	scrape(mock)
+	if walks := mock.CallWalk(); len(walks) != 2 {
+		t.Errorf("Expected another target to be walked, got %v", walks)
+	}
+
+	// Failed walks are not cached.
+	c.target = "refresh-test-3"
+	mock = scraper.NewMockSNMPScraper(getResponses, walkResponses)
+	mock.WalkErrors = map[string]error{"1.3.6.1.2.1.31.1.1.1.1": errors.New("timeout")}
+	if _, err := scrapeTarget(context.Background(), c.refreshed(mock, module, promslog.NewNopLogger()), nil, nil, c.target, c.auth, module, promslog.NewNopLogger(), Metrics{}, nil); err == nil {
+		t.Fatal("Expected the walk to fail")
+	}
+	mock = scraper.NewMockSNMPScraper(getResponses, walkResponses)
+	scrape(mock)
+	if walks := mock.CallWalk(); !reflect.DeepEqual(walks, []string{"1.3.6.1.2.1.31.1.1.1.1"}) {
+		t.Errorf("Expected only the failed walk to be walked again, got %v", walks)
+	}
+}
+
+func TestSubtreeCache(t *testing.T) {
+	cache := newSubtreeCache()
+	key := subtreeCacheKey{target: "10.0.0.1", auth: "public_v2", oid: "1.3.6.1.2.1.31.1.1.1.1"}
+	now := time.Now()
+	pdus := []gosnmp.SnmpPDU{{Name: ".1.3.6.1.2.1.31.1.1.1.1.1", Type: gosnmp.OctetString, Value: []byte("lo")}}
+
+	cache.put(key, pdus, now, time.Hour)
+	if got, walked, ok := cache.get(key, now.Add(59*time.Minute)); !ok || len(got) != 1 || !walked.Equal(now) {
+		t.Fatalf("Expected a hit walked at %s, got %v %s %v", now, got, walked, ok)
+	}
+	if _, _, ok := cache.get(key, now.Add(time.Hour)); ok {
+		t.Error("Expected the subtree to be due after the refresh interval")
+	}
+	// The subtree is walked again from another source address.
+	other := key
+	other.sourceAddress = "10.0.0.2"
+	if _, _, ok := cache.get(other, now); ok {
+		t.Error("Expected no hit for another source address")
+	}
+	cache.put(key, pdus, now, time.Hour)
+	cache.flush()
+	if _, _, ok := cache.get(key, now); ok {
+		t.Error("Expected no hit after a flush")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// How long the max repetitions learned for a target that is no longer scraped
+// are remembered.
+const repetitionsTTL = time.Hour
+
+// repetitionsKey identifies the walks that learn max repetitions together. A
+// target may handle a different number of repetitions for the subtrees of
+// each module, or with each auth, such as when an SNMPv3 view limits them.
+type repetitionsKey struct {
+	target string
+	module string
+	auth   string
+}
+
+type repetitionsEntry struct {
+	repetitions *scraper.AdaptiveRepetitions
+	seen        time.Time
+}
+
+// targetRepetitions holds the max repetitions learned for each target by
+// modules with adaptive_max_repetitions.
+type targetRepetitions struct {
+	mu        sync.Mutex
+	targets   map[repetitionsKey]repetitionsEntry
+	lastSweep time.Time
+}
+
+var learnedRepetitions = newTargetRepetitions()
+
+func newTargetRepetitions() *targetRepetitions {
+	return &targetRepetitions{targets: make(map[repetitionsKey]repetitionsEntry)}
+}
+
+// get returns the max repetitions learned for key, as used at now.
+func (t *targetRepetitions) get(key repetitionsKey, now time.Time) *scraper.AdaptiveRepetitions {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastSweep) >= cacheSweepInterval {
+		for k, e := range t.targets {
+			if now.Sub(e.seen) >= repetitionsTTL {
+				delete(t.targets, k)
+			}
+		}
+		t.lastSweep = now
+	}
+	e, ok := t.targets[key]
+	if !ok {
+		e.repetitions = &scraper.AdaptiveRepetitions{}
+	}
+	e.seen = now
+	t.targets[key] = e
+	return e.repetitions
+}
+
+// flush forgets the max repetitions learned for all targets.
+func (t *targetRepetitions) flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clear(t.targets)
+}
+
+// FlushRepetitions forgets the max repetitions learned for all targets, e.g.
+// once the configuration of the modules they were learned with is reloaded.
+func FlushRepetitions() {
+	learnedRepetitions.flush()
+}
+
+// repetitions returns the max repetitions learned for the module.
+func (c Collector) repetitions(module *NamedModule) *scraper.AdaptiveRepetitions {
+	return learnedRepetitions.get(repetitionsKey{target: c.target, module: module.name, auth: c.authName}, time.Now())
+}
+
+// adaptRepetitions makes the walks of a module adapt the max repetitions to
+// the target, if the module asks for it.
+func (c Collector) adaptRepetitions(client scraper.SNMPScraper, module *NamedModule) {
+	if module.WalkParams.AdaptiveMaxRepetitions {
+		client.SetAdaptiveRepetitions(c.repetitions(module))
+	} else {
+		client.SetAdaptiveRepetitions(nil)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTargetRepetitions(t *testing.T) {
+	repetitions := newTargetRepetitions()
+	key := repetitionsKey{target: "10.0.0.1", module: "if_mib", auth: "public_v2"}
+	other := repetitionsKey{target: "10.0.0.2", module: "if_mib", auth: "public_v2"}
+	now := time.Now()
+
+	learned := repetitions.get(key, now)
+	if repetitions.get(key, now.Add(time.Minute)) != learned {
+		t.Error("Expected the learned max repetitions to be kept for the target")
+	}
+	repetitions.get(other, now.Add(30*time.Minute))
+
+	// Targets that are no longer scraped are forgotten.
+	repetitions.get(other, now.Add(time.Minute+repetitionsTTL))
+	if _, ok := repetitions.targets[key]; ok {
+		t.Error("Expected the max repetitions of a target no longer scraped to expire")
+	}
+	if _, ok := repetitions.targets[other]; !ok {
+		t.Error("Expected the max repetitions of a scraped target to be kept")
+	}
+
+	repetitions.flush()
+	if len(repetitions.targets) != 0 {
+		t.Errorf("Expected no max repetitions after a flush, got %d", len(repetitions.targets))
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// walkGroup is what modules must have in common for their walks to be
+// shared, as it changes how a subtree is walked.
+type walkGroup struct {
+	maxRepetitions         uint32
+	retries                int
+	timeout                time.Duration
+	allowNonIncreasingOIDs bool
+	adaptiveMaxRepetitions bool
+}
+
+func newWalkGroup(module *NamedModule) walkGroup {
+	g := walkGroup{
+		maxRepetitions:         module.WalkParams.MaxRepetitions,
+		timeout:                module.WalkParams.Timeout,
+		allowNonIncreasingOIDs: module.WalkParams.AllowNonIncreasingOIDs,
+		adaptiveMaxRepetitions: module.WalkParams.AdaptiveMaxRepetitions,
+	}
+	if module.WalkParams.Retries != nil {
+		g.retries = *module.WalkParams.Retries
+	}
+	return g
+}
+
+type sharedWalkKey struct {
+	group walkGroup
+	root  string
+}
+
+// sharedWalk is a walk that is done once for all the modules that need it.
+type sharedWalk struct {
+	done chan struct{}
+	pdus []gosnmp.SnmpPDU
+	err  error
+}
+
+// sharedWalks walks the subtrees that several modules of a request walk,
+// or that are within a subtree another module walks, once for the request.
+// Overlapping subtrees are merged into the one that covers them, like the
+// generator does for the subtrees of a module.
+type sharedWalks struct {
+	// The subtree each shared subtree is served from, by walk group.
+	roots map[walkGroup]map[string]string
+
+	mu    sync.Mutex
+	walks map[sharedWalkKey]*sharedWalk
+}
+
+// sharesWalks reports whether a module shares walks. Streamed modules do not,
+// as their PDUs are not kept, and neither do modules with max_pdus, as a
+// shared walk is kept in memory whole before its PDUs are passed to each
+// module.
+func sharesWalks(module *NamedModule) bool {
+	return !module.WalkParams.Streaming && module.WalkParams.MaxPDUs == 0
+}
+
+// newSharedWalks plans the walks that the modules share. It returns nil if
+// they share none.
+func newSharedWalks(modules []*NamedModule) *sharedWalks {
+	// The modules that walk each subtree, by walk group.
+	walkers := map[walkGroup]map[string]map[string]bool{}
+	for _, m := range modules {
+		if !sharesWalks(m) {
+			continue
+		}
+		group := newWalkGroup(m)
+		if walkers[group] == nil {
+			walkers[group] = map[string]map[string]bool{}
+		}
+		oids := append([]string{}, m.Walk...)
+		for _, filter := range m.Filters {
+			oids = append(oids, filter.Oid)
+		}
+		for _, oid := range oids {
+			if walkers[group][oid] == nil {
+				walkers[group][oid] = map[string]bool{}
+			}
+			walkers[group][oid][m.name] = true
+		}
+	}
+
+	var s *sharedWalks
+	for group, subtrees := range walkers {
+		oids := make([]string, 0, len(subtrees))
+		for oid := range subtrees {
+			oids = append(oids, oid)
+		}
+		// A subtree sorts right after the subtrees that contain it.
+		sort.Strings(oids)
+		covered := map[string][]string{}
+		var root string
+		for _, oid := range oids {
+			if root == "" || !strings.HasPrefix(oid+".", root+".") {
+				root = oid
+			}
+			covered[root] = append(covered[root], oid)
+		}
+		for root, oids := range covered {
+			modules := map[string]bool{}
+			for _, oid := range oids {
+				for m := range subtrees[oid] {
+					modules[m] = true
+				}
+			}
+			if len(modules) < 2 {
+				continue
+			}
+			if s == nil {
+				s = &sharedWalks{roots: map[walkGroup]map[string]string{}, walks: map[sharedWalkKey]*sharedWalk{}}
+			}
+			if s.roots[group] == nil {
+				s.roots[group] = map[string]string{}
+			}
+			for _, oid := range oids {
+				s.roots[group][oid] = root
+			}
+		}
+	}
+	return s
+}
+
+// client returns a client for a module that serves its shared walks from the
+// walks of the request. Walks by other modules are waited for until ctx, the
+// context of the scrape of the module, is done.
+func (s *sharedWalks) client(ctx context.Context, client scraper.SNMPScraper, module *NamedModule) scraper.SNMPScraper {
+	if s == nil || !sharesWalks(module) {
+		return client
+	}
+	roots, ok := s.roots[newWalkGroup(module)]
+	if !ok {
+		return client
+	}
+	return &sharedWalkClient{SNMPScraper: client, ctx: ctx, walks: s, group: newWalkGroup(module), roots: roots}
+}
+
+// walk returns the PDUs of the shared subtree root, walking it with client
+// unless it was already walked or is being walked by another module, in
+// which case it is waited for until ctx is done.
+func (s *sharedWalks) walk(ctx context.Context, client scraper.SNMPScraper, group walkGroup, root string) ([]gosnmp.SnmpPDU, error) {
+	key := sharedWalkKey{group: group, root: root}
+	s.mu.Lock()
+	w, ok := s.walks[key]
+	if !ok {
+		w = &sharedWalk{done: make(chan struct{})}
+		s.walks[key] = w
+	}
+	s.mu.Unlock()
+	if ok {
+		select {
+		case <-w.done:
+			return w.pdus, w.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	w.pdus, w.err = client.WalkAll(root)
+	close(w.done)
+	return w.pdus, w.err
+}
+
+// sharedWalkClient is the client of a module whose walks are shared with
+// other modules of the request.
+type sharedWalkClient struct {
+	scraper.SNMPScraper
+	ctx   context.Context
+	walks *sharedWalks
+	group walkGroup
+	roots map[string]string
+}
+
+func (s *sharedWalkClient) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	root, ok := s.roots[oid]
+	if !ok {
+		return s.SNMPScraper.WalkAll(oid)
+	}
+	pdus, err := s.walks.walk(s.ctx, s.SNMPScraper, s.group, root)
+	if oid == root {
+		return pdus, err
+	}
+	return subtreePDUs(pdus, oid), err
+}
+
+// Walk passes the PDUs of a shared walk to fn once the walk has finished.
+func (s *sharedWalkClient) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	if _, ok := s.roots[oid]; !ok {
+		return s.SNMPScraper.Walk(oid, fn)
+	}
+	pdus, err := s.WalkAll(oid)
+	for _, pdu := range pdus {
+		if err := fn(pdu); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// subtreePDUs returns the PDUs within the subtree oid.
+func subtreePDUs(pdus []gosnmp.SnmpPDU, oid string) []gosnmp.SnmpPDU {
+	var subtree []gosnmp.SnmpPDU
+	for _, pdu := range pdus {
+		name := strings.TrimPrefix(pdu.Name, ".")
+		if name == oid || strings.HasPrefix(name, oid+".") {
+			subtree = append(subtree, pdu)
+		}
+	}
+	return subtree
+}
@@ -0,0 +1,155 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+func TestSharedWalks(t *testing.T) {
+	ifMib := NewNamedModule("if_mib", &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2.2.1", "1.3.6.1.2.1.31.1.1.1"},
+	})
+	cisco := NewNamedModule("cisco", &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.4.1.9.9.13"},
+	})
+	// Walks with other parameters are not shared.
+	other := NewNamedModule("other", &config.Module{
+		Walk:       []string{"1.3.6.1.2.1.2.2.1.2"},
+		WalkParams: config.WalkParams{MaxRepetitions: 10},
+	})
+
+	walkResponses := map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1": {
+			{Type: gosnmp.Integer, Name: ".1.3.6.1.2.1.2.2.1.1.1", Value: 1},
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+			{Type: gosnmp.Integer, Name: ".1.3.6.1.2.1.2.2.1.20.1", Value: 0},
+		},
+		"1.3.6.1.2.1.2.2.1.2": {
+			{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"},
+		},
+	}
+
+	shared := newSharedWalks([]*NamedModule{ifMib, cisco, other})
+	expectRoots := map[walkGroup]map[string]string{
+		newWalkGroup(ifMib): {
+			"1.3.6.1.2.1.2.2.1":   "1.3.6.1.2.1.2.2.1",
+			"1.3.6.1.2.1.2.2.1.2": "1.3.6.1.2.1.2.2.1",
+		},
+	}
+	if !reflect.DeepEqual(shared.roots, expectRoots) {
+		t.Fatalf("Expected shared walks %v, got %v", expectRoots, shared.roots)
+	}
+
+	scrape := func(m *NamedModule) (*ScrapeResults, []string) {
+		t.Helper()
+		mock := scraper.NewMockSNMPScraper(nil, walkResponses)
+		results, err := ScrapeTarget(context.Background(), shared.client(context.Background(), mock, m), "someTarget", &config.Auth{Version: 2}, m.Module, promslog.NewNopLogger(), Metrics{})
+		if err != nil {
+			t.Fatalf("ScrapeTarget returned an error: %v", err)
+		}
+		return &results, mock.CallWalk()
+	}
+
+	results, walks := scrape(ifMib)
+	if len(results.pdus) != 3 || !reflect.DeepEqual(walks, ifMib.Walk) {
+		t.Errorf("Unexpected if_mib scrape: %v, walks %v", results.pdus, walks)
+	}
+	// ifDescr comes from the walk of ifEntry by if_mib.
+	results, walks = scrape(cisco)
+	expectPdus := []gosnmp.SnmpPDU{{Type: gosnmp.OctetString, Name: ".1.3.6.1.2.1.2.2.1.2.1", Value: "lo"}}
+	if !reflect.DeepEqual(results.pdus, expectPdus) {
+		t.Errorf("Expected PDUs %v, got %v", expectPdus, results.pdus)
+	}
+	if expectWalks := []string{"1.3.6.1.4.1.9.9.13"}; !reflect.DeepEqual(walks, expectWalks) {
+		t.Errorf("Expected walks %v, got %v", expectWalks, walks)
+	}
+	if _, walks = scrape(other); !reflect.DeepEqual(walks, other.Walk) {
+		t.Errorf("Expected walks %v, got %v", other.Walk, walks)
+	}
+
+	if newSharedWalks([]*NamedModule{ifMib}) != nil {
+		t.Error("Expected no shared walks for a single module")
+	}
+
+	// Modules waiting for a walk by another stop once their scrape is done.
+	shared = newSharedWalks([]*NamedModule{ifMib, cisco})
+	walker := blockingScraper{SNMPScraper: scraper.NewMockSNMPScraper(nil, walkResponses), started: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(walker.release)
+	go shared.client(context.Background(), walker, ifMib).WalkAll("1.3.6.1.2.1.2.2.1")
+	<-walker.started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := shared.client(ctx, scraper.NewMockSNMPScraper(nil, nil), cisco).WalkAll("1.3.6.1.2.1.2.2.1.2"); err != context.Canceled {
+		t.Errorf("Expected the wait for the shared walk to be cancelled, got %v", err)
+	}
+}
+
+func TestSharedWalksMaxPDUs(t *testing.T) {
+	walkParams := config.WalkParams{MaxPDUs: 2}
+	limited := NewNamedModule("limited", &config.Module{Walk: []string{"1.3.6.1.2.1.2.2.1"}, WalkParams: walkParams})
+	ifMib := NewNamedModule("if_mib", &config.Module{Walk: []string{"1.3.6.1.2.1.2.2.1"}})
+	cisco := NewNamedModule("cisco", &config.Module{Walk: []string{"1.3.6.1.2.1.2.2.1.2"}})
+
+	// Modules with max_pdus walk on their own, so that their walks stop at
+	// the limit.
+	if shared := newSharedWalks([]*NamedModule{limited, ifMib}); shared != nil {
+		t.Errorf("Expected no shared walks with a module with max_pdus, got %v", shared.roots)
+	}
+	shared := newSharedWalks([]*NamedModule{limited, ifMib, cisco})
+	expectRoots := map[walkGroup]map[string]string{
+		newWalkGroup(ifMib): {
+			"1.3.6.1.2.1.2.2.1":   "1.3.6.1.2.1.2.2.1",
+			"1.3.6.1.2.1.2.2.1.2": "1.3.6.1.2.1.2.2.1",
+		},
+	}
+	if !reflect.DeepEqual(shared.roots, expectRoots) {
+		t.Fatalf("Expected shared walks %v, got %v", expectRoots, shared.roots)
+	}
+
+	var pdus []gosnmp.SnmpPDU
+	for i := range 10 {
+		pdus = append(pdus, gosnmp.SnmpPDU{Type: gosnmp.Integer, Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.1.%d", i+1), Value: i})
+	}
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{"1.3.6.1.2.1.2.2.1": pdus})
+	walker := &countingWalker{SNMPScraper: mock}
+	if _, err := ScrapeTarget(context.Background(), shared.client(context.Background(), walker, limited), "someTarget", &config.Auth{Version: 2}, limited.Module, promslog.NewNopLogger(), Metrics{}); scraper.Reason(err) != scraper.ReasonPDULimit {
+		t.Errorf("Expected the PDU limit to be exceeded, got %v", err)
+	}
+	if walker.passed != 3 {
+		t.Errorf("Expected the walk of the target to stop past the limit, got %d PDUs", walker.passed)
+	}
+}
+
+// countingWalker counts the PDUs its walks pass on.
+type countingWalker struct {
+	scraper.SNMPScraper
+	passed int
+}
+
+func (c *countingWalker) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	return c.SNMPScraper.Walk(oid, func(pdu gosnmp.SnmpPDU) error {
+		c.passed++
+		return fn(pdu)
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// pduStream turns the PDUs of a streamed module into samples as they are
+// received. The samples of metrics that need no other PDUs are sent right
+// away. Only the PDUs of the columns that lookups and combined types read,
+// and of the metrics that read them, are kept until the scrape is done.
+type pduStream struct {
+	plan    *ModulePlan
+	ch      chan<- prometheus.Metric
+	logger  *slog.Logger
+	metrics Metrics
+	// The most PDUs the scrape may return, 0 for no limit.
+	limit int
+
+	mu       sync.Mutex
+	count    int
+	retained map[string]gosnmp.SnmpPDU
+	// The OIDs of the PDUs received so far, so that a PDU fetched twice,
+	// such as by a get and a walk, is turned into samples once.
+	seen map[string]struct{}
+}
+
+func newPDUStream(plan *ModulePlan, maxPDUs int, ch chan<- prometheus.Metric, logger *slog.Logger, metrics Metrics) *pduStream {
+	return &pduStream{
+		plan:     plan,
+		ch:       ch,
+		logger:   logger,
+		metrics:  metrics,
+		limit:    maxPDUs,
+		retained: map[string]gosnmp.SnmpPDU{},
+		seen:     map[string]struct{}{},
+	}
+}
+
+// add processes a PDU. It fails once the scrape returned more PDUs than the
+// limit. PDUs with an OID that was already received are counted but
+// otherwise ignored, so that each OID is turned into samples once, as when
+// the PDUs of a scrape are not streamed.
+func (s *pduStream) add(pdu gosnmp.SnmpPDU) error {
+	oid := pdu.Name[1:]
+	oidList := oidToList(oid)
+	var (
+		metric *metricPlan
+		index  []int
+		retain bool
+	)
+	head := s.plan.metricTree
+	for i, o := range oidList {
+		var ok bool
+		head, ok = head.children[o]
+		if !ok {
+			break
+		}
+		retain = retain || head.retain
+		if head.metric != nil && metric == nil {
+			metric, index = head.metric, oidList[i+1:]
+		}
+	}
+
+	s.mu.Lock()
+	s.count++
+	if s.limit > 0 && s.count > s.limit {
+		s.mu.Unlock()
+		return pduLimitError(s.limit)
+	}
+	if _, ok := s.seen[oid]; ok {
+		s.mu.Unlock()
+		return nil
+	}
+	s.seen[oid] = struct{}{}
+	if retain || (metric != nil && metric.deferred) {
+		s.retained[oid] = pdu
+	}
+	s.mu.Unlock()
+
+	if metric != nil && !metric.deferred {
+		for _, sample := range pduToSamples(index, &pdu, metric, nil, s.logger, s.metrics) {
+			s.ch <- sample
+		}
+	}
+	return nil
+}
+
+// finish sends the samples of the metrics that needed other PDUs, once all
+// of them were received.
+func (s *pduStream) finish() {
+	for oid, pdu := range s.retained {
+		metric, index := matchMetric(s.plan.metricTree, oidToList(oid))
+		if metric == nil || !metric.deferred {
+			continue
+		}
+		for _, sample := range pduToSamples(index, &pdu, metric, s.retained, s.logger, s.metrics) {
+			s.ch <- sample
+		}
+	}
+}
+
+func pduLimitError(limit int) error {
+	return &scraper.Error{Reason: scraper.ReasonPDULimit, Err: fmt.Errorf("target returned more than %d PDUs", limit)}
+}
@@ -0,0 +1,142 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+func TestStreamedScrape(t *testing.T) {
+	ifIndex := []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}
+	module := &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2.2.1"},
+		Metrics: []*config.Metric{
+			{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString", Indexes: ifIndex},
+			{Name: "ifMtu", Oid: "1.3.6.1.2.1.2.2.1.4", Type: "gauge", Indexes: ifIndex},
+			{Name: "ifInOctets", Oid: "1.3.6.1.2.1.2.2.1.10", Type: "counter", Indexes: ifIndex, Lookups: []*config.Lookup{
+				{Labels: []string{"ifIndex"}, Labelname: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString"},
+			}},
+		},
+		WalkParams: config.WalkParams{Streaming: true},
+	}
+	// The counter comes before the column its lookup reads.
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1": {
+			{Name: ".1.3.6.1.2.1.2.2.1.10.1", Type: gosnmp.Counter32, Value: uint(100)},
+			{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("lo")},
+			{Name: ".1.3.6.1.2.1.2.2.1.4.1", Type: gosnmp.Integer, Value: 1500},
+		},
+	})
+	plan, err := CompileModule(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	stream := newPDUStream(plan, 0, ch, promslog.NewNopLogger(), Metrics{})
+	results, err := scrapeTarget(context.Background(), mock, nil, nil, "someTarget", &config.Auth{Version: 2}, NewNamedModule("if_mib", module), promslog.NewNopLogger(), Metrics{}, stream)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(results.pdus) != 0 || results.pduCount() != 3 {
+		t.Errorf("Expected 3 streamed PDUs, got %d kept and %d counted", len(results.pdus), results.pduCount())
+	}
+	// ifMtu is not kept, as nothing reads it.
+	retained := make([]string, 0, len(stream.retained))
+	for oid := range stream.retained {
+		retained = append(retained, oid)
+	}
+	slices.Sort(retained)
+	if expected := []string{"1.3.6.1.2.1.2.2.1.10.1", "1.3.6.1.2.1.2.2.1.2.1"}; !reflect.DeepEqual(retained, expected) {
+		t.Errorf("Expected to retain %v, got %v", expected, retained)
+	}
+	if len(ch) != 2 {
+		t.Errorf("Expected the samples of ifDescr and ifMtu during the walk, got %d", len(ch))
+	}
+
+	// A PDU that is received again is not turned into samples again.
+	if err := stream.add(gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.4.1", Type: gosnmp.Integer, Value: 1500}); err != nil || len(ch) != 2 || stream.count != 4 {
+		t.Errorf("Expected a duplicate PDU to be counted only, got %v, %d samples and %d PDUs", err, len(ch), stream.count)
+	}
+
+	stream.finish()
+	close(ch)
+	var counters []map[string]string
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatal(err)
+		}
+		if pb.Counter == nil {
+			continue
+		}
+		labels := map[string]string{}
+		for _, l := range pb.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		counters = append(counters, labels)
+	}
+	if expected := []map[string]string{{"ifIndex": "1", "ifDescr": "lo"}}; !reflect.DeepEqual(counters, expected) {
+		t.Errorf("Expected ifInOctets with the ifDescr of its lookup once the walk finished, got %v", counters)
+	}
+}
+
+func TestScrapeMaxPDUs(t *testing.T) {
+	module := &config.Module{
+		Walk:       []string{"1.3.6.1.2.1.2.2.1"},
+		WalkParams: config.WalkParams{MaxPDUs: 2, PartialResults: true},
+	}
+	mock := scraper.NewMockSNMPScraper(nil, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1": {
+			{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("lo")},
+			{Name: ".1.3.6.1.2.1.2.2.1.2.2", Type: gosnmp.OctetString, Value: []byte("eth0")},
+			{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: gosnmp.OctetString, Value: []byte("eth1")},
+		},
+	})
+
+	// The limit fails the module even with partial results.
+	for _, streaming := range []bool{false, true} {
+		module.WalkParams.Streaming = streaming
+		plan, err := CompileModule(module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stream *pduStream
+		if streaming {
+			stream = newPDUStream(plan, module.WalkParams.MaxPDUs, make(chan prometheus.Metric, 10), promslog.NewNopLogger(), Metrics{})
+		}
+		_, err = scrapeTarget(context.Background(), mock, nil, nil, "someTarget", &config.Auth{Version: 2}, NewNamedModule("if_mib", module), promslog.NewNopLogger(), Metrics{}, stream)
+		if reason := scraper.Reason(err); reason != scraper.ReasonPDULimit {
+			t.Errorf("Streaming %v: expected a PDU limit error, got %v", streaming, err)
+		}
+	}
+
+	// The walk ends as soon as the limit is passed, counting the PDUs
+	// fetched before it.
+	walks := walkSubtrees(context.Background(), mock, nil, nil, module.Walk, module.WalkParams, 1, promslog.NewNopLogger(), nil)
+	if w := walks[0]; scraper.Reason(w.err) != scraper.ReasonPDULimit || len(w.pdus) != 2 {
+		t.Errorf("Expected the walk to end after 2 PDUs, got %d PDUs and %v", len(w.pdus), w.err)
+	}
+}
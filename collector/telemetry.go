@@ -0,0 +1,111 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// subtreeStats is the telemetry of the walk of a subtree, or of a get batch
+// along with the batches it was split into.
+type subtreeStats struct {
+	// "walk" or "get".
+	kind string
+	// The subtree, or the first OID of the get batch.
+	oid      string
+	duration time.Duration
+	pdus     int
+	packets  uint64
+	retries  uint64
+}
+
+// packetCounter counts the packets sent on a session.
+type packetCounter struct {
+	packets atomic.Uint64
+	retries atomic.Uint64
+}
+
+// countPackets starts counting the packets sent on a session, on top of the
+// hooks it already has. It is called once per session, as each call wraps the
+// hooks again.
+func countPackets(client scraper.SNMPScraper) *packetCounter {
+	c := &packetCounter{}
+	client.SetOptions(func(g *gosnmp.GoSNMP) {
+		onSent, onRetry := g.OnSent, g.OnRetry
+		g.OnSent = func(x *gosnmp.GoSNMP) {
+			if onSent != nil {
+				onSent(x)
+			}
+			c.packets.Add(1)
+		}
+		g.OnRetry = func(x *gosnmp.GoSNMP) {
+			if onRetry != nil {
+				onRetry(x)
+			}
+			c.retries.Add(1)
+		}
+	})
+	return c
+}
+
+// measure returns a function that completes the stats of a request started
+// now, once it has returned pdus. A nil counter measures no packets.
+func (c *packetCounter) measure(kind, oid string) func(pdus int) subtreeStats {
+	start := time.Now()
+	packets, retries := c.load()
+	return func(pdus int) subtreeStats {
+		p, r := c.load()
+		return subtreeStats{
+			kind:     kind,
+			oid:      oid,
+			duration: time.Since(start),
+			pdus:     pdus,
+			packets:  p - packets,
+			retries:  r - retries,
+		}
+	}
+}
+
+func (c *packetCounter) load() (packets, retries uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.packets.Load(), c.retries.Load()
+}
+
+// sendSubtreeStats sends the telemetry of each subtree and get batch of a
+// scrape. The OIDs are named after the metric they belong to, if any.
+func sendSubtreeStats(ch chan<- prometheus.Metric, plan *ModulePlan, stats []subtreeStats, moduleLabel prometheus.Labels) {
+	labels := []string{"kind", "oid", "name"}
+	durationDesc := prometheus.NewDesc("snmp_scrape_subtree_duration_seconds", "Time the walk of the subtree, or the get batch starting at the OID, took.", labels, moduleLabel)
+	pdusDesc := prometheus.NewDesc("snmp_scrape_subtree_pdus_returned", "PDUs returned for the subtree or get batch.", labels, moduleLabel)
+	packetsDesc := prometheus.NewDesc("snmp_scrape_subtree_packets_sent", "Packets sent for the subtree or get batch; including retries.", labels, moduleLabel)
+	retriesDesc := prometheus.NewDesc("snmp_scrape_subtree_packets_retried", "Packets retried for the subtree or get batch.", labels, moduleLabel)
+	for _, s := range stats {
+		var name string
+		if metric, _ := matchMetric(plan.metricTree, oidToList(s.oid)); metric != nil {
+			name = metric.Name
+		}
+		ch <- prometheus.MustNewConstMetric(durationDesc, prometheus.GaugeValue, s.duration.Seconds(), s.kind, s.oid, name)
+		ch <- prometheus.MustNewConstMetric(pdusDesc, prometheus.GaugeValue, float64(s.pdus), s.kind, s.oid, name)
+		ch <- prometheus.MustNewConstMetric(packetsDesc, prometheus.GaugeValue, float64(s.packets), s.kind, s.oid, name)
+		ch <- prometheus.MustNewConstMetric(retriesDesc, prometheus.GaugeValue, float64(s.retries), s.kind, s.oid, name)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// packetScraper calls the packet hooks of its options for each request, with
+// a retry for walks of the OIDs in retried.
+type packetScraper struct {
+	scraper.SNMPScraper
+	g       gosnmp.GoSNMP
+	retried map[string]bool
+}
+
+func (p *packetScraper) SetOptions(fns ...func(*gosnmp.GoSNMP)) {
+	for _, fn := range fns {
+		fn(&p.g)
+	}
+}
+
+func (p *packetScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	p.g.OnSent(&p.g)
+	return p.SNMPScraper.Get(oids)
+}
+
+func (p *packetScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	p.g.OnSent(&p.g)
+	if p.retried[oid] {
+		p.g.OnRetry(&p.g)
+		p.g.OnSent(&p.g)
+	}
+	return p.SNMPScraper.WalkAll(oid)
+}
+
+func (p *packetScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	pdus, err := p.WalkAll(oid)
+	for _, pdu := range pdus {
+		if err := fn(pdu); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func TestSubtreeTelemetry(t *testing.T) {
+	module := &config.Module{
+		Get:  []string{"1.3.6.1.2.1.1.3.0"},
+		Walk: []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.31.1.1"},
+		Metrics: []*config.Metric{
+			{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3", Type: "gauge"},
+			{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", Type: "DisplayString", Indexes: []*config.Index{{Labelname: "ifIndex", Type: "gauge"}}},
+		},
+		WalkParams: config.WalkParams{MaxRepetitions: 25, SubtreeTelemetry: true},
+	}
+	mock := scraper.NewMockSNMPScraper(map[string]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.1.3.0": {Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(100)},
+	}, map[string][]gosnmp.SnmpPDU{
+		"1.3.6.1.2.1.2.2.1.2": {
+			{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("lo")},
+			{Name: ".1.3.6.1.2.1.2.2.1.2.2", Type: gosnmp.OctetString, Value: []byte("eth0")},
+		},
+	})
+	client := &packetScraper{SNMPScraper: mock, retried: map[string]bool{"1.3.6.1.2.1.31.1.1": true}}
+	results, err := scrapeTarget(context.Background(), client, countPackets(client), nil, "someTarget", &config.Auth{Version: 2}, NewNamedModule("if_mib", module), promslog.NewNopLogger(), Metrics{}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []subtreeStats{
+		{kind: "get", oid: "1.3.6.1.2.1.1.3.0", pdus: 1, packets: 1},
+		{kind: "walk", oid: "1.3.6.1.2.1.2.2.1.2", pdus: 2, packets: 1},
+		{kind: "walk", oid: "1.3.6.1.2.1.31.1.1", pdus: 0, packets: 2, retries: 1},
+	}
+	if len(results.subtrees) != len(expected) {
+		t.Fatalf("Expected %d subtrees, got %v", len(expected), results.subtrees)
+	}
+	for i, s := range results.subtrees {
+		s.duration = 0
+		if s != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], s)
+		}
+	}
+
+	plan, err := CompileModule(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan prometheus.Metric, 20)
+	sendSubtreeStats(ch, plan, expected, prometheus.Labels{"module": "if_mib"})
+	close(ch)
+	var pdus []prometheus.Metric
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), "subtree_pdus_returned") {
+			pdus = append(pdus, m)
+		}
+	}
+	c := prometheus.CollectorFunc(func(c chan<- prometheus.Metric) {
+		for _, m := range pdus {
+			c <- m
+		}
+	})
+	// OIDs are named after the metric they belong to.
+	expectedMetrics := `# HELP snmp_scrape_subtree_pdus_returned PDUs returned for the subtree or get batch.
+# TYPE snmp_scrape_subtree_pdus_returned gauge
+snmp_scrape_subtree_pdus_returned{kind="get",module="if_mib",name="sysUpTime",oid="1.3.6.1.2.1.1.3.0"} 1
+snmp_scrape_subtree_pdus_returned{kind="walk",module="if_mib",name="",oid="1.3.6.1.2.1.31.1.1"} 0
+snmp_scrape_subtree_pdus_returned{kind="walk",module="if_mib",name="ifDescr",oid="1.3.6.1.2.1.2.2.1.2"} 2
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expectedMetrics)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gosnmp/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+var errSessionLimit = errors.New("session limits reached")
+
+// sessionOpener opens another connected session to the target of a scrape,
+// whose requests run with ctx, for subtrees to be walked in parallel.
+type sessionOpener func(ctx context.Context) (scraper.SNMPScraper, error)
+
+// sessionOpener returns a sessionOpener for sessions that walk a module with
+// the given options. Sessions are only opened while the session limits allow
+// it without waiting.
+func (c Collector) sessionOpener(logger *slog.Logger, module *NamedModule, options ...func(*gosnmp.GoSNMP)) sessionOpener {
+	return func(ctx context.Context) (scraper.SNMPScraper, error) {
+		release, ok := sessions().tryAcquire(c.target)
+		if !ok {
+			return nil, errSessionLimit
+		}
+		client, err := c.newClient(ctx, logger)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if err := client.Connect(); err != nil {
+			release()
+			return nil, err
+		}
+		client.SetOptions(options...)
+		c.adaptRepetitions(client, module)
+		return c.moduleClient(ctx, &limitedClient{SNMPScraper: client, release: release}, module, logger), nil
+	}
+}
+
+// limitedClient is a session that gives back its place in the session
+// limits once closed.
+type limitedClient struct {
+	scraper.SNMPScraper
+	release func()
+}
+
+func (l *limitedClient) Close() error {
+	defer l.release()
+	return l.SNMPScraper.Close()
+}
+
+// subtreeWalk is the outcome of the walk of one subtree.
+type subtreeWalk struct {
+	pdus   []gosnmp.SnmpPDU
+	err    error
+	walked bool
+	// Whether the scrape deadline had passed once the walk failed.
+	budgetExhausted bool
+	stats           subtreeStats
+}
+
+// walkSubtrees walks the subtrees, on up to walk_concurrency sessions at the
+// same time. The first session is snmp, whose packets counter counts, the
+// others come from openSession and have their packets counted here.
+// The subtrees are handed out in order, and stop being handed out once the
+// scrape deadline has passed or, without partial_results, a walk has failed.
+// The walks that were not started are thus always the last ones. If stream
+// is not nil, the PDUs are passed to it rather than kept in the walks.
+// Otherwise a walk ends once the module has returned more than max_pdus,
+// counting the fetched PDUs the module already returned.
+func walkSubtrees(ctx context.Context, snmp scraper.SNMPScraper, counter *packetCounter, openSession sessionOpener, subtrees []string, walkParams config.WalkParams, fetched int, logger *slog.Logger, stream *pduStream) []subtreeWalk {
+	walks := make([]subtreeWalk, len(subtrees))
+	var (
+		mu   sync.Mutex
+		next int
+		done bool
+	)
+	var returned atomic.Int64
+	returned.Store(int64(fetched))
+	take := func() (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if done || next == len(subtrees) || budgetExhausted(ctx) {
+			done = true
+			return 0, false
+		}
+		next++
+		return next - 1, true
+	}
+	walk := func(client scraper.SNMPScraper, counter *packetCounter) {
+		for i, ok := take(); ok; i, ok = take() {
+			planRequest(ctx, client, walkParams)
+			measured := counter.measure("walk", subtrees[i])
+			var (
+				pdus []gosnmp.SnmpPDU
+				err  error
+			)
+			if stream != nil {
+				streamed := 0
+				err = client.Walk(subtrees[i], func(pdu gosnmp.SnmpPDU) error {
+					streamed++
+					return stream.add(pdu)
+				})
+				walks[i].stats = measured(streamed)
+			} else {
+				err = client.Walk(subtrees[i], func(pdu gosnmp.SnmpPDU) error {
+					pdus = append(pdus, pdu)
+					if walkParams.MaxPDUs > 0 && returned.Add(1) > int64(walkParams.MaxPDUs) {
+						return pduLimitError(walkParams.MaxPDUs)
+					}
+					return nil
+				})
+				walks[i].stats = measured(len(pdus))
+			}
+			walks[i].pdus, walks[i].err, walks[i].walked = pdus, err, true
+			walks[i].budgetExhausted = err != nil && budgetExhausted(ctx)
+			if err != nil && (!walkParams.PartialResults || scraper.Reason(err) == scraper.ReasonPDULimit) {
+				mu.Lock()
+				done = true
+				mu.Unlock()
+			}
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 1; i < min(walkParams.WalkConcurrency, len(subtrees)) && openSession != nil; i++ {
+		client, err := openSession(ctx)
+		if err != nil {
+			logger.Debug("Could not open another session, walking with fewer", "sessions", i, "err", err)
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			walk(client, countPackets(client))
+		}()
+	}
+	walk(snmp, counter)
+	wg.Wait()
+	return walks
+}
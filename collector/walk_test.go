@@ -0,0 +1,133 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/scraper"
+)
+
+// slowScraper takes a while for each walk, and tracks how many walks of
+// all sessions run at the same time.
+type slowScraper struct {
+	scraper.SNMPScraper
+	inflight, maxInflight *atomic.Int32
+	closed                *atomic.Int32
+}
+
+func (s slowScraper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
+	n := s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+	for {
+		m := s.maxInflight.Load()
+		if n <= m || s.maxInflight.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return s.SNMPScraper.WalkAll(oid)
+}
+
+func (s slowScraper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	pdus, err := s.WalkAll(oid)
+	for _, pdu := range pdus {
+		if err := fn(pdu); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (s slowScraper) Close() error {
+	s.closed.Add(1)
+	return nil
+}
+
+func TestScrapeTargetWalkConcurrency(t *testing.T) {
+	module := &config.Module{WalkParams: config.WalkParams{WalkConcurrency: 3}}
+	walkResponses := map[string][]gosnmp.SnmpPDU{}
+	var expectPdus []gosnmp.SnmpPDU
+	for i := 1; i <= 7; i++ {
+		oid := fmt.Sprintf("1.3.6.1.2.1.2.2.1.%d", i)
+		module.Walk = append(module.Walk, oid)
+		pdus := []gosnmp.SnmpPDU{
+			{Type: gosnmp.Integer, Name: "." + oid + ".1", Value: i},
+			{Type: gosnmp.Integer, Name: "." + oid + ".2", Value: i},
+		}
+		walkResponses[oid] = pdus
+		expectPdus = append(expectPdus, pdus...)
+	}
+	timeout := errors.New("request timeout (after 3 retries)")
+
+	var inflight, maxInflight, closed atomic.Int32
+	newScraper := func() slowScraper {
+		mock := scraper.NewMockSNMPScraper(nil, walkResponses)
+		mock.WalkErrors = map[string]error{"1.3.6.1.2.1.2.2.1.5": timeout}
+		return slowScraper{SNMPScraper: mock, inflight: &inflight, maxInflight: &maxInflight, closed: &closed}
+	}
+	opened := 0
+	openSession := func(context.Context) (scraper.SNMPScraper, error) {
+		opened++
+		return newScraper(), nil
+	}
+
+	// The results are merged in the order of the subtrees, whatever
+	// session walked them.
+	module.WalkParams.PartialResults = true
+	results, err := scrapeTarget(context.Background(), newScraper(), nil, openSession, "someTarget", &config.Auth{Version: 2}, NewNamedModule("walk", module), promslog.NewNopLogger(), Metrics{}, nil)
+	if err != nil {
+		t.Fatalf("ScrapeTarget returned an error: %v", err)
+	}
+	if !reflect.DeepEqual(results.pdus, expectPdus) {
+		t.Errorf("Expected PDUs %v, got %v", expectPdus, results.pdus)
+	}
+	expectErrors := []scrapeError{{oid: "1.3.6.1.2.1.2.2.1.5", reason: "timeout"}}
+	if !reflect.DeepEqual(results.errors, expectErrors) {
+		t.Errorf("Expected errors %v, got %v", expectErrors, results.errors)
+	}
+	if opened != 2 || closed.Load() != 2 {
+		t.Errorf("Expected 2 more sessions to be opened and closed, got %d opened, %d closed", opened, closed.Load())
+	}
+	if got := maxInflight.Load(); got != 3 {
+		t.Errorf("Expected 3 walks at the same time, got %d", got)
+	}
+
+	// Without partial_results the failed walk fails the module.
+	module.WalkParams.PartialResults = false
+	if _, err := scrapeTarget(context.Background(), newScraper(), nil, openSession, "someTarget", &config.Auth{Version: 2}, NewNamedModule("walk", module), promslog.NewNopLogger(), Metrics{}, nil); !errors.Is(err, timeout) {
+		t.Errorf("Expected the walk error, got %v", err)
+	}
+
+	// Sessions that cannot be opened leave the walks to the others.
+	module.WalkParams.PartialResults = true
+	maxInflight.Store(0)
+	results, err = scrapeTarget(context.Background(), newScraper(), nil, func(context.Context) (scraper.SNMPScraper, error) { return nil, errSessionLimit }, "someTarget", &config.Auth{Version: 2}, NewNamedModule("walk", module), promslog.NewNopLogger(), Metrics{}, nil)
+	if err != nil || !reflect.DeepEqual(results.pdus, expectPdus) {
+		t.Errorf("Unexpected results with one session: %v, %v", results.pdus, err)
+	}
+	if got := maxInflight.Load(); got != 1 {
+		t.Errorf("Expected the walks to run one at a time, got %d", got)
+	}
+}
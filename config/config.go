@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"time"
 
 	"github.com/gosnmp/gosnmp"
@@ -27,15 +28,23 @@ import (
 )
 
 type Auth struct {
-	Community     Secret `yaml:"community,omitempty"`
-	SecurityLevel string `yaml:"security_level,omitempty"`
-	Username      string `yaml:"username,omitempty"`
-	Password      Secret `yaml:"password,omitempty"`
-	AuthProtocol  string `yaml:"auth_protocol,omitempty"`
-	PrivProtocol  string `yaml:"priv_protocol,omitempty"`
-	PrivPassword  Secret `yaml:"priv_password,omitempty"`
-	ContextName   string `yaml:"context_name,omitempty"`
-	Version       int    `yaml:"version,omitempty"`
+	Community        Secret `yaml:"community,omitempty"`
+	CommunityFile    string `yaml:"community_file,omitempty"`
+	SecurityLevel    string `yaml:"security_level,omitempty"`
+	Username         string `yaml:"username,omitempty"`
+	Password         Secret `yaml:"password,omitempty"`
+	PasswordFile     string `yaml:"password_file,omitempty"`
+	AuthProtocol     string `yaml:"auth_protocol,omitempty"`
+	PrivProtocol     string `yaml:"priv_protocol,omitempty"`
+	PrivPassword     Secret `yaml:"priv_password,omitempty"`
+	PrivPasswordFile string `yaml:"priv_password_file,omitempty"`
+	ContextName      string `yaml:"context_name,omitempty"`
+	Version          int    `yaml:"version,omitempty"`
+
+	// The secrets given by reference to a secret provider.
+	CommunityRef    *SecretRef `yaml:"-"`
+	PasswordRef     *SecretRef `yaml:"-"`
+	PrivPasswordRef *SecretRef `yaml:"-"`
 }
 
 func LoadFile(logger *slog.Logger, paths []string, expandEnvVars bool) (*Config, error) {
@@ -86,6 +95,18 @@ func LoadFile(logger *slog.Logger, paths []string, expandEnvVars bool) (*Config,
 		}
 	}
 
+	if err := cfg.validateAuthChains(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateProfiles(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateTargets(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateTrapDefinitions(); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
@@ -116,9 +137,203 @@ var (
 
 // Config for the snmp_exporter.
 type Config struct {
-	Auths   map[string]*Auth   `yaml:"auths,omitempty"`
-	Modules map[string]*Module `yaml:"modules,omitempty"`
-	Version int                `yaml:"version,omitempty"`
+	Auths      map[string]*Auth        `yaml:"auths,omitempty"`
+	AuthChains map[string]*AuthChain   `yaml:"auth_chains,omitempty"`
+	Modules    map[string]*Module      `yaml:"modules,omitempty"`
+	Profiles   map[string]*Profile     `yaml:"profiles,omitempty"`
+	Targets    map[string]*TargetGroup `yaml:"targets,omitempty"`
+	// Notifications the trap receiver knows by name, keyed by name.
+	TrapDefinitions map[string]*TrapDefinition `yaml:"trap_definitions,omitempty"`
+	Version         int                        `yaml:"version,omitempty"`
+
+	// Maps each target to the name of its group.
+	targetIndex map[string]string
+	// Maps each trap OID to the name of its definition.
+	trapIndex map[string]string
+}
+
+// TrapDefinition is a NOTIFICATION-TYPE or TRAP-TYPE, as extracted by the
+// generator.
+type TrapDefinition struct {
+	Oid  string `yaml:"oid"`
+	Help string `yaml:"help,omitempty"`
+	// The objects the notification carries, in the order they are sent.
+	Objects []*TrapObject `yaml:"objects,omitempty"`
+}
+
+// TrapObject is an object carried by a notification.
+type TrapObject struct {
+	Name string `yaml:"name"`
+	Oid  string `yaml:"oid"`
+}
+
+// TrapDefinition returns the name and definition of the notification with
+// the given OID, or nil.
+func (c *Config) TrapDefinition(oid string) (string, *TrapDefinition) {
+	name, ok := c.trapIndex[oid]
+	if !ok {
+		return "", nil
+	}
+	return name, c.TrapDefinitions[name]
+}
+
+// validateTrapDefinitions checks that the trap definitions have an OID, and
+// that no OID is defined twice.
+func (c *Config) validateTrapDefinitions() error {
+	c.trapIndex = make(map[string]string)
+	for name, def := range c.TrapDefinitions {
+		if def == nil || def.Oid == "" {
+			return fmt.Errorf("trap definition %q has no oid", name)
+		}
+		if other, ok := c.trapIndex[def.Oid]; ok {
+			return fmt.Errorf("trap definitions %q and %q have the same oid %s", other, name, def.Oid)
+		}
+		c.trapIndex[def.Oid] = name
+	}
+	return nil
+}
+
+// AuthChain is a list of auths that are tried in order until one works. It
+// can be used wherever an auth can.
+type AuthChain struct {
+	Auths []string `yaml:"auths"`
+}
+
+// HasAuth reports whether name is an auth or an auth chain.
+func (c *Config) HasAuth(name string) bool {
+	_, auth := c.Auths[name]
+	_, chain := c.AuthChains[name]
+	return auth || chain
+}
+
+// validateAuthChains checks that the auth chains refer to known auths, and
+// that their names do not clash with those of auths.
+func (c *Config) validateAuthChains() error {
+	for name, chain := range c.AuthChains {
+		if chain == nil || len(chain.Auths) == 0 {
+			return fmt.Errorf("auth chain %q has no auths", name)
+		}
+		if _, ok := c.Auths[name]; ok {
+			return fmt.Errorf("auth chain %q has the same name as an auth", name)
+		}
+		for _, a := range chain.Auths {
+			if _, ok := c.Auths[a]; !ok {
+				return fmt.Errorf("auth chain %q uses unknown auth %q", name, a)
+			}
+		}
+	}
+	return nil
+}
+
+// Profile is a named combination of auth, modules, context, engine ID,
+// source address and walk parameters, so that scrapes of a class of devices
+// can refer to it by name.
+type Profile struct {
+	Auth          string              `yaml:"auth,omitempty"`
+	Modules       []string            `yaml:"modules,omitempty"`
+	SNMPContext   string              `yaml:"snmp_context,omitempty"`
+	SNMPEngineID  string              `yaml:"snmp_engineid,omitempty"`
+	SourceAddress string              `yaml:"source_address,omitempty"`
+	WalkParams    WalkParamsOverrides `yaml:",inline"`
+}
+
+// WalkParamsOverrides replace the walk parameters of the modules scraped
+// with a profile. Unset fields keep the value of the module.
+type WalkParamsOverrides struct {
+	MaxRepetitions *uint32        `yaml:"max_repetitions,omitempty"`
+	Retries        *int           `yaml:"retries,omitempty"`
+	Timeout        *time.Duration `yaml:"timeout,omitempty"`
+}
+
+// Apply returns the module with the overrides applied. The module itself is
+// not modified, as it is shared with other scrapes.
+func (o WalkParamsOverrides) Apply(module *Module) *Module {
+	if o.MaxRepetitions == nil && o.Retries == nil && o.Timeout == nil {
+		return module
+	}
+	m := *module
+	if o.MaxRepetitions != nil {
+		m.WalkParams.MaxRepetitions = *o.MaxRepetitions
+	}
+	if o.Retries != nil {
+		m.WalkParams.Retries = o.Retries
+	}
+	if o.Timeout != nil {
+		m.WalkParams.Timeout = *o.Timeout
+	}
+	return &m
+}
+
+// validateProfiles checks that the profiles refer to known auths and modules.
+func (c *Config) validateProfiles() error {
+	for name, profile := range c.Profiles {
+		if profile == nil {
+			return fmt.Errorf("profile %q is empty", name)
+		}
+		if profile.Auth != "" {
+			if !c.HasAuth(profile.Auth) {
+				return fmt.Errorf("profile %q uses unknown auth %q", name, profile.Auth)
+			}
+		}
+		for _, m := range profile.Modules {
+			if _, ok := c.Modules[m]; !ok {
+				return fmt.Errorf("profile %q uses unknown module %q", name, m)
+			}
+		}
+	}
+	return nil
+}
+
+// TargetGroup is a group of targets that are scraped with the same auth,
+// modules, context and engine ID.
+type TargetGroup struct {
+	Targets      []string          `yaml:"targets"`
+	Auth         string            `yaml:"auth,omitempty"`
+	Modules      []string          `yaml:"modules,omitempty"`
+	SNMPContext  string            `yaml:"snmp_context,omitempty"`
+	SNMPEngineID string            `yaml:"snmp_engineid,omitempty"`
+	Labels       map[string]string `yaml:"labels,omitempty"`
+}
+
+// TargetGroup returns the group a target belongs to, or nil.
+func (c *Config) TargetGroup(target string) *TargetGroup {
+	if c.targetIndex != nil {
+		return c.Targets[c.targetIndex[target]]
+	}
+	for _, group := range c.Targets {
+		if slices.Contains(group.Targets, target) {
+			return group
+		}
+	}
+	return nil
+}
+
+// validateTargets checks that the target groups refer to known auths and
+// modules, and that no target is in more than one group.
+func (c *Config) validateTargets() error {
+	c.targetIndex = make(map[string]string)
+	for name, group := range c.Targets {
+		if group == nil || len(group.Targets) == 0 {
+			return fmt.Errorf("target group %q has no targets", name)
+		}
+		if group.Auth != "" {
+			if !c.HasAuth(group.Auth) {
+				return fmt.Errorf("target group %q uses unknown auth %q", name, group.Auth)
+			}
+		}
+		for _, m := range group.Modules {
+			if _, ok := c.Modules[m]; !ok {
+				return fmt.Errorf("target group %q uses unknown module %q", name, m)
+			}
+		}
+		for _, t := range group.Targets {
+			if other, ok := c.targetIndex[t]; ok {
+				return fmt.Errorf("target %q is in both target groups %q and %q", t, other, name)
+			}
+			c.targetIndex[t] = name
+		}
+	}
+	return nil
 }
 
 type WalkParams struct {
@@ -127,6 +342,13 @@ type WalkParams struct {
 	Timeout                 time.Duration `yaml:"timeout,omitempty"`
 	UseUnconnectedUDPSocket bool          `yaml:"use_unconnected_udp_socket,omitempty"`
 	AllowNonIncreasingOIDs  bool          `yaml:"allow_nonincreasing_oids,omitempty"`
+	PartialResults          bool          `yaml:"partial_results,omitempty"`
+	CacheTTL                time.Duration `yaml:"cache_ttl,omitempty"`
+	AdaptiveMaxRepetitions  bool          `yaml:"adaptive_max_repetitions,omitempty"`
+	WalkConcurrency         int           `yaml:"walk_concurrency,omitempty"`
+	Streaming               bool          `yaml:"streaming,omitempty"`
+	MaxPDUs                 int           `yaml:"max_pdus,omitempty"`
+	SubtreeTelemetry        bool          `yaml:"subtree_telemetry,omitempty"`
 }
 
 type Module struct {
@@ -136,6 +358,9 @@ type Module struct {
 	Metrics    []*Metric       `yaml:"metrics"`
 	WalkParams WalkParams      `yaml:",inline"`
 	Filters    []DynamicFilter `yaml:"filters,omitempty"`
+	// How often to walk some of the subtrees of walk or of the filters, by
+	// OID. They are served from a cache of the target in between.
+	RefreshIntervals map[string]time.Duration `yaml:"refresh_intervals,omitempty"`
 }
 
 func (c *Module) UnmarshalYAML(unmarshal func(any) error) error {
@@ -145,7 +370,19 @@ func (c *Module) UnmarshalYAML(unmarshal func(any) error) error {
 		c.WalkParams.Retries = &retries
 	}
 	type plain Module
-	return unmarshal((*plain)(c))
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	for oid, interval := range c.RefreshIntervals {
+		walked := slices.Contains(c.Walk, oid) || slices.ContainsFunc(c.Filters, func(f DynamicFilter) bool { return f.Oid == oid })
+		if !walked {
+			return fmt.Errorf("refresh interval for %s, which is not a subtree walked by the module", oid)
+		}
+		if interval <= 0 {
+			return fmt.Errorf("refresh interval for %s must be positive", oid)
+		}
+	}
+	return nil
 }
 
 // ConfigureSNMP sets the various version and auth settings.
@@ -296,13 +533,22 @@ type Lookup struct {
 	EnumValues  map[int]string `yaml:"enum_values,omitempty"`
 }
 
-// Secret is a string that must not be revealed on marshaling.
+// Secret is a string that must not be revealed on marshaling. The secrets of
+// an auth may also refer to a secret provider, see SecretRef.
 type Secret string
 
 func (s *Secret) Set(value string) {
 	*s = Secret(value)
 }
 
+// String hides the secret from logs.
+func (s Secret) String() string {
+	if s != "" {
+		return "<secret>"
+	}
+	return ""
+}
+
 // Hack for creating snmp.yml with the secret.
 var (
 	DoNotHideSecrets = false
@@ -322,17 +568,47 @@ func (s Secret) MarshalYAML() (any, error) {
 func (c *Auth) UnmarshalYAML(unmarshal func(any) error) error {
 	*c = DefaultAuth
 	type plain Auth
-	if err := unmarshal((*plain)(c)); err != nil {
+	rest, err := c.unmarshalSecretRefs(unmarshal)
+	if err != nil {
 		return err
 	}
+	if rest == nil {
+		err = unmarshal((*plain)(c))
+	} else {
+		err = yaml.UnmarshalStrict(rest, (*plain)(c))
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range c.secretRefs() {
+		if *s.ref != nil {
+			*s.secret = ""
+		}
+	}
 
+	if c.CommunityFile != "" {
+		// The community defaults to public.
+		if c.Community != DefaultAuth.Community {
+			return fmt.Errorf("at most one of community and community_file must be set")
+		}
+		c.Community = ""
+	}
+	if c.CommunityRef != nil && c.CommunityFile != "" {
+		return fmt.Errorf("at most one of community and community_file must be set")
+	}
+	if (c.Password != "" || c.PasswordRef != nil) && c.PasswordFile != "" {
+		return fmt.Errorf("at most one of password and password_file must be set")
+	}
+	if (c.PrivPassword != "" || c.PrivPasswordRef != nil) && c.PrivPasswordFile != "" {
+		return fmt.Errorf("at most one of priv_password and priv_password_file must be set")
+	}
 	if c.Version < 1 || c.Version > 3 {
 		return fmt.Errorf("SNMP version must be 1, 2 or 3. Got: %d", c.Version)
 	}
 	if c.Version == 3 {
 		switch c.SecurityLevel {
 		case "authPriv":
-			if c.PrivPassword == "" {
+			if c.PrivPassword == "" && c.PrivPasswordFile == "" && c.PrivPasswordRef == nil {
 				return fmt.Errorf("priv password is missing, required for SNMPv3 with priv")
 			}
 			if c.PrivProtocol != "DES" && c.PrivProtocol != "AES" && c.PrivProtocol != "AES192" && c.PrivProtocol != "AES192C" && c.PrivProtocol != "AES256" && c.PrivProtocol != "AES256C" {
@@ -340,7 +616,7 @@ func (c *Auth) UnmarshalYAML(unmarshal func(any) error) error {
 			}
 			fallthrough
 		case "authNoPriv":
-			if c.Password == "" {
+			if c.Password == "" && c.PasswordFile == "" && c.PasswordRef == nil {
 				return fmt.Errorf("auth password is missing, required for SNMPv3 with auth")
 			}
 			if c.AuthProtocol != "MD5" && c.AuthProtocol != "SHA" && c.AuthProtocol != "SHA224" && c.AuthProtocol != "SHA256" && c.AuthProtocol != "SHA384" && c.AuthProtocol != "SHA512" {
@@ -358,6 +634,82 @@ func (c *Auth) UnmarshalYAML(unmarshal func(any) error) error {
 	return nil
 }
 
+// secretRefs returns the secrets of the auth that may refer to a secret
+// provider, by key.
+func (c *Auth) secretRefs() []struct {
+	key    string
+	secret *Secret
+	ref    **SecretRef
+} {
+	return []struct {
+		key    string
+		secret *Secret
+		ref    **SecretRef
+	}{
+		{"community", &c.Community, &c.CommunityRef},
+		{"password", &c.Password, &c.PasswordRef},
+		{"priv_password", &c.PrivPassword, &c.PrivPasswordRef},
+	}
+}
+
+// unmarshalSecretRefs reads the secrets given by reference to a secret
+// provider. It returns the rest of the auth, to be unmarshaled without them,
+// or nil if there are none.
+func (c *Auth) unmarshalSecretRefs(unmarshal func(any) error) ([]byte, error) {
+	var fields yaml.MapSlice
+	if err := unmarshal(&fields); err != nil {
+		return nil, err
+	}
+	found := false
+	for _, s := range c.secretRefs() {
+		i := slices.IndexFunc(fields, func(f yaml.MapItem) bool { return f.Key == s.key })
+		if i < 0 {
+			continue
+		}
+		if _, ok := fields[i].Value.(yaml.MapSlice); !ok {
+			continue
+		}
+		out, err := yaml.Marshal(fields[i].Value)
+		if err != nil {
+			return nil, err
+		}
+		ref := &SecretRef{}
+		if err := yaml.UnmarshalStrict(out, ref); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.key, err)
+		}
+		*s.ref = ref
+		fields = slices.Delete(fields, i, i+1)
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	return yaml.Marshal(fields)
+}
+
+// MarshalYAML implements the yaml.Marshaler interface. Secrets given by
+// reference to a secret provider are marshaled as their reference.
+func (c Auth) MarshalYAML() (any, error) {
+	type plain Auth
+	if c.CommunityRef == nil && c.PasswordRef == nil && c.PrivPasswordRef == nil {
+		return plain(c), nil
+	}
+	out, err := yaml.Marshal(plain(c))
+	if err != nil {
+		return nil, err
+	}
+	var fields yaml.MapSlice
+	if err := yaml.Unmarshal(out, &fields); err != nil {
+		return nil, err
+	}
+	for _, s := range c.secretRefs() {
+		if *s.ref != nil {
+			fields = append(fields, yaml.MapItem{Key: s.key, Value: *s.ref})
+		}
+	}
+	return fields, nil
+}
+
 type RegexpExtract struct {
 	Value string `yaml:"value"`
 	Regex Regexp `yaml:"regex"`
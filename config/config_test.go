@@ -14,8 +14,12 @@
 package config
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"go.yaml.in/yaml/v2"
 )
@@ -80,3 +84,330 @@ modules:
 		t.Error("BUG: module1 and module2 share the same Retries pointer!")
 	}
 }
+
+func TestValidateTargets(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name: "valid",
+			content: `
+auths:
+  private_v2: {community: private, version: 2}
+modules:
+  if_mib: {}
+targets:
+  core:
+    targets: [switch1, switch2]
+    auth: private_v2
+    modules: [if_mib]
+`,
+		},
+		{
+			name: "unknown auth",
+			content: `
+targets:
+  core:
+    targets: [switch1]
+    auth: nope
+`,
+			err: `target group "core" uses unknown auth "nope"`,
+		},
+		{
+			name: "unknown module",
+			content: `
+targets:
+  core:
+    targets: [switch1]
+    modules: [nope]
+`,
+			err: `target group "core" uses unknown module "nope"`,
+		},
+		{
+			name: "no targets",
+			content: `
+targets:
+  core: {}
+`,
+			err: `target group "core" has no targets`,
+		},
+		{
+			name: "duplicate target",
+			content: `
+targets:
+  a:
+    targets: [switch1]
+  b:
+    targets: [switch1]
+`,
+			err: `target "switch1" is in both target groups`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &Config{}
+			if err := yaml.UnmarshalStrict([]byte(c.content), cfg); err != nil {
+				t.Fatalf("Error unmarshaling content: %v", err)
+			}
+			err := cfg.validateTargets()
+			if c.err == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if g := cfg.TargetGroup("switch2"); g == nil || g.Auth != "private_v2" {
+					t.Errorf("Unexpected target group for switch2: %+v", g)
+				}
+				if g := cfg.TargetGroup("switch3"); g != nil {
+					t.Errorf("Expected no target group for switch3, got %+v", g)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("Expected error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	content := `
+auths:
+  private_v2: {community: private, version: 2}
+modules:
+  if_mib: {}
+profiles:
+  slow_firewall:
+    auth: private_v2
+    modules: [if_mib]
+    source_address: 10.0.0.1
+    timeout: 20s
+    max_repetitions: 5
+`
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(content), cfg); err != nil {
+		t.Fatalf("Error unmarshaling content: %v", err)
+	}
+	if err := cfg.validateProfiles(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	module := cfg.Modules["if_mib"]
+	m := cfg.Profiles["slow_firewall"].WalkParams.Apply(module)
+	if m.WalkParams.Timeout != 20*time.Second || m.WalkParams.MaxRepetitions != 5 || *m.WalkParams.Retries != 3 {
+		t.Errorf("Unexpected walk params after overrides: %+v", m.WalkParams)
+	}
+	if module.WalkParams.Timeout != 5*time.Second || module.WalkParams.MaxRepetitions != 25 {
+		t.Errorf("Overrides modified the module: %+v", module.WalkParams)
+	}
+
+	cfg.Profiles["broken"] = &Profile{Modules: []string{"nope"}}
+	if err := cfg.validateProfiles(); err == nil || !strings.Contains(err.Error(), `profile "broken" uses unknown module "nope"`) {
+		t.Errorf("Expected unknown module error, got %v", err)
+	}
+}
+
+func TestTrapDefinitions(t *testing.T) {
+	content := `
+trap_definitions:
+  linkDown:
+    oid: 1.3.6.1.6.3.1.1.5.3
+    help: A linkDown trap signifies that the SNMP entity has detected that the ifOperStatus object has left the up state
+    objects:
+      - {name: ifIndex, oid: 1.3.6.1.2.1.2.2.1.1}
+`
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(content), cfg); err != nil {
+		t.Fatalf("Error unmarshaling content: %v", err)
+	}
+	if err := cfg.validateTrapDefinitions(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	name, def := cfg.TrapDefinition("1.3.6.1.6.3.1.1.5.3")
+	if name != "linkDown" || def == nil || len(def.Objects) != 1 {
+		t.Errorf("Unexpected definition %q: %+v", name, def)
+	}
+	if name, def := cfg.TrapDefinition("1.3.6.1.6.3.1.1.5.4"); name != "" || def != nil {
+		t.Errorf("Expected no definition, got %q: %+v", name, def)
+	}
+
+	cfg.TrapDefinitions["ifDown"] = &TrapDefinition{Oid: "1.3.6.1.6.3.1.1.5.3"}
+	if err := cfg.validateTrapDefinitions(); err == nil || !strings.Contains(err.Error(), "have the same oid") {
+		t.Errorf("Expected a duplicate oid error, got %v", err)
+	}
+}
+
+func TestAuthChains(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name: "valid",
+			content: `
+auths:
+  v3_sha: {version: 3, username: user}
+  public_v2: {version: 2}
+auth_chains:
+  migrating:
+    auths: [v3_sha, public_v2]
+targets:
+  core:
+    targets: [switch1]
+    auth: migrating
+`,
+		},
+		{
+			name: "unknown auth",
+			content: `
+auth_chains:
+  migrating:
+    auths: [nope]
+`,
+			err: `auth chain "migrating" uses unknown auth "nope"`,
+		},
+		{
+			name: "empty",
+			content: `
+auth_chains:
+  migrating: {auths: []}
+`,
+			err: `auth chain "migrating" has no auths`,
+		},
+		{
+			name: "name clash",
+			content: `
+auths:
+  public_v2: {version: 2}
+auth_chains:
+  public_v2:
+    auths: [public_v2]
+`,
+			err: `auth chain "public_v2" has the same name as an auth`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &Config{}
+			if err := yaml.UnmarshalStrict([]byte(c.content), cfg); err != nil {
+				t.Fatalf("Error unmarshaling content: %v", err)
+			}
+			err := cfg.validateAuthChains()
+			if err == nil {
+				err = cfg.validateTargets()
+			}
+			if c.err == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("Expected error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestRefreshIntervals(t *testing.T) {
+	content := `
+modules:
+  if_mib:
+    walk: [1.3.6.1.2.1.2, 1.3.6.1.2.1.31.1.1.1.1]
+    filters:
+      - oid: 1.3.6.1.2.1.2.2.1.7
+        targets: [1.3.6.1.2.1.2.2.1.10]
+        values: ["1"]
+    refresh_intervals:
+      1.3.6.1.2.1.31.1.1.1.1: 1h
+      1.3.6.1.2.1.2.2.1.7: 10m
+`
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(content), cfg); err != nil {
+		t.Fatalf("Error unmarshaling content: %v", err)
+	}
+	if got := cfg.Modules["if_mib"].RefreshIntervals["1.3.6.1.2.1.31.1.1.1.1"]; got != time.Hour {
+		t.Errorf("Expected a refresh interval of 1h, got %s", got)
+	}
+
+	// Only subtrees that are walked on their own can be refreshed.
+	content = `
+modules:
+  if_mib:
+    walk: [1.3.6.1.2.1.31.1.1]
+    refresh_intervals:
+      1.3.6.1.2.1.31.1.1.1.1: 1h
+`
+	err := yaml.UnmarshalStrict([]byte(content), &Config{})
+	if err == nil || !strings.Contains(err.Error(), "not a subtree walked by the module") {
+		t.Fatalf("Expected an error for a subtree that is not walked, got %v", err)
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("mysecret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	content := `
+auths:
+  v3:
+    version: 3
+    username: user
+    security_level: authNoPriv
+    password_file: ` + passwordFile + `
+  v2:
+    community_file: ` + filepath.Join(dir, "community") + `
+`
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(content), cfg); err != nil {
+		t.Fatalf("Error unmarshaling content: %v", err)
+	}
+	if cfg.Auths["v2"].Community != "" {
+		t.Errorf("Expected no default community with a community file, got %q", cfg.Auths["v2"].Community)
+	}
+
+	auth, err := cfg.Auths["v3"].LoadSecrets(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if auth.Password != "mysecret" || cfg.Auths["v3"].Password != "" {
+		t.Errorf("Expected the password to be read into a copy of the auth, got %q and %q", auth.Password, cfg.Auths["v3"].Password)
+	}
+
+	// Rotated secrets are read again.
+	if err := os.WriteFile(passwordFile, []byte("rotated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if auth, err = cfg.Auths["v3"].LoadSecrets(context.Background()); err != nil || auth.Password != "rotated" {
+		t.Errorf("Expected the rotated password, got %q %v", auth.Password, err)
+	}
+
+	if _, err := cfg.Auths["v2"].LoadSecrets(context.Background()); err == nil {
+		t.Error("Expected an error for a missing secret file")
+	}
+
+	// Only the paths of the files are shown.
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "mysecret") || strings.Contains(string(out), "rotated") || !strings.Contains(string(out), passwordFile) {
+		t.Errorf("Expected the secret files but not the secrets in the configuration, got %s", out)
+	}
+}
+
+func TestSecretFilesExclusive(t *testing.T) {
+	for _, content := range []string{
+		"community: private\ncommunity_file: /run/secrets/community",
+		"version: 3\nusername: user\nsecurity_level: authNoPriv\npassword: pass\npassword_file: /run/secrets/password",
+	} {
+		var auth Auth
+		if err := yaml.UnmarshalStrict([]byte(content), &auth); err == nil || !strings.Contains(err.Error(), "at most one of") {
+			t.Errorf("Expected an error for %q, got %v", content, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultSecretTTL   = 5 * time.Minute
+	secretFetchTimeout = 10 * time.Second
+	// The largest secret read from a provider.
+	maxSecretSize = 64 << 10
+)
+
+// SecretProvider fetches the secrets that the configuration refers to, such
+// as from a secrets manager.
+type SecretProvider interface {
+	// Validate checks a reference to the provider when the configuration is
+	// loaded.
+	Validate(ref *SecretRef) error
+	// Fetch returns the secret a reference refers to. Errors must not
+	// include the secret.
+	Fetch(ctx context.Context, ref *SecretRef) (string, error)
+}
+
+var secretProviders = map[string]SecretProvider{
+	"exec": execProvider{},
+	"http": httpProvider{client: &http.Client{}},
+}
+
+// RegisterSecretProvider makes a secret provider available under name. It
+// must be called before the configuration is loaded.
+func RegisterSecretProvider(name string, p SecretProvider) {
+	secretProviders[name] = p
+}
+
+// SecretRef refers to a secret held by a secret provider, in place of the
+// secret itself.
+type SecretRef struct {
+	Provider string `yaml:"provider"`
+	// The command to run and its arguments, for the exec provider.
+	Args []string `yaml:"args,omitempty"`
+	// The URL to fetch the secret from, for the http provider.
+	URL             string `yaml:"url,omitempty"`
+	BearerToken     Secret `yaml:"bearer_token,omitempty"`
+	BearerTokenFile string `yaml:"bearer_token_file,omitempty"`
+	// How long the secret is used before it is fetched again.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+}
+
+func (r *SecretRef) UnmarshalYAML(unmarshal func(any) error) error {
+	type plain SecretRef
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	p, ok := secretProviders[r.Provider]
+	if !ok {
+		return fmt.Errorf("unknown secret provider %q", r.Provider)
+	}
+	if r.TTL < 0 {
+		return fmt.Errorf("ttl of secret provider %q must be positive", r.Provider)
+	}
+	if r.TTL == 0 {
+		r.TTL = defaultSecretTTL
+	}
+	return p.Validate(r)
+}
+
+// key identifies the secret a reference refers to, whatever its TTL.
+func (r *SecretRef) key() string {
+	return strings.Join(append([]string{r.Provider, r.URL, string(r.BearerToken), r.BearerTokenFile}, r.Args...), "\x00")
+}
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+	// Whether the secret is being refreshed in the background.
+	refreshing bool
+}
+
+// secretCache keeps the secrets fetched from providers for their TTL. Once
+// half of the TTL has passed, the next use of a secret refreshes it in the
+// background, so that secrets in use are rarely fetched on the scrape path.
+type secretCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedSecret
+	flights singleflight.Group
+}
+
+var providedSecrets = newSecretCache()
+
+func newSecretCache() *secretCache {
+	return &secretCache{entries: make(map[string]*cachedSecret)}
+}
+
+// get returns the secret a reference refers to, fetching it if it is not
+// cached. A fetch is shared by the concurrent gets of the secret, and is not
+// cancelled along with ctx, so that it is cached for later gets even if the
+// one that started it stops waiting once ctx is done.
+func (c *secretCache) get(ctx context.Context, ref *SecretRef, now time.Time) (string, error) {
+	key := ref.key()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && now.Sub(e.fetched) < ref.TTL {
+		if now.Sub(e.fetched) >= ref.TTL/2 && !e.refreshing {
+			e.refreshing = true
+			go c.refresh(key, ref)
+		}
+		c.mu.Unlock()
+		return e.value, nil
+	}
+	c.mu.Unlock()
+	flight := c.flights.DoChan(key, func() (any, error) {
+		return c.fetch(key, ref)
+	})
+	select {
+	case r := <-flight:
+		if r.Err != nil {
+			return "", r.Err
+		}
+		return r.Val.(string), nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("error fetching secret from provider %q: %w", ref.Provider, ctx.Err())
+	}
+}
+
+// refresh fetches a secret again. On failure the cached secret is kept until
+// it expires, and fetched again on its next use.
+func (c *secretCache) refresh(key string, ref *SecretRef) {
+	_, err, _ := c.flights.Do(key, func() (any, error) {
+		return c.fetch(key, ref)
+	})
+	if err != nil {
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok {
+			e.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *secretCache) fetch(key string, ref *SecretRef) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	defer cancel()
+	value, err := secretProviders[ref.Provider].Fetch(ctx, ref)
+	if err == nil && value == "" {
+		err = errors.New("empty secret")
+	}
+	if err != nil {
+		return "", fmt.Errorf("error fetching secret from provider %q: %w", ref.Provider, err)
+	}
+	c.mu.Lock()
+	c.entries[key] = &cachedSecret{value: value, fetched: time.Now()}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// execProvider runs a command and uses its output as the secret.
+type execProvider struct{}
+
+func (execProvider) Validate(ref *SecretRef) error {
+	if len(ref.Args) == 0 {
+		return errors.New("args of the exec secret provider must not be empty")
+	}
+	return nil
+}
+
+func (execProvider) Fetch(ctx context.Context, ref *SecretRef) (string, error) {
+	// The output of the command, and what it writes to stderr, may hold the
+	// secret so is left out of errors.
+	out, err := exec.CommandContext(ctx, ref.Args[0], ref.Args[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("error running %s: %w", ref.Args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// httpProvider fetches the secret from a URL, with an optional bearer token.
+// The body of the response is used as the secret.
+type httpProvider struct {
+	client *http.Client
+}
+
+func (httpProvider) Validate(ref *SecretRef) error {
+	if ref.URL == "" {
+		return errors.New("url of the http secret provider must not be empty")
+	}
+	if ref.BearerToken != "" && ref.BearerTokenFile != "" {
+		return errors.New("at most one of bearer_token and bearer_token_file must be set")
+	}
+	return nil
+}
+
+func (p httpProvider) Fetch(ctx context.Context, ref *SecretRef) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref.URL, http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	token := string(ref.BearerToken)
+	if ref.BearerTokenFile != "" {
+		if token, err = secretFiles.read(ref.BearerTokenFile); err != nil {
+			return "", err
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSecretSize))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
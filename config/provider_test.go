@@ -0,0 +1,202 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// secretServer serves the secret it holds to requests with the bearer token
+// "token", and sends on fetched after each request.
+func secretServer(t *testing.T, secret *atomic.Value, fetched chan struct{}) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { fetched <- struct{}{} }()
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "forbidden: mysecret", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintln(w, secret.Load())
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestHTTPSecretProvider(t *testing.T) {
+	var secret atomic.Value
+	secret.Store("mysecret")
+	fetched := make(chan struct{}, 10)
+	server := secretServer(t, &secret, fetched)
+
+	content := `
+auths:
+  v3:
+    version: 3
+    username: user
+    security_level: authNoPriv
+    password:
+      provider: http
+      url: ` + server.URL + `/password
+      bearer_token: token
+      ttl: 1m
+`
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(content), cfg); err != nil {
+		t.Fatalf("Error unmarshaling content: %v", err)
+	}
+	auth, err := cfg.Auths["v3"].LoadSecrets(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if auth.Password != "mysecret" || cfg.Auths["v3"].Password != "" {
+		t.Errorf("Expected the password to be fetched into a copy of the auth, got %q", string(auth.Password))
+	}
+
+	// Neither the secret nor the bearer token are shown, the reference is.
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "mysecret") || strings.Contains(string(out), "token: token") || !strings.Contains(string(out), "provider: http") {
+		t.Errorf("Expected the secret reference without secrets in the configuration, got %s", out)
+	}
+	if s := fmt.Sprintf("%v", auth); strings.Contains(s, "mysecret") {
+		t.Errorf("Expected the secret to be hidden when formatted, got %s", s)
+	}
+
+	// Errors do not include what the provider returned.
+	ref := *cfg.Auths["v3"].PasswordRef
+	ref.BearerToken = "wrong"
+	if _, err := newSecretCache().get(context.Background(), &ref, time.Now()); err == nil || strings.Contains(err.Error(), "mysecret") {
+		t.Errorf("Expected an error without the response, got %v", err)
+	}
+}
+
+func TestSecretCache(t *testing.T) {
+	var secret atomic.Value
+	secret.Store("first")
+	fetched := make(chan struct{}, 10)
+	server := secretServer(t, &secret, fetched)
+	ref := &SecretRef{Provider: "http", URL: server.URL, BearerToken: "token", TTL: time.Minute}
+	cache := newSecretCache()
+	now := time.Now()
+
+	if v, err := cache.get(context.Background(), ref, now); err != nil || v != "first" {
+		t.Fatalf("Expected the secret to be fetched, got %q %v", v, err)
+	}
+	<-fetched
+	secret.Store("second")
+	if v, err := cache.get(context.Background(), ref, now.Add(10*time.Second)); err != nil || v != "first" {
+		t.Errorf("Expected the cached secret, got %q %v", v, err)
+	}
+
+	// Past half of the TTL the cached secret is used while it is refreshed.
+	if v, err := cache.get(context.Background(), ref, now.Add(40*time.Second)); err != nil || v != "first" {
+		t.Errorf("Expected the cached secret during the refresh, got %q %v", v, err)
+	}
+	select {
+	case <-fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the secret to be refreshed in the background")
+	}
+	// The refresh is stored right after the response is read.
+	for i := 0; ; i++ {
+		if v, _ := cache.get(context.Background(), ref, time.Now()); v == "second" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Expected the refreshed secret")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(fetched) != 0 {
+		t.Errorf("Expected a single refresh, got %d more fetches", len(fetched))
+	}
+}
+
+func TestSecretCacheContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintln(w, "mysecret")
+	}))
+	t.Cleanup(server.Close)
+	unblock := sync.OnceFunc(func() { close(release) })
+	t.Cleanup(unblock)
+	ref := &SecretRef{Provider: "http", URL: server.URL, TTL: time.Minute}
+	cache := newSecretCache()
+
+	// A slow fetch is only waited for until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cache.get(ctx, ref, time.Now()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+	// The fetch goes on, and is cached for the next get.
+	unblock()
+	for i := 0; ; i++ {
+		if v, _ := cache.get(context.Background(), ref, time.Now()); v == "mysecret" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Expected the fetched secret")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExecSecretProvider(t *testing.T) {
+	if _, err := exec.LookPath("echo"); err != nil {
+		t.Skip("echo is not available")
+	}
+	var auth Auth
+	if err := yaml.UnmarshalStrict([]byte("community: {provider: exec, args: [echo, mysecret]}"), &auth); err != nil {
+		t.Fatalf("Error unmarshaling content: %v", err)
+	}
+	if auth.Community != "" {
+		t.Errorf("Expected no default community with a secret provider, got %q", string(auth.Community))
+	}
+	loaded, err := auth.LoadSecrets(context.Background())
+	if err != nil || loaded.Community != "mysecret" {
+		t.Errorf("Expected the output of the command as the community, got %q %v", string(loaded.Community), err)
+	}
+}
+
+func TestSecretRefValidation(t *testing.T) {
+	for content, expected := range map[string]string{
+		"community: {provider: vault}":                                 `unknown secret provider "vault"`,
+		"community: {provider: exec}":                                  "args of the exec secret provider must not be empty",
+		"community: {provider: http}":                                  "url of the http secret provider must not be empty",
+		"community: {provider: exec, args: [cat], unknown: 1}":         "field unknown not found",
+		"community: {provider: exec, args: [cat]}\ncommunity_file: /x": "at most one of community and community_file",
+		// Only the secrets of an auth may refer to a secret provider.
+		"community: {provider: http, url: x, bearer_token: {provider: exec, args: [cat]}}": "cannot unmarshal !!map into config.Secret",
+	} {
+		var auth Auth
+		if err := yaml.UnmarshalStrict([]byte(content), &auth); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error containing %q for %q, got %v", expected, content, err)
+		}
+	}
+}
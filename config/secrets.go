@@ -0,0 +1,105 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HasExternalSecrets reports whether any secret of the auth is read from a
+// file or a secret provider.
+func (c Auth) HasExternalSecrets() bool {
+	return c.CommunityFile != "" || c.PasswordFile != "" || c.PrivPasswordFile != "" ||
+		c.CommunityRef != nil || c.PasswordRef != nil || c.PrivPasswordRef != nil
+}
+
+// LoadSecrets returns a copy of the auth with the secrets that are read from
+// files or secret providers filled in. Files are only read again once they
+// change, and secrets from providers once their TTL expires, so that rotated
+// secrets are picked up without reloading the configuration. Secrets are
+// waited for until ctx is done.
+func (c Auth) LoadSecrets(ctx context.Context) (Auth, error) {
+	for _, s := range c.secretRefs() {
+		if *s.ref == nil {
+			continue
+		}
+		value, err := providedSecrets.get(ctx, *s.ref, time.Now())
+		if err != nil {
+			return c, err
+		}
+		s.secret.Set(value)
+	}
+	for _, s := range []struct {
+		file   string
+		secret *Secret
+	}{
+		{c.CommunityFile, &c.Community},
+		{c.PasswordFile, &c.Password},
+		{c.PrivPasswordFile, &c.PrivPassword},
+	} {
+		if s.file == "" {
+			continue
+		}
+		value, err := secretFiles.read(s.file)
+		if err != nil {
+			return c, err
+		}
+		s.secret.Set(value)
+	}
+	return c, nil
+}
+
+type secretFile struct {
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+// secretFileCache keeps the content of secret files by path, along with the
+// modification time and size they had when they were read.
+type secretFileCache struct {
+	mu    sync.Mutex
+	files map[string]secretFile
+}
+
+var secretFiles = &secretFileCache{files: make(map[string]secretFile)}
+
+func (c *secretFileCache) read(path string) (string, error) {
+	// Stat follows symlinks, so secrets mounted by Kubernetes, which are
+	// swapped by replacing a symlink, are read again too.
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.files[path]; ok && f.modTime.Equal(info.ModTime()) && f.size == info.Size() {
+		return f.value, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file: %w", err)
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	c.files[path] = secretFile{modTime: info.ModTime(), size: info.Size(), value: value}
+	return value, nil
+}
@@ -14,13 +14,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/promslog"
 	"go.yaml.in/yaml/v2"
 
@@ -63,6 +69,17 @@ func TestLoadConfigWithOverrides(t *testing.T) {
 	}
 }
 
+func TestLoadConfigInvalidFilter(t *testing.T) {
+	sc := &SafeConfig{}
+	err := sc.ReloadConfig(nopLogger, []string{"testdata/snmp-invalid-filter.yml"}, false)
+	if err == nil || !strings.Contains(err.Error(), `invalid value "(up"`) {
+		t.Errorf("Expected an invalid filter value to fail the load, got %v", err)
+	}
+	if sc.C != nil {
+		t.Error("Expected the config not to be replaced")
+	}
+}
+
 func TestLoadMultipleConfigs(t *testing.T) {
 	sc := &SafeConfig{}
 	configs := []string{"testdata/snmp-auth.yml", "testdata/snmp-with-overrides.yml"}
@@ -234,3 +251,196 @@ func TestHandlerRejectsEmptyModuleParameter(t *testing.T) {
 		t.Fatalf("unexpected response body: %q", resp.Body.String())
 	}
 }
+
+func TestScrapeContext(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/snmp?target=127.0.0.1", http.NoBody)
+	ctx, cancel, err := scrapeContext(req, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("Expected no deadline without the scrape timeout header")
+	}
+
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10")
+	ctx, cancel, err = scrapeContext(req, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("Expected a deadline from the scrape timeout header")
+	}
+	if budget := time.Until(deadline); budget > 9500*time.Millisecond || budget < 9*time.Second {
+		t.Errorf("Expected a budget of about 9.5s, got %s", budget)
+	}
+
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "soon")
+	if _, _, err := scrapeContext(req, 500*time.Millisecond); err == nil {
+		t.Error("Expected an error for an invalid scrape timeout header")
+	}
+}
+
+func TestTargetInventory(t *testing.T) {
+	sc = batchTestConfig()
+	sc.C.Targets = map[string]*config.TargetGroup{
+		"core": {
+			Targets:     []string{"10.0.0.1", "10.0.0.2"},
+			Auth:        "private_v2",
+			Modules:     []string{"if_mib", "system"},
+			SNMPContext: "vrf-mgmt",
+			Labels:      map[string]string{"site": "ams1"},
+		},
+		"access": {
+			Targets: []string{"10.0.1.1"},
+		},
+	}
+
+	// Parameters missing from the query are taken from the inventory.
+	req, err := parseScrapeRequest(url.Values{"target": {"10.0.0.2"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if req.authName != "private_v2" || req.snmpContext != "vrf-mgmt" || len(req.modules) != 2 {
+		t.Errorf("Expected inventory defaults, got %+v", req)
+	}
+	req, err = parseScrapeRequest(url.Values{"target": {"10.0.0.2"}, "auth": {"public_v2"}, "module": {"system"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if req.authName != "public_v2" || len(req.modules) != 1 {
+		t.Errorf("Expected query parameters to take precedence, got %+v", req)
+	}
+
+	// The inventory is served as Prometheus HTTP service discovery.
+	resp := httptest.NewRecorder()
+	sdHandler(resp, httptest.NewRequest(http.MethodGet, sdPath, http.NoBody), nopLogger)
+	if ct := resp.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON, got content type %q", ct)
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	want := []map[string]any{
+		{
+			"targets": []any{"10.0.1.1"},
+			"labels":  map[string]any{"__meta_snmp_target_group": "access"},
+		},
+		{
+			"targets": []any{"10.0.0.1", "10.0.0.2"},
+			"labels": map[string]any{
+				"__meta_snmp_target_group": "core",
+				"__param_auth":             "private_v2",
+				"__param_module":           "if_mib,system",
+				"__param_snmp_context":     "vrf-mgmt",
+				"site":                     "ams1",
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected target groups:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	sc = batchTestConfig()
+	timeout := 30 * time.Second
+	sc.C.Profiles = map[string]*config.Profile{
+		"slow_firewall": {
+			Auth:          "private_v2",
+			Modules:       []string{"if_mib", "system"},
+			SNMPContext:   "vrf-mgmt",
+			SourceAddress: "10.0.0.1",
+			WalkParams:    config.WalkParamsOverrides{Timeout: &timeout},
+		},
+	}
+
+	req, err := parseScrapeRequest(url.Values{"target": {"10.0.0.2"}, "profile": {"slow_firewall"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if req.authName != "private_v2" || req.snmpContext != "vrf-mgmt" || req.sourceAddress != "10.0.0.1" || len(req.modules) != 2 {
+		t.Errorf("Expected profile settings, got %+v", req)
+	}
+	for _, m := range req.modules {
+		if m.WalkParams.Timeout != timeout {
+			t.Errorf("Expected timeout override of %s, got %s", timeout, m.WalkParams.Timeout)
+		}
+	}
+	if sc.C.Modules["system"].WalkParams.Timeout == timeout {
+		t.Error("Profile overrides modified the configured module")
+	}
+
+	req, err = parseScrapeRequest(url.Values{"target": {"10.0.0.2"}, "profile": {"slow_firewall"}, "module": {"system"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(req.modules) != 1 || req.modules[0].WalkParams.Timeout != timeout {
+		t.Errorf("Expected the module parameter to take precedence, got %+v", req.modules)
+	}
+
+	if _, err := parseScrapeRequest(url.Values{"target": {"10.0.0.2"}, "profile": {"nope"}}); err == nil {
+		t.Error("Expected an error for an unknown profile")
+	}
+}
+
+func TestSubtreeTelemetryParam(t *testing.T) {
+	sc = batchTestConfig()
+	req, err := parseScrapeRequest(url.Values{"target": {"10.0.0.2"}, "module": {"system"}, "subtree_telemetry": {"true"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !req.modules[0].WalkParams.SubtreeTelemetry {
+		t.Error("Expected subtree telemetry to be enabled")
+	}
+	if sc.C.Modules["system"].WalkParams.SubtreeTelemetry {
+		t.Error("Expected the configured module to be left as is")
+	}
+}
+
+func TestSecretFileAuth(t *testing.T) {
+	communityFile := filepath.Join(t.TempDir(), "community")
+	if err := os.WriteFile(communityFile, []byte("mysecret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sc = batchTestConfig()
+	sc.C.Auths["file_v2"] = &config.Auth{CommunityFile: communityFile, SecurityLevel: "noAuthNoPriv", Version: 2}
+	req, err := parseScrapeRequest(url.Values{"target": {"10.0.0.2"}, "auth": {"file_v2"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if req.auth.Community != "" {
+		t.Errorf("Expected the community to be read once the configuration is no longer locked, got %q", req.auth.Community)
+	}
+	if err := req.loadSecrets(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if req.auth.Community != "mysecret" || sc.C.Auths["file_v2"].Community != "" {
+		t.Errorf("Expected the community to be read for the request only, got %q", req.auth.Community)
+	}
+
+	if err := os.Remove(communityFile); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(authSecretLoadErrors.WithLabelValues("file_v2"))
+	if req, err = parseScrapeRequest(url.Values{"target": {"10.0.0.2"}, "auth": {"file_v2"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := req.loadSecrets(context.Background()); err == nil {
+		t.Fatal("Expected an error for the missing secret file")
+	}
+	if got := testutil.ToFloat64(authSecretLoadErrors.WithLabelValues("file_v2")); got != before+1 {
+		t.Errorf("Expected the secret load error to be counted, got %v", got)
+	}
+
+	// Secrets that can't be loaded are a failure of the exporter, not of the
+	// request.
+	resp := httptest.NewRecorder()
+	handler(resp, httptest.NewRequest(http.MethodGet, "/snmp?target=10.0.0.2&auth=file_v2", http.NoBody), nopLogger, collector.Metrics{})
+	if resp.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
+	}
+}
@@ -16,6 +16,7 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/prometheus/snmp_exporter/config"
 )
@@ -24,7 +25,9 @@ import (
 type Config struct {
 	Auths   map[string]*config.Auth  `yaml:"auths"`
 	Modules map[string]*ModuleConfig `yaml:"modules"`
-	Version int                      `yaml:"version,omitempty"`
+	// Subtrees to extract trap definitions from.
+	Traps   []string `yaml:"traps,omitempty"`
+	Version int      `yaml:"version,omitempty"`
 }
 
 type MetricOverrides struct {
@@ -60,6 +63,8 @@ type ModuleConfig struct {
 	WalkParams config.WalkParams          `yaml:",inline"`
 	Overrides  map[string]MetricOverrides `yaml:"overrides"`
 	Filters    config.Filters             `yaml:"filters,omitempty"`
+	// Subtrees of walk or dynamic filters to walk less often, by name or OID.
+	RefreshIntervals map[string]time.Duration `yaml:"refresh_intervals,omitempty"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -72,6 +72,10 @@ func generateConfig(nodes *Node, nameToNode map[string]*Node, logger *slog.Logge
 		outputConfig.Modules[name].WalkParams = m.WalkParams
 		logger.Info("Generated metrics", "module", name, "metrics", len(outputConfig.Modules[name].Metrics))
 	}
+	outputConfig.TrapDefinitions, err = generateTrapDefinitions(cfg.Traps, nameToNode, logger)
+	if err != nil {
+		return err
+	}
 
 	config.DoNotHideSecrets = true
 	out, err := yaml.Marshal(outputConfig)
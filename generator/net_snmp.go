@@ -98,6 +98,9 @@ type Node struct {
 
 	Indexes      []string
 	ImpliedIndex bool
+
+	// The objects of a notification.
+	Objects []string
 }
 
 // Copy returns a deep copy of the tree underneath the current Node.
@@ -107,6 +110,8 @@ func (n *Node) Copy() *Node {
 	newNode.EnumValues = make(map[int]string, len(n.EnumValues))
 	newNode.Indexes = make([]string, len(n.Indexes))
 	copy(newNode.Indexes, n.Indexes)
+	newNode.Objects = make([]string, len(n.Objects))
+	copy(newNode.Objects, n.Objects)
 	// Deep copy children and enums.
 	for _, child := range n.Children {
 		newNode.Children = append(newNode.Children, child.Copy())
@@ -258,6 +263,12 @@ func buildMIBTree(t *C.struct_tree, n *Node, oid string) {
 		enum = enum.next
 	}
 
+	vb := t.varbinds
+	for vb != nil {
+		n.Objects = append(n.Objects, C.GoString(vb.vblabel))
+		vb = vb.next
+	}
+
 	if t.child_list == nil {
 		return
 	}
@@ -21,6 +21,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/snmp_exporter/config"
 )
@@ -629,11 +630,104 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 			out.Walk = append(out.Walk, k)
 		}
 	}
+
+	// Subtrees with a refresh interval are cached as a whole, so they must be
+	// walked on their own, out of the walk that encloses them if any.
+	for name, interval := range cfg.RefreshIntervals {
+		oid := name
+		if n, ok := nameToNode[name]; ok {
+			oid = n.Oid
+		}
+		filtered := slices.ContainsFunc(out.Filters, func(f config.DynamicFilter) bool { return f.Oid == oid })
+		if !filtered {
+			out.Walk = splitWalk(out.Walk, oid, nameToNode)
+		}
+		if !filtered && !slices.Contains(out.Walk, oid) {
+			return nil, fmt.Errorf("cannot refresh '%s' on its own, as it is not a subtree walked by the module", name)
+		}
+		if out.RefreshIntervals == nil {
+			out.RefreshIntervals = make(map[string]time.Duration, len(cfg.RefreshIntervals))
+		}
+		out.RefreshIntervals[oid] = interval
+	}
 	return out, nil
 }
 
+// splitWalk replaces the walk enclosing oid, if any, with walks of oid and of
+// the subtrees next to it on the way down from the enclosing walk, which
+// together walk the same MIB objects. The walks are left as they are if a
+// node on the way is not in the MIB.
+func splitWalk(walks []string, oid string, nameToNode map[string]*Node) []string {
+	i := slices.IndexFunc(walks, func(walk string) bool {
+		return strings.HasPrefix(oid, walk+".")
+	})
+	if i < 0 {
+		return walks
+	}
+	node, ok := nameToNode[walks[i]]
+	if !ok {
+		return walks
+	}
+	split := []string{oid}
+	for node.Oid != oid {
+		var next *Node
+		for _, child := range node.Children {
+			if strings.HasPrefix(oid+".", child.Oid+".") {
+				next = child
+			} else {
+				split = append(split, child.Oid)
+			}
+		}
+		if next == nil {
+			return walks
+		}
+		node = next
+	}
+	walks = append(slices.Delete(slices.Clone(walks), i, i+1), split...)
+	sort.Strings(walks)
+	return walks
+}
+
 var invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 
 func sanitizeLabelName(name string) string {
 	return invalidLabelCharRE.ReplaceAllString(name, "_")
 }
+
+// generateTrapDefinitions extracts the notifications underneath the given
+// subtrees.
+func generateTrapDefinitions(subtrees []string, nameToNode map[string]*Node, logger *slog.Logger) (map[string]*config.TrapDefinition, error) {
+	if len(subtrees) == 0 {
+		return nil, nil
+	}
+	definitions := map[string]*config.TrapDefinition{}
+	for _, subtree := range subtrees {
+		n, ok := nameToNode[subtree]
+		if !ok {
+			return nil, fmt.Errorf("cannot find oid '%s' to extract traps from", subtree)
+		}
+		walkNode(n, func(n *Node) {
+			if n.Type != "NOTIFTYPE" && n.Type != "TRAPTYPE" {
+				return
+			}
+			if other, ok := definitions[n.Label]; ok {
+				if other.Oid != n.Oid {
+					logger.Warn("Skipping trap with duplicate name", "trap", n.Label, "oid", n.Oid, "other_oid", other.Oid)
+				}
+				return
+			}
+			def := &config.TrapDefinition{Oid: n.Oid, Help: n.Description}
+			for _, object := range n.Objects {
+				o, ok := nameToNode[object]
+				if !ok {
+					logger.Warn("Could not find object of trap", "trap", n.Label, "object", object)
+					continue
+				}
+				def.Objects = append(def.Objects, &config.TrapObject{Name: o.Label, Oid: o.Oid})
+			}
+			definitions[n.Label] = def
+		})
+	}
+	logger.Info("Generated trap definitions", "traps", len(definitions))
+	return definitions, nil
+}
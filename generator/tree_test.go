@@ -18,6 +18,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/promslog"
 	"go.yaml.in/yaml/v2"
@@ -2441,3 +2442,91 @@ func TestGenerateConfigModuleChainedLookupIndexType(t *testing.T) {
 		t.Fatalf("Expected 'cannot use lookup' error, got: %s", err)
 	}
 }
+
+// A subtree within a walk is split out of it to be refreshed on its own.
+func TestGenerateConfigModuleRefreshIntervals(t *testing.T) {
+	node := &Node{
+		Oid: "1", Label: "root",
+		Children: []*Node{
+			{
+				Oid: "1.1", Label: "table",
+				Children: []*Node{
+					{
+						Oid: "1.1.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+						Children: []*Node{
+							{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "tableIndex", Type: "INTEGER"},
+							{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "tableFoo", Type: "INTEGER"},
+							{Oid: "1.1.1.3", Access: "ACCESS_READONLY", Label: "tableName", Type: "OCTETSTR", TextualConvention: "DisplayString"},
+						},
+					},
+				},
+			},
+		},
+	}
+	nameToNode := prepareTree(node, promslog.NewNopLogger())
+	cfg := &ModuleConfig{
+		Walk:             []string{"root"},
+		RefreshIntervals: map[string]time.Duration{"tableName": time.Hour},
+	}
+	out, err := generateConfigModule(cfg, node, nameToNode, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := []string{"1.1.1.1", "1.1.1.2", "1.1.1.3"}; !reflect.DeepEqual(out.Walk, expected) {
+		t.Errorf("Expected walks %v, got %v", expected, out.Walk)
+	}
+	if expected := map[string]time.Duration{"1.1.1.3": time.Hour}; !reflect.DeepEqual(out.RefreshIntervals, expected) {
+		t.Errorf("Expected refresh intervals %v, got %v", expected, out.RefreshIntervals)
+	}
+
+	// Subtrees the MIB does not have cannot be split out.
+	cfg.RefreshIntervals = map[string]time.Duration{"1.1.1.3.5": time.Hour}
+	if _, err := generateConfigModule(cfg, node, nameToNode, promslog.NewNopLogger()); err == nil || !strings.Contains(err.Error(), "cannot refresh '1.1.1.3.5' on its own") {
+		t.Errorf("Expected an error for a subtree not in the MIB, got %v", err)
+	}
+}
+
+func TestGenerateTrapDefinitions(t *testing.T) {
+	node := &Node{
+		Oid: "1", Label: "root",
+		Children: []*Node{
+			{
+				Oid: "1.1", Label: "ifEntry",
+				Children: []*Node{
+					{Oid: "1.1.1", Access: "ACCESS_READONLY", Label: "ifIndex", Type: "INTEGER"},
+					{Oid: "1.1.2", Access: "ACCESS_READONLY", Label: "ifOperStatus", Type: "INTEGER"},
+				},
+			},
+			{
+				Oid: "1.2", Label: "traps",
+				Children: []*Node{
+					{Oid: "1.2.3", Label: "linkDown", Type: "NOTIFTYPE", Description: "A linkDown trap.   Sent when a link goes down.", Objects: []string{"ifIndex", "ifOperStatus", "missing"}},
+					{Oid: "1.2.4", Label: "notATrap", Type: "INTEGER"},
+				},
+			},
+		},
+	}
+	nameToNode := prepareTree(node, promslog.NewNopLogger())
+	got, err := generateTrapDefinitions([]string{"traps"}, nameToNode, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := map[string]*config.TrapDefinition{
+		"linkDown": {
+			Oid:  "1.2.3",
+			Help: "A linkDown trap",
+			Objects: []*config.TrapObject{
+				{Name: "ifIndex", Oid: "1.1.1"},
+				{Name: "ifOperStatus", Oid: "1.1.2"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(want, got) {
+		out, _ := yaml.Marshal(got)
+		t.Errorf("Unexpected trap definitions:\n%s", out)
+	}
+
+	if _, err := generateTrapDefinitions([]string{"nope"}, nameToNode, promslog.NewNopLogger()); err == nil {
+		t.Error("Expected an error for an unknown subtree")
+	}
+}
@@ -14,16 +14,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -46,12 +52,14 @@ const (
 )
 
 var (
-	configFile    = kingpin.Flag("config.file", "Path to configuration file.").Default("snmp.yml").Strings()
-	dryRun        = kingpin.Flag("dry-run", "Only verify configuration is valid and exit.").Default("false").Bool()
-	concurrency   = kingpin.Flag("snmp.module-concurrency", "The number of modules to fetch concurrently per scrape").Default("1").Int()
-	debugSNMP     = kingpin.Flag("snmp.debug-packets", "Include a full debug trace of SNMP packet traffics.").Default("false").Bool()
-	expandEnvVars = kingpin.Flag("config.expand-environment-variables", "Expand environment variables to source secrets").Default("false").Bool()
-	metricsPath   = kingpin.Flag(
+	configFile       = kingpin.Flag("config.file", "Path to configuration file.").Default("snmp.yml").Strings()
+	dryRun           = kingpin.Flag("dry-run", "Only verify configuration is valid and exit.").Default("false").Bool()
+	concurrency      = kingpin.Flag("snmp.module-concurrency", "The number of modules to fetch concurrently per scrape").Default("1").Int()
+	batchConcurrency = kingpin.Flag("snmp.batch-concurrency", "The number of targets to scrape concurrently per batch scrape").Default("10").Int()
+	debugSNMP        = kingpin.Flag("snmp.debug-packets", "Include a full debug trace of SNMP packet traffics.").Default("false").Bool()
+	expandEnvVars    = kingpin.Flag("config.expand-environment-variables", "Expand environment variables to source secrets").Default("false").Bool()
+	timeoutOffset    = kingpin.Flag("snmp.timeout-offset", "Time to subtract from the Prometheus scrape timeout to leave for processing the results.").Default("500ms").Duration()
+	metricsPath      = kingpin.Flag(
 		"web.telemetry-path",
 		"Path under which to expose metrics.",
 	).Default("/metrics").String()
@@ -73,6 +81,14 @@ var (
 		},
 		[]string{"module"},
 	)
+	authSecretLoadErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_secret_load_errors_total",
+			Help:      "Errors loading the secrets of an auth from files or secret providers.",
+		},
+		[]string{"auth"},
+	)
 	sc = &SafeConfig{
 		C: &config.Config{},
 	}
@@ -82,6 +98,7 @@ var (
 const (
 	proberPath = "/snmp"
 	configPath = "/config"
+	sdPath     = "/sd"
 )
 
 func parseModules(query url.Values) ([]string, error) {
@@ -108,29 +125,87 @@ func parseModules(query url.Values) ([]string, error) {
 	return modules, nil
 }
 
-func handler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, exporterMetrics collector.Metrics) {
-	query := r.URL.Query()
+// scrapeContext derives the scrape deadline from the timeout Prometheus sends
+// with each scrape, less the offset. Without the header there is no deadline.
+func scrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc, error) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return nil, nil, fmt.Errorf("invalid X-Prometheus-Scrape-Timeout-Seconds header %q", v)
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
 
-	debug := *debugSNMP
-	if query.Get("snmp_debug_packets") == "true" {
-		debug = true
-		// TODO: This doesn't work the way I want.
-		// logger = level.NewFilter(logger, level.AllowDebug())
-		logger.Debug("Debug query param enabled")
+// scrapeRequest is a scrape of a single target, with its auth and modules
+// resolved against the configuration.
+type scrapeRequest struct {
+	target        string
+	authName      string
+	auth          *config.Auth
+	snmpContext   string
+	snmpEngineID  string
+	sourceAddress string
+	modules       []*collector.NamedModule
+	// The auths to try in order, if authName is an auth chain.
+	chainAuths []*collector.NamedAuth
+}
+
+// collector returns the collector that scrapes the target of the request.
+func (req *scrapeRequest) collector(ctx context.Context, logger *slog.Logger, exporterMetrics collector.Metrics, debug bool) *collector.Collector {
+	c := collector.New(ctx, req.target, req.authName, req.snmpContext, req.snmpEngineID, req.sourceAddress, req.auth, req.modules, logger, exporterMetrics, *concurrency, debug)
+	if req.chainAuths != nil {
+		c.WithAuthChain(req.authName, req.chainAuths)
 	}
+	return c
+}
 
+// parseScrapeRequest validates the parameters of a scrape of a single target.
+func parseScrapeRequest(query url.Values) (*scrapeRequest, error) {
 	target := query.Get("target")
 	if len(query["target"]) != 1 || target == "" {
-		http.Error(w, "'target' parameter must be specified once", http.StatusBadRequest)
-		snmpRequestErrors.Inc()
-		return
+		return nil, fmt.Errorf("'target' parameter must be specified once")
+	}
+
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	var profile *config.Profile
+	if profileName := query.Get("profile"); profileName != "" {
+		if len(query["profile"]) > 1 {
+			return nil, fmt.Errorf("'profile' parameter must only be specified once")
+		}
+		var ok bool
+		profile, ok = sc.C.Profiles[profileName]
+		if !ok {
+			return nil, fmt.Errorf("Unknown profile '%s'", profileName)
+		}
+		query = withDefaults(query, url.Values{
+			"auth":          nonEmpty(profile.Auth),
+			"module":        profile.Modules,
+			"snmp_context":  nonEmpty(profile.SNMPContext),
+			"snmp_engineid": nonEmpty(profile.SNMPEngineID),
+		})
+	}
+	if group := sc.C.TargetGroup(target); group != nil {
+		query = withDefaults(query, url.Values{
+			"auth":          nonEmpty(group.Auth),
+			"module":        group.Modules,
+			"snmp_context":  nonEmpty(group.SNMPContext),
+			"snmp_engineid": nonEmpty(group.SNMPEngineID),
+		})
 	}
 
 	authName := query.Get("auth")
 	if len(query["auth"]) > 1 {
-		http.Error(w, "'auth' parameter must only be specified once", http.StatusBadRequest)
-		snmpRequestErrors.Inc()
-		return
+		return nil, fmt.Errorf("'auth' parameter must only be specified once")
 	}
 	if authName == "" {
 		authName = "public_v2"
@@ -138,47 +213,155 @@ func handler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, export
 
 	snmpContext := query.Get("snmp_context")
 	if len(query["snmp_context"]) > 1 {
-		http.Error(w, "'snmp_context' parameter must only be specified once", http.StatusBadRequest)
-		snmpRequestErrors.Inc()
-		return
+		return nil, fmt.Errorf("'snmp_context' parameter must only be specified once")
 	}
 
 	snmpEngineID := query.Get("snmp_engineid")
 	if len(query["snmp_engineid"]) > 1 {
-		http.Error(w, "'snmp_engineid' parameter must only be specified once", http.StatusBadRequest)
-		snmpRequestErrors.Inc()
-		return
+		return nil, fmt.Errorf("'snmp_engineid' parameter must only be specified once")
 	}
 
 	modules, err := parseModules(query)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		snmpRequestErrors.Inc()
-		return
+		return nil, err
 	}
-	sc.mu.RLock()
+	subtreeTelemetry := query.Get("subtree_telemetry") == "true"
 	auth, authOk := sc.C.Auths[authName]
+	var chainAuths []*collector.NamedAuth
+	if chain, ok := sc.C.AuthChains[authName]; ok {
+		// Only the secrets of the auths that are tried are loaded.
+		for _, a := range chain.Auths {
+			auth := sc.C.Auths[a]
+			chainAuths = append(chainAuths, collector.NewLazyNamedAuth(a, auth, func(ctx context.Context) (*config.Auth, error) {
+				return loadSecrets(ctx, a, auth)
+			}))
+		}
+		auth, authOk = chainAuths[0].Auth, true
+	}
 	if !authOk {
-		sc.mu.RUnlock()
-		http.Error(w, fmt.Sprintf("Unknown auth '%s'", authName), http.StatusBadRequest)
-		snmpRequestErrors.Inc()
-		return
+		return nil, fmt.Errorf("Unknown auth '%s'", authName)
 	}
 	var nmodules []*collector.NamedModule
 	for _, m := range modules {
 		module, moduleOk := sc.C.Modules[m]
 		if !moduleOk {
-			sc.mu.RUnlock()
-			http.Error(w, fmt.Sprintf("Unknown module '%s'", m), http.StatusBadRequest)
-			snmpRequestErrors.Inc()
-			return
+			return nil, fmt.Errorf("Unknown module '%s'", m)
+		}
+		if profile != nil {
+			module = profile.WalkParams.Apply(module)
 		}
-		nmodules = append(nmodules, collector.NewNamedModule(m, module))
+		if subtreeTelemetry && !module.WalkParams.SubtreeTelemetry {
+			// The module is shared with other scrapes.
+			m := *module
+			m.WalkParams.SubtreeTelemetry = true
+			module = &m
+		}
+		nmodules = append(nmodules, collector.NewCompiledModule(m, module, sc.plans[m]))
 	}
-	sc.mu.RUnlock()
-	logger = logger.With("auth", authName, "target", target)
+	req := &scrapeRequest{
+		target:       target,
+		authName:     authName,
+		auth:         auth,
+		snmpContext:  snmpContext,
+		snmpEngineID: snmpEngineID,
+		modules:      nmodules,
+		chainAuths:   chainAuths,
+	}
+	if profile != nil {
+		req.sourceAddress = profile.SourceAddress
+	}
+	return req, nil
+}
+
+// loadSecrets loads the secrets of the auth of the request, once the
+// configuration is no longer locked, within the scrape deadline. The secrets
+// of the auths of an auth chain are loaded once they are tried.
+func (req *scrapeRequest) loadSecrets(ctx context.Context) error {
+	if req.chainAuths != nil {
+		return nil
+	}
+	auth, err := loadSecrets(ctx, req.authName, req.auth)
+	if err != nil {
+		return err
+	}
+	req.auth = auth
+	return nil
+}
+
+// loadSecrets returns the auth with the secrets it reads from files or secret
+// providers filled in.
+func loadSecrets(ctx context.Context, name string, auth *config.Auth) (*config.Auth, error) {
+	if !auth.HasExternalSecrets() {
+		return auth, nil
+	}
+	loaded, err := auth.LoadSecrets(ctx)
+	if err != nil {
+		authSecretLoadErrors.WithLabelValues(name).Inc()
+		return nil, fmt.Errorf("error loading secrets of auth '%s': %w", name, err)
+	}
+	return &loaded, nil
+}
+
+// withDefaults fills in the parameters that are not in the query, such as
+// those of a profile or of the inventory entry of the target.
+func withDefaults(query, defaults url.Values) url.Values {
+	q := make(url.Values, len(query))
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range defaults {
+		if _, ok := q[k]; !ok && len(v) > 0 {
+			q[k] = v
+		}
+	}
+	return q
+}
+
+// nonEmpty returns a parameter value list holding s, or nil if s is empty.
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+// debugPackets reports whether SNMP packet debugging is enabled for a request.
+func debugPackets(query url.Values, logger *slog.Logger) bool {
+	if query.Get("snmp_debug_packets") == "true" {
+		// TODO: This doesn't work the way I want.
+		// logger = level.NewFilter(logger, level.AllowDebug())
+		logger.Debug("Debug query param enabled")
+		return true
+	}
+	return *debugSNMP
+}
+
+func handler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, exporterMetrics collector.Metrics) {
+	query := r.URL.Query()
+
+	debug := debugPackets(query, logger)
+
+	req, err := parseScrapeRequest(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+	ctx, cancel, err := scrapeContext(r, *timeoutOffset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+	defer cancel()
+	if err := req.loadSecrets(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		snmpRequestErrors.Inc()
+		return
+	}
+	logger = logger.With("auth", req.authName, "target", req.target)
 	registry := prometheus.NewRegistry()
-	c := collector.New(r.Context(), target, authName, snmpContext, snmpEngineID, auth, nmodules, logger, exporterMetrics, *concurrency, debug)
+	c := req.collector(ctx, logger, exporterMetrics, debug)
 	registry.MustRegister(c)
 	// Delegate http serving to Prometheus client library, which will call collector.Collect.
 	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
@@ -198,9 +381,56 @@ func updateConfiguration(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// sdTargetGroup is a target group in the Prometheus HTTP service discovery
+// format.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// sdTargetGroups returns the target inventory of the configuration, with the
+// parameters of each group as __param_* labels.
+func sdTargetGroups(c *config.Config) []sdTargetGroup {
+	groups := make([]sdTargetGroup, 0, len(c.Targets))
+	for _, name := range slices.Sorted(maps.Keys(c.Targets)) {
+		group := c.Targets[name]
+		labels := make(map[string]string, len(group.Labels)+5)
+		maps.Copy(labels, group.Labels)
+		labels["__meta_snmp_target_group"] = name
+		if group.Auth != "" {
+			labels["__param_auth"] = group.Auth
+		}
+		if len(group.Modules) > 0 {
+			labels["__param_module"] = strings.Join(group.Modules, ",")
+		}
+		if group.SNMPContext != "" {
+			labels["__param_snmp_context"] = group.SNMPContext
+		}
+		if group.SNMPEngineID != "" {
+			labels["__param_snmp_engineid"] = group.SNMPEngineID
+		}
+		groups = append(groups, sdTargetGroup{Targets: group.Targets, Labels: labels})
+	}
+	return groups
+}
+
+// sdHandler serves the target inventory in the format of Prometheus HTTP
+// service discovery.
+func sdHandler(w http.ResponseWriter, _ *http.Request, logger *slog.Logger) {
+	sc.mu.RLock()
+	groups := sdTargetGroups(sc.C)
+	sc.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(groups); err != nil {
+		logger.Error("Error encoding target groups", "err", err)
+	}
+}
+
 type SafeConfig struct {
 	mu sync.RWMutex
 	C  *config.Config
+	// The plans of the modules of C, by name.
+	plans map[string]*collector.ModulePlan
 }
 
 func (sc *SafeConfig) ReloadConfig(logger *slog.Logger, configFile []string, expandEnvVars bool) (err error) {
@@ -208,12 +438,29 @@ func (sc *SafeConfig) ReloadConfig(logger *slog.Logger, configFile []string, exp
 	if err != nil {
 		return err
 	}
+	plans := make(map[string]*collector.ModulePlan, len(conf.Modules))
+	for name, module := range conf.Modules {
+		plans[name], err = collector.CompileModule(module)
+		if err != nil {
+			return fmt.Errorf("error compiling module %q: %w", name, err)
+		}
+	}
 	sc.mu.Lock()
 	sc.C = conf
+	sc.plans = plans
+	// Results scraped with the previous configuration are not served, and
+	// the max repetitions are learned again for the modules as they are now.
+	collector.FlushResultCache()
+	collector.FlushRepetitions()
 	// Initialize metrics.
 	for module := range sc.C.Modules {
 		snmpCollectionDuration.WithLabelValues(module)
 	}
+	for name, auth := range sc.C.Auths {
+		if auth.HasExternalSecrets() {
+			authSecretLoadErrors.WithLabelValues(name)
+		}
+	}
 	sc.mu.Unlock()
 	return nil
 }
@@ -259,6 +506,11 @@ func main() {
 		return
 	}
 
+	if err := startTrapReceiver(logger); err != nil {
+		logger.Error("Error starting trap receiver", "err", err)
+		os.Exit(1)
+	}
+
 	hup := make(chan os.Signal, 1)
 	reloadCh = make(chan chan error)
 	signal.Notify(hup, syscall.SIGHUP)
@@ -322,6 +574,41 @@ func main() {
 				Help:      "Current number of SNMP scrapes being requested.",
 			},
 		),
+		SNMPCoalesced: promauto.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "scrapes_coalesced_total",
+				Help:      "Number of scrapes that shared the results of an identical scrape in flight.",
+			},
+		),
+		SNMPSessionQueueDepth: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "session_queue_depth",
+				Help:      "Current number of SNMP sessions waiting for the session limits.",
+			},
+		),
+		SNMPSessionWait: promauto.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "session_wait_seconds",
+				Help:      "A histogram of the time SNMP sessions waited for the session limits.",
+			},
+		),
+		SNMPSessionRejections: promauto.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "session_rejections_total",
+				Help:      "Number of SNMP sessions rejected because the wait queue was full.",
+			},
+		),
+		SNMPSessionsReused: promauto.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "session_pool_reused_total",
+				Help:      "Number of scrapes that reused an idle SNMP session from the session pool.",
+			},
+		),
 	}
 
 	http.Handle(*metricsPath, promhttp.Handler()) // Normal metrics endpoint for SNMP exporter itself.
@@ -329,6 +616,18 @@ func main() {
 	http.HandleFunc(proberPath, func(w http.ResponseWriter, r *http.Request) {
 		handler(w, r, logger, exporterMetrics)
 	})
+	// Endpoint to do SNMP scrapes of many targets at once.
+	http.HandleFunc(batchPath, func(w http.ResponseWriter, r *http.Request) {
+		batchHandler(w, r, logger, exporterMetrics)
+	})
+	// Endpoint to debug SNMP scrapes, returning the PDUs as JSON.
+	http.HandleFunc(rawPath, func(w http.ResponseWriter, r *http.Request) {
+		rawHandler(w, r, logger, exporterMetrics)
+	})
+	// Endpoint to debug how PDUs are turned into metrics.
+	http.HandleFunc(explainPath, func(w http.ResponseWriter, r *http.Request) {
+		explainHandler(w, r, logger, exporterMetrics)
+	})
 	http.HandleFunc("/-/reload", updateConfiguration) // Endpoint to reload configuration.
 	// Endpoint to respond to health checks
 	http.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
@@ -386,6 +685,11 @@ func main() {
 		http.Handle("/", landingPage)
 	}
 
+	// Endpoint for Prometheus HTTP service discovery of the target inventory.
+	http.HandleFunc(sdPath, func(w http.ResponseWriter, r *http.Request) {
+		sdHandler(w, r, logger)
+	})
+
 	http.HandleFunc(configPath, func(w http.ResponseWriter, r *http.Request) {
 		sc.mu.RLock()
 		c, err := yaml.Marshal(sc.C)
@@ -0,0 +1,89 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/snmp_exporter/collector"
+)
+
+const (
+	rawPath     = "/snmp/raw"
+	explainPath = "/snmp/explain"
+)
+
+// debugResponse is the response of the raw and explain endpoints.
+type debugResponse struct {
+	Target  string `json:"target"`
+	Auth    string `json:"auth"`
+	Modules any    `json:"modules"`
+}
+
+// rawHandler scrapes a target like the /snmp endpoint, but returns the PDUs
+// as JSON instead of turning them into metrics.
+func rawHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, exporterMetrics collector.Metrics) {
+	debugHandler(w, r, logger, exporterMetrics, func(c *collector.Collector) (any, error) {
+		return c.Raw()
+	})
+}
+
+// explainHandler scrapes a target like the /snmp endpoint, and reports as
+// JSON how each PDU was turned into samples.
+func explainHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, exporterMetrics collector.Metrics) {
+	debugHandler(w, r, logger, exporterMetrics, func(c *collector.Collector) (any, error) {
+		return c.Explain()
+	})
+}
+
+func debugHandler(w http.ResponseWriter, r *http.Request, logger *slog.Logger, exporterMetrics collector.Metrics, scrape func(*collector.Collector) (any, error)) {
+	query := r.URL.Query()
+	debug := debugPackets(query, logger)
+
+	req, err := parseScrapeRequest(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+	ctx, cancel, err := scrapeContext(r, *timeoutOffset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		snmpRequestErrors.Inc()
+		return
+	}
+	defer cancel()
+	if err := req.loadSecrets(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		snmpRequestErrors.Inc()
+		return
+	}
+	logger = logger.With("auth", req.authName, "target", req.target)
+
+	c := req.collector(ctx, logger, exporterMetrics, debug)
+	modules, err := scrape(c)
+	if err != nil {
+		logger.Info("Error scraping target", "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(debugResponse{Target: req.target, Auth: req.authName, Modules: modules}); err != nil {
+		logger.Error("Error encoding response", "err", err)
+	}
+}
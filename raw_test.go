@@ -0,0 +1,79 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/snmp_exporter/collector"
+)
+
+func TestRawHandler(t *testing.T) {
+	sc = batchTestConfig()
+	useMockTargets(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/snmp/raw?target=10.0.0.1&auth=private_v2&module=if_mib,system", http.NoBody)
+	resp := httptest.NewRecorder()
+	rawHandler(resp, req, nopLogger, testMetrics())
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	var got struct {
+		Target  string                `json:"target"`
+		Auth    string                `json:"auth"`
+		Modules []collector.RawModule `json:"modules"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if got.Target != "10.0.0.1" || got.Auth != "private_v2" || len(got.Modules) != 2 || got.Modules[1].Module != "system" {
+		t.Fatalf("Unexpected response: %+v", got)
+	}
+	for _, m := range got.Modules {
+		if m.Error != "" || len(m.PDUs) != 1 {
+			t.Errorf("Expected a PDU and no error for module %s, got %+v", m.Module, m)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/snmp/raw?target=10.0.0.1&module=nope", http.NoBody)
+	resp = httptest.NewRecorder()
+	rawHandler(resp, req, nopLogger, testMetrics())
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown module, got %d", http.StatusBadRequest, resp.Code)
+	}
+}
+
+func TestExplainHandler(t *testing.T) {
+	sc = batchTestConfig()
+	useMockTargets(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/snmp/explain?target=10.0.0.1&module=system", http.NoBody)
+	resp := httptest.NewRecorder()
+	explainHandler(resp, req, nopLogger, testMetrics())
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, resp.Code, resp.Body.String())
+	}
+	var got struct {
+		Modules []collector.ModuleExplanation `json:"modules"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if len(got.Modules) != 1 || got.Modules[0].Module != "system" {
+		t.Errorf("Unexpected response: %+v", got)
+	}
+}
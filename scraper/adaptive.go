@@ -0,0 +1,217 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	// Number of walks that must succeed before a higher max repetitions is
+	// tried again.
+	repetitionsProbeAfter = 10
+	// How long a target that mishandles GETBULK is walked with GETNEXT
+	// before GETBULK is tried again.
+	bulkRetryInterval = time.Hour
+)
+
+// AdaptiveRepetitions is the max repetitions learned for a target. It is
+// lowered when bulk walks time out or fail with tooBig or genErr, and probed
+// back up towards the configured value after a run of successful walks. If
+// even a max repetitions of 1 fails, the target is walked with GETNEXT.
+type AdaptiveRepetitions struct {
+	mu sync.Mutex
+	// The max repetitions to use, 0 until one had to be lowered.
+	limit uint32
+	// The max repetitions of the last successful walk, 0 for GETNEXT.
+	last      uint32
+	walked    bool
+	successes int
+	// When GETBULK is to be tried again, if it was found to be broken.
+	bulkBrokenUntil time.Time
+}
+
+// LastMaxRepetitions returns the max repetitions of the last successful
+// walk, or 0 if it used GETNEXT. ok is false before the first one.
+func (a *AdaptiveRepetitions) LastMaxRepetitions() (value uint32, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last, a.walked
+}
+
+// next returns the max repetitions to walk with, or 0 to use GETNEXT.
+func (a *AdaptiveRepetitions) next(configured uint32, now time.Time) uint32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Before(a.bulkBrokenUntil) {
+		return 0
+	}
+	if a.limit == 0 || a.limit >= configured {
+		return configured
+	}
+	if a.successes >= repetitionsProbeAfter {
+		a.successes = 0
+		return min(a.limit*2, configured)
+	}
+	return a.limit
+}
+
+func (a *AdaptiveRepetitions) succeeded(repetitions uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.walked = true
+	a.last = repetitions
+	if repetitions == 0 {
+		return
+	}
+	a.successes++
+	a.bulkBrokenUntil = time.Time{}
+	if a.limit != 0 && repetitions > a.limit {
+		a.limit = repetitions
+		a.successes = 0
+	}
+}
+
+// failed lowers the max repetitions after a walk with repetitions failed.
+// Once even 1 fails, GETBULK is considered broken for a while.
+func (a *AdaptiveRepetitions) failed(repetitions uint32, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.successes = 0
+	if repetitions <= 1 {
+		a.limit = 1
+		a.bulkBrokenUntil = now.Add(bulkRetryInterval)
+		return
+	}
+	a.limit = repetitions / 2
+}
+
+// bulkClient is the part of gosnmp that adaptive walks use.
+type bulkClient interface {
+	Get(oids []string) (*gosnmp.SnmpPacket, error)
+	GetBulk(oids []string, nonRepeaters uint8, maxRepetitions uint32) (*gosnmp.SnmpPacket, error)
+	WalkAll(rootOid string) ([]gosnmp.SnmpPDU, error)
+}
+
+// adaptiveWalk walks oid, lowering the max repetitions and retrying when a
+// bulk walk fails in a way that suggests the responses are too large for the
+// agent.
+func adaptiveWalk(ctx context.Context, c bulkClient, oid string, configured uint32, checkIncreasing bool, a *AdaptiveRepetitions) ([]gosnmp.SnmpPDU, error) {
+	for {
+		repetitions := a.next(configured, time.Now())
+		if repetitions == 0 {
+			results, err := c.WalkAll(oid)
+			if err == nil {
+				a.succeeded(0)
+			}
+			return results, err
+		}
+		results, err := bulkWalk(c, oid, repetitions, checkIncreasing)
+		if err == nil {
+			a.succeeded(repetitions)
+			return results, nil
+		}
+		if ctx.Err() != nil {
+			return results, err
+		}
+		switch Reason(err) {
+		case ReasonTooBig, ReasonGenErr:
+		case ReasonTimeout:
+			// Only blame GETBULK if the agent answers a plain get.
+			if _, getErr := c.Get([]string{oid}); getErr != nil {
+				return results, err
+			}
+		default:
+			return results, err
+		}
+		a.failed(repetitions, time.Now())
+	}
+}
+
+// bulkWalk walks oid with GETBULK like gosnmp does, except that responses
+// with an error status fail the walk rather than ending it.
+func bulkWalk(c bulkClient, oid string, repetitions uint32, checkIncreasing bool) ([]gosnmp.SnmpPDU, error) {
+	root := oid
+	if !strings.HasPrefix(root, ".") {
+		root = "." + root
+	}
+	var results []gosnmp.SnmpPDU
+	next := root
+	for requests := 1; ; requests++ {
+		response, err := c.GetBulk([]string{next}, 0, repetitions)
+		if err != nil {
+			return results, &Error{Reason: ClassifyError(err), Err: err}
+		}
+		if response.Error != gosnmp.NoError {
+			return results, &Error{Reason: ErrorStatusReason(response.Error), Err: fmt.Errorf("bulk walk of %s failed with %s", oid, response.Error)}
+		}
+		if len(response.Variables) == 0 {
+			return results, nil
+		}
+		for i, pdu := range response.Variables {
+			if pdu.Type == gosnmp.EndOfMibView || pdu.Type == gosnmp.NoSuchObject || pdu.Type == gosnmp.NoSuchInstance {
+				return results, nil
+			}
+			if !strings.HasPrefix(pdu.Name, root+".") {
+				if requests == 1 && i == 0 {
+					// The OID is a leaf rather than a subtree.
+					return getLeaf(c, root)
+				}
+				return results, nil
+			}
+			if checkIncreasing && compareOids(next, pdu.Name) >= 0 {
+				return results, fmt.Errorf("OID not increasing: %s >= %s", next, pdu.Name)
+			}
+			results = append(results, pdu)
+			next = pdu.Name
+		}
+	}
+}
+
+func getLeaf(c bulkClient, oid string) ([]gosnmp.SnmpPDU, error) {
+	response, err := c.Get([]string{oid})
+	if err != nil {
+		return nil, &Error{Reason: ClassifyError(err), Err: err}
+	}
+	for _, pdu := range response.Variables {
+		if pdu.Name == oid && pdu.Type != gosnmp.NoSuchObject && pdu.Type != gosnmp.NoSuchInstance {
+			return []gosnmp.SnmpPDU{pdu}, nil
+		}
+	}
+	return nil, nil
+}
+
+// compareOids compares two OIDs component by component.
+func compareOids(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "."), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if len(as[i]) != len(bs[i]) {
+			if len(as[i]) < len(bs[i]) {
+				return -1
+			}
+			return 1
+		}
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
@@ -0,0 +1,168 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// fakeBulkAgent serves a table of 50 rows under 1.3.6.1.2.1.2.2.1.1, and
+// fails GETBULK requests with more than maxRepetitions.
+type fakeBulkAgent struct {
+	maxRepetitions uint32
+	status         gosnmp.SNMPError
+	down           bool
+	bulks          []uint32
+	getNextWalks   int
+}
+
+func (f *fakeBulkAgent) pdus() []gosnmp.SnmpPDU {
+	var pdus []gosnmp.SnmpPDU
+	for i := 1; i <= 50; i++ {
+		pdus = append(pdus, gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.1.%d", i), Type: gosnmp.Integer, Value: i})
+	}
+	return pdus
+}
+
+func (f *fakeBulkAgent) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	if f.down {
+		return nil, errors.New("request timeout (after 0 retries)")
+	}
+	return &gosnmp.SnmpPacket{Variables: []gosnmp.SnmpPDU{{Name: oids[0], Type: gosnmp.NoSuchObject}}}, nil
+}
+
+func (f *fakeBulkAgent) GetBulk(oids []string, _ uint8, maxRepetitions uint32) (*gosnmp.SnmpPacket, error) {
+	f.bulks = append(f.bulks, maxRepetitions)
+	if f.down {
+		return nil, errors.New("request timeout (after 0 retries)")
+	}
+	if maxRepetitions > f.maxRepetitions {
+		return &gosnmp.SnmpPacket{Error: f.status, Variables: []gosnmp.SnmpPDU{{Name: oids[0], Type: gosnmp.Null}}}, nil
+	}
+	var vars []gosnmp.SnmpPDU
+	for _, pdu := range f.pdus() {
+		if compareOids(pdu.Name, oids[0]) > 0 && uint32(len(vars)) < maxRepetitions {
+			vars = append(vars, pdu)
+		}
+	}
+	if len(vars) == 0 {
+		vars = append(vars, gosnmp.SnmpPDU{Name: oids[0], Type: gosnmp.EndOfMibView})
+	}
+	return &gosnmp.SnmpPacket{Variables: vars}, nil
+}
+
+func (f *fakeBulkAgent) WalkAll(string) ([]gosnmp.SnmpPDU, error) {
+	f.getNextWalks++
+	return f.pdus(), nil
+}
+
+func TestAdaptiveWalk(t *testing.T) {
+	agent := &fakeBulkAgent{maxRepetitions: 8, status: gosnmp.TooBig}
+	a := &AdaptiveRepetitions{}
+	walk := func() {
+		t.Helper()
+		agent.bulks = nil
+		results, err := adaptiveWalk(context.Background(), agent, "1.3.6.1.2.1.2.2.1.1", 25, true, a)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(results) != 50 {
+			t.Fatalf("Expected 50 PDUs, got %d", len(results))
+		}
+	}
+
+	walk()
+	if v, ok := a.LastMaxRepetitions(); !ok || v != 6 {
+		t.Errorf("Expected to settle on 6, got %d", v)
+	}
+	if agent.bulks[0] != 25 || agent.bulks[1] != 12 || agent.bulks[2] != 6 {
+		t.Errorf("Expected to halve the max repetitions, got requests with %v", agent.bulks)
+	}
+
+	// Later walks start with the learned value.
+	for range repetitionsProbeAfter - 1 {
+		walk()
+		if agent.bulks[0] != 6 {
+			t.Fatalf("Expected walks with 6, got %v", agent.bulks)
+		}
+	}
+	// Until a higher value is probed, which fails again here.
+	walk()
+	if agent.bulks[0] != 12 || agent.bulks[1] != 6 {
+		t.Errorf("Expected a probe with 12, got %v", agent.bulks)
+	}
+
+	// Once the agent handles more, the probe sticks.
+	agent.maxRepetitions = 100
+	for range repetitionsProbeAfter + 1 {
+		walk()
+	}
+	if v, _ := a.LastMaxRepetitions(); v != 12 {
+		t.Errorf("Expected to move up to 12, got %d", v)
+	}
+}
+
+func TestAdaptiveWalkGetNextFallback(t *testing.T) {
+	agent := &fakeBulkAgent{maxRepetitions: 0, status: gosnmp.GenErr}
+	a := &AdaptiveRepetitions{}
+	for range 2 {
+		results, err := adaptiveWalk(context.Background(), agent, "1.3.6.1.2.1.2.2.1.1", 4, true, a)
+		if err != nil || len(results) != 50 {
+			t.Fatalf("Unexpected result: %d PDUs, %v", len(results), err)
+		}
+	}
+	if v, ok := a.LastMaxRepetitions(); !ok || v != 0 {
+		t.Errorf("Expected GETNEXT to be used, got %d", v)
+	}
+	// 4, 2 and 1 are tried once, then GETBULK is not tried again.
+	if len(agent.bulks) != 3 || agent.getNextWalks != 2 {
+		t.Errorf("Unexpected requests: bulks %v, GETNEXT walks %d", agent.bulks, agent.getNextWalks)
+	}
+}
+
+func TestAdaptiveWalkTargetDown(t *testing.T) {
+	agent := &fakeBulkAgent{maxRepetitions: 100, down: true}
+	a := &AdaptiveRepetitions{}
+	if _, err := adaptiveWalk(context.Background(), agent, "1.3.6.1.2.1.2.2.1.1", 25, true, a); Reason(err) != ReasonTimeout {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	// A target that does not answer at all is not taken as mishandling
+	// GETBULK.
+	if len(agent.bulks) != 1 {
+		t.Errorf("Expected a single try, got %v", agent.bulks)
+	}
+	if _, ok := a.LastMaxRepetitions(); ok {
+		t.Error("Expected nothing to be learned")
+	}
+}
+
+func TestCompareOids(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{".1.3.6.1.2", ".1.3.6.1.10", -1},
+		{".1.3.6.1.2.1", ".1.3.6.1.2", 1},
+		{"1.3.6", ".1.3.6", 0},
+	} {
+		if got := compareOids(c.a, c.b); (got > 0) != (c.want > 0) || (got < 0) != (c.want < 0) {
+			t.Errorf("compareOids(%s, %s) = %d, expected sign of %d", c.a, c.b, got, c.want)
+		}
+	}
+}
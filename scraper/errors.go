@@ -0,0 +1,133 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// ErrorReason classifies why an SNMP request failed. It is used as a label
+// value, so it must stay short and low cardinality.
+type ErrorReason string
+
+const (
+	ReasonTimeout           ErrorReason = "timeout"
+	ReasonAuthFailure       ErrorReason = "auth_failure"
+	ReasonUnknownUser       ErrorReason = "unknown_user"
+	ReasonNotInTimeWindow   ErrorReason = "not_in_time_window"
+	ReasonUnknownEngineID   ErrorReason = "unknown_engine_id"
+	ReasonDecryptionError   ErrorReason = "decryption_error"
+	ReasonTooBig            ErrorReason = "too_big"
+	ReasonGenErr            ErrorReason = "gen_err"
+	ReasonBadValue          ErrorReason = "bad_value"
+	ReasonNoSuchName        ErrorReason = "no_such_name"
+	ReasonErrorStatus       ErrorReason = "error_status"
+	ReasonConnectionRefused ErrorReason = "connection_refused"
+	ReasonDNSFailure        ErrorReason = "dns_failure"
+	ReasonOther             ErrorReason = "other"
+
+	// ReasonBudgetExhausted is used for requests that were not sent, or were
+	// cut short, because the scrape deadline had passed.
+	ReasonBudgetExhausted ErrorReason = "budget_exhausted"
+	// ReasonPDULimit is used for scrapes of modules that returned more
+	// PDUs than their max_pdus.
+	ReasonPDULimit ErrorReason = "pdu_limit"
+)
+
+// Error is an SNMP failure along with its classified reason.
+type Error struct {
+	Reason ErrorReason
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Reason returns the reason of an error, classifying it if it is not
+// already an *Error.
+func Reason(err error) ErrorReason {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Reason
+	}
+	return ClassifyError(err)
+}
+
+// ClassifyError maps errors returned by gosnmp and the network stack to a
+// reason.
+func ClassifyError(err error) ErrorReason {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, gosnmp.ErrWrongDigest):
+		return ReasonAuthFailure
+	case errors.Is(err, gosnmp.ErrUnknownUsername):
+		return ReasonUnknownUser
+	case errors.Is(err, gosnmp.ErrNotInTimeWindow):
+		return ReasonNotInTimeWindow
+	case errors.Is(err, gosnmp.ErrUnknownEngineID):
+		return ReasonUnknownEngineID
+	case errors.Is(err, gosnmp.ErrDecryption):
+		return ReasonDecryptionError
+	case errors.As(err, &dnsErr):
+		return ReasonDNSFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReasonConnectionRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return ReasonTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	// gosnmp reports exhausted retries as an untyped error.
+	case strings.Contains(err.Error(), "timeout"):
+		return ReasonTimeout
+	}
+	return ReasonOther
+}
+
+// IsTransportError reports whether err is a failure of the connection to the
+// target rather than of a request, such as a TCP connection the target
+// closed.
+func IsTransportError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// ErrorStatusReason maps the error status of a response packet to a reason.
+func ErrorStatusReason(status gosnmp.SNMPError) ErrorReason {
+	switch status {
+	case gosnmp.TooBig:
+		return ReasonTooBig
+	case gosnmp.GenErr:
+		return ReasonGenErr
+	case gosnmp.BadValue:
+		return ReasonBadValue
+	case gosnmp.NoSuchName:
+		return ReasonNoSuchName
+	}
+	return ReasonErrorStatus
+}
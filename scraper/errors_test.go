@@ -0,0 +1,123 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestReason(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want ErrorReason
+	}{
+		{
+			name: "wrong digest",
+			err:  fmt.Errorf("error getting target: %w", gosnmp.ErrWrongDigest),
+			want: ReasonAuthFailure,
+		},
+		{
+			name: "unknown username",
+			err:  gosnmp.ErrUnknownUsername,
+			want: ReasonUnknownUser,
+		},
+		{
+			name: "not in time window",
+			err:  gosnmp.ErrNotInTimeWindow,
+			want: ReasonNotInTimeWindow,
+		},
+		{
+			name: "decryption",
+			err:  gosnmp.ErrDecryption,
+			want: ReasonDecryptionError,
+		},
+		{
+			name: "retries exhausted",
+			err:  errors.New("request timeout (after 3 retries)"),
+			want: ReasonTimeout,
+		},
+		{
+			name: "context deadline",
+			err:  fmt.Errorf("error walking target: %w", context.DeadlineExceeded),
+			want: ReasonTimeout,
+		},
+		{
+			name: "connection refused",
+			err: &net.OpError{Op: "read", Net: "udp", Err: &os.SyscallError{
+				Syscall: "recvfrom", Err: syscall.ECONNREFUSED,
+			}},
+			want: ReasonConnectionRefused,
+		},
+		{
+			name: "dns",
+			err:  &net.OpError{Op: "dial", Net: "udp", Err: &net.DNSError{Err: "no such host", Name: "switch.invalid", IsNotFound: true}},
+			want: ReasonDNSFailure,
+		},
+		{
+			name: "already classified",
+			err:  fmt.Errorf("scrape failed: %w", &Error{Reason: ReasonTooBig, Err: errors.New("too big")}),
+			want: ReasonTooBig,
+		},
+		{
+			name: "unknown",
+			err:  errors.New("something else"),
+			want: ReasonOther,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := Reason(c.err); got != c.want {
+				t.Errorf("Reason(%v): got %q, want %q", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestErrorStatusReason(t *testing.T) {
+	cases := map[gosnmp.SNMPError]ErrorReason{
+		gosnmp.TooBig:     ReasonTooBig,
+		gosnmp.GenErr:     ReasonGenErr,
+		gosnmp.NoSuchName: ReasonNoSuchName,
+		gosnmp.BadValue:   ReasonBadValue,
+		gosnmp.NoAccess:   ReasonErrorStatus,
+	}
+	for status, want := range cases {
+		if got := ErrorStatusReason(status); got != want {
+			t.Errorf("ErrorStatusReason(%s): got %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestIsTransportError(t *testing.T) {
+	for err, want := range map[error]bool{
+		&net.OpError{Op: "read", Net: "tcp", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}:       true,
+		&net.OpError{Op: "write", Net: "tcp", Err: &os.SyscallError{Syscall: "write", Err: syscall.EPIPE}}:          true,
+		fmt.Errorf("error getting target: %w", net.ErrClosed):                                                       true,
+		errors.New("request timeout (after 3 retries)"):                                                             false,
+		&net.OpError{Op: "read", Net: "udp", Err: &os.SyscallError{Syscall: "recvfrom", Err: syscall.ECONNREFUSED}}: false,
+	} {
+		if got := IsTransportError(err); got != want {
+			t.Errorf("IsTransportError(%v): got %v, want %v", err, got, want)
+		}
+	}
+}
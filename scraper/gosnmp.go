@@ -27,8 +27,9 @@ import (
 )
 
 type GoSNMPWrapper struct {
-	c      *gosnmp.GoSNMP
-	logger *slog.Logger
+	c        *gosnmp.GoSNMP
+	logger   *slog.Logger
+	adaptive *AdaptiveRepetitions
 }
 
 func NewGoSNMP(logger *slog.Logger, target, srcAddress string, debug bool) (*GoSNMPWrapper, error) {
@@ -70,15 +71,28 @@ func (g *GoSNMPWrapper) SetOptions(fns ...func(*gosnmp.GoSNMP)) {
 	}
 }
 
+// SetAdaptiveRepetitions makes walks adapt the max repetitions to what the
+// target handles, or stops them from doing so if a is nil.
+func (g *GoSNMPWrapper) SetAdaptiveRepetitions(a *AdaptiveRepetitions) {
+	g.adaptive = a
+}
+
+// SetLogger makes the session log to logger, such as once it is reused for
+// another scrape. The packets are still logged to the logger the session was
+// created with, if debugged.
+func (g *GoSNMPWrapper) SetLogger(logger *slog.Logger) {
+	g.logger = logger
+}
+
 func (g *GoSNMPWrapper) Connect() error {
 	st := time.Now()
 	err := g.c.Connect()
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
-			return fmt.Errorf("scrape cancelled after %s (possible timeout) connecting to target %s",
-				time.Since(st), g.c.Target)
+			return &Error{Reason: ReasonTimeout, Err: fmt.Errorf("scrape cancelled after %s (possible timeout) connecting to target %s",
+				time.Since(st), g.c.Target)}
 		}
-		return fmt.Errorf("error connecting to target %s: %w", g.c.Target, err)
+		return &Error{Reason: ClassifyError(err), Err: fmt.Errorf("error connecting to target %s: %w", g.c.Target, err)}
 	}
 	return nil
 }
@@ -93,10 +107,10 @@ func (g *GoSNMPWrapper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
 	results, err := g.c.Get(oids)
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
-			err = fmt.Errorf("scrape cancelled after %s (possible timeout) getting target %s",
-				time.Since(st), g.c.Target)
+			err = &Error{Reason: ReasonTimeout, Err: fmt.Errorf("scrape cancelled after %s (possible timeout) getting target %s",
+				time.Since(st), g.c.Target)}
 		} else {
-			err = fmt.Errorf("error getting target %s: %w", g.c.Target, err)
+			err = &Error{Reason: ClassifyError(err), Err: fmt.Errorf("error getting target %s: %w", g.c.Target, err)}
 		}
 		return results, err
 	}
@@ -109,20 +123,60 @@ func (g *GoSNMPWrapper) WalkAll(oid string) ([]gosnmp.SnmpPDU, error) {
 	var err error
 	g.logger.Debug("Walking subtree", "oid", oid)
 	st := time.Now()
-	if g.c.Version == gosnmp.Version1 {
+	switch {
+	case g.c.Version == gosnmp.Version1:
 		results, err = g.c.WalkAll(oid)
-	} else {
+	case g.adaptive != nil:
+		ctx := g.c.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		_, allowNonIncreasing := g.c.AppOpts["c"]
+		results, err = adaptiveWalk(ctx, g.c, oid, g.c.MaxRepetitions, !allowNonIncreasing, g.adaptive)
+	default:
 		results, err = g.c.BulkWalkAll(oid)
 	}
 	if err != nil {
-		if errors.Is(err, context.Canceled) {
-			err = fmt.Errorf("scrape canceled after %s (possible timeout) walking target %s",
-				time.Since(st), g.c.Target)
-		} else {
-			err = fmt.Errorf("error walking target %s: %w", g.c.Target, err)
-		}
-		return results, err
+		return results, g.walkError(err, st)
 	}
 	g.logger.Debug("Walk of subtree completed", "oid", oid, "duration_seconds", time.Since(st))
 	return results, err
 }
+
+// Walk walks oid like WalkAll, but passes each PDU to fn as it is received
+// rather than collecting them. An error returned by fn ends the walk.
+func (g *GoSNMPWrapper) Walk(oid string, fn func(gosnmp.SnmpPDU) error) error {
+	var err error
+	g.logger.Debug("Walking subtree", "oid", oid)
+	st := time.Now()
+	switch {
+	case g.c.Version == gosnmp.Version1:
+		err = g.c.Walk(oid, fn)
+	case g.adaptive != nil:
+		// An adaptive walk may start over, so its PDUs are only passed on
+		// once it has finished.
+		var results []gosnmp.SnmpPDU
+		results, err = g.WalkAll(oid)
+		for _, pdu := range results {
+			if fnErr := fn(pdu); fnErr != nil {
+				return fnErr
+			}
+		}
+		return err
+	default:
+		err = g.c.BulkWalk(oid, fn)
+	}
+	if err != nil {
+		return g.walkError(err, st)
+	}
+	g.logger.Debug("Walk of subtree completed", "oid", oid, "duration_seconds", time.Since(st))
+	return nil
+}
+
+func (g *GoSNMPWrapper) walkError(err error, start time.Time) error {
+	if errors.Is(err, context.Canceled) {
+		return &Error{Reason: ReasonTimeout, Err: fmt.Errorf("scrape canceled after %s (possible timeout) walking target %s",
+			time.Since(start), g.c.Target)}
+	}
+	return &Error{Reason: Reason(err), Err: fmt.Errorf("error walking target %s: %w", g.c.Target, err)}
+}
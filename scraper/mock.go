@@ -14,6 +14,8 @@
 package scraper
 
 import (
+	"log/slog"
+
 	"github.com/gosnmp/gosnmp"
 )
 
@@ -31,6 +33,13 @@ type mockSNMPScraper struct {
 	WalkResponses map[string][]gosnmp.SnmpPDU
 	ConnectError  error
 	CloseError    error
+	// GetErrors and WalkErrors make a Get including, or a walk of, the
+	// given OID fail with the error.
+	GetErrors  map[string]error
+	WalkErrors map[string]error
+	// GetErrorStatuses makes a Get including the given OID return a
+	// response with the error status.
+	GetErrorStatuses map[string]gosnmp.SNMPError
 
 	callGet  []string
 	callWalk []string
@@ -45,6 +54,18 @@ func (m *mockSNMPScraper) CallWalk() []string {
 }
 
 func (m *mockSNMPScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	for _, oid := range oids {
+		if err, exists := m.GetErrors[oid]; exists {
+			m.callGet = append(m.callGet, oids...)
+			return nil, err
+		}
+	}
+	for _, oid := range oids {
+		if status, exists := m.GetErrorStatuses[oid]; exists {
+			m.callGet = append(m.callGet, oids...)
+			return &gosnmp.SnmpPacket{Error: status}, nil
+		}
+	}
 	pdus := make([]gosnmp.SnmpPDU, 0, len(oids))
 	for _, oid := range oids {
 		if response, exists := m.GetResponses[oid]; exists {
@@ -66,12 +87,25 @@ func (m *mockSNMPScraper) Get(oids []string) (*gosnmp.SnmpPacket, error) {
 
 func (m *mockSNMPScraper) WalkAll(baseOID string) ([]gosnmp.SnmpPDU, error) {
 	m.callWalk = append(m.callWalk, baseOID)
+	if err, exists := m.WalkErrors[baseOID]; exists {
+		return m.WalkResponses[baseOID], err
+	}
 	if pdus, exists := m.WalkResponses[baseOID]; exists {
 		return pdus, nil
 	}
 	return nil, nil
 }
 
+func (m *mockSNMPScraper) Walk(baseOID string, fn func(gosnmp.SnmpPDU) error) error {
+	pdus, err := m.WalkAll(baseOID)
+	for _, pdu := range pdus {
+		if err := fn(pdu); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
 func (m *mockSNMPScraper) Connect() error {
 	return m.ConnectError
 }
@@ -82,3 +116,9 @@ func (m *mockSNMPScraper) Close() error {
 
 func (m *mockSNMPScraper) SetOptions(...func(*gosnmp.GoSNMP)) {
 }
+
+func (m *mockSNMPScraper) SetAdaptiveRepetitions(*AdaptiveRepetitions) {
+}
+
+func (m *mockSNMPScraper) SetLogger(*slog.Logger) {
+}
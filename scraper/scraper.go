@@ -14,13 +14,18 @@
 package scraper
 
 import (
+	"log/slog"
+
 	"github.com/gosnmp/gosnmp"
 )
 
 type SNMPScraper interface {
 	Get([]string) (*gosnmp.SnmpPacket, error)
 	WalkAll(string) ([]gosnmp.SnmpPDU, error)
+	Walk(string, func(gosnmp.SnmpPDU) error) error
 	Connect() error
 	Close() error
 	SetOptions(...func(*gosnmp.GoSNMP))
+	SetAdaptiveRepetitions(*AdaptiveRepetitions)
+	SetLogger(*slog.Logger)
 }
@@ -0,0 +1,108 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/prometheus/snmp_exporter/config"
+	"github.com/prometheus/snmp_exporter/trap"
+)
+
+var (
+	trapListenAddress = kingpin.Flag("snmp.trap-listen-address", "UDP address on which to receive SNMP traps and informs. Empty disables the trap receiver.").Default("").String()
+	trapAuths         = kingpin.Flag("snmp.trap-auth", "Auth accepted for SNMP traps and informs. Can be repeated.").Default("public_v2").Strings()
+	trapMaxSeries     = kingpin.Flag("snmp.trap-max-series", "Maximum number of source and trap OID combinations the trap metrics are labelled with. Traps of further combinations are rejected. 0 means no limit.").Default("0").Int()
+)
+
+// startTrapReceiver starts receiving traps, if enabled. The auths are looked
+// up in the current configuration and their secrets loaded again by the
+// receiver, so that rotated secrets are picked up. Trap definitions are
+// looked up for every trap.
+func startTrapReceiver(logger *slog.Logger) error {
+	if *trapListenAddress == "" {
+		return nil
+	}
+	auths := func() ([]*config.Auth, error) {
+		sc.mu.RLock()
+		auths := make([]*config.Auth, 0, len(*trapAuths))
+		for _, name := range *trapAuths {
+			auth, ok := sc.C.Auths[name]
+			if !ok {
+				sc.mu.RUnlock()
+				return nil, fmt.Errorf("unknown trap auth %q", name)
+			}
+			auths = append(auths, auth)
+		}
+		sc.mu.RUnlock()
+		for i, name := range *trapAuths {
+			auth, err := loadSecrets(context.Background(), name, auths[i])
+			if err != nil {
+				return nil, err
+			}
+			auths[i] = auth
+		}
+		return auths, nil
+	}
+
+	definitions := func(oid string) (string, *config.TrapDefinition) {
+		sc.mu.RLock()
+		defer sc.mu.RUnlock()
+		return sc.C.TrapDefinition(oid)
+	}
+	logger = logger.With("component", "trap_receiver")
+	r, err := trap.NewReceiver(auths, definitions, logger, trap.Metrics{
+		Received: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "traps_received_total",
+				Help:      "Number of SNMP traps and informs received.",
+			},
+			[]string{"source", "trap_oid", "trap"},
+		),
+		LastReceived: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "trap_last_received_timestamp_seconds",
+				Help:      "Unix time the last SNMP trap or inform was received.",
+			},
+			[]string{"source", "trap_oid", "trap"},
+		),
+		Rejected: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "traps_rejected_total",
+				Help:      "Number of SNMP traps and informs that were rejected.",
+			},
+			[]string{"reason"},
+		),
+		MaxSeries: *trapMaxSeries,
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		logger.Info("Listening for traps", "address", *trapListenAddress)
+		if err := r.Listen(*trapListenAddress); err != nil {
+			logger.Error("Error receiving traps", "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,363 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package trap receives SNMP traps and informs, and counts them.
+package trap
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const (
+	// snmpTrapOID.0, the varbind of a v2c or v3 notification that carries
+	// its OID.
+	snmpTrapOID = "1.3.6.1.6.3.1.1.4.1.0"
+	// sysUpTime.0, the first varbind of a v2c or v3 notification.
+	sysUpTime = "1.3.6.1.2.1.1.3.0"
+	// snmpTraps, under which the generic v1 traps are mapped to v2c OIDs as
+	// per RFC 3584.
+	snmpTraps = "1.3.6.1.6.3.1.1.5"
+)
+
+// Metrics of the trap receiver. Received and LastReceived are labelled by
+// source, trap_oid and trap.
+type Metrics struct {
+	Received     *prometheus.CounterVec
+	LastReceived *prometheus.GaugeVec
+	Rejected     *prometheus.CounterVec
+	// MaxSeries limits the number of label sets of Received and
+	// LastReceived, unless it is 0. Notifications that would exceed it are
+	// rejected.
+	MaxSeries int
+}
+
+// Definitions returns the name and definition of the notification with the
+// given OID, or nil if it is unknown.
+type Definitions func(oid string) (string, *config.TrapDefinition)
+
+// Auths returns the auths notifications are accepted with, with their
+// secrets loaded.
+type Auths func() ([]*config.Auth, error)
+
+// authCheckInterval is how often the secrets of the v3 auths are checked for
+// changes.
+var authCheckInterval = time.Minute
+
+// Receiver listens for traps and informs, and counts them per source and
+// trap OID.
+type Receiver struct {
+	auths       Auths
+	definitions Definitions
+	logger      *slog.Logger
+	metrics     Metrics
+	listening   chan bool
+	done        chan struct{}
+	closeOnce   sync.Once
+
+	// The v3 auths the listener authenticates notifications with.
+	users []config.Auth
+
+	mu sync.Mutex
+	// The communities of the last auths that were loaded.
+	communities map[string]bool
+	// The label sets notifications were counted with, if they are limited.
+	series map[[3]string]bool
+}
+
+// NewReceiver returns a receiver that accepts v1 and v2c notifications with
+// the communities of the auths, and v3 notifications from their users. The
+// auths are loaded again every authCheckInterval, so that rotated
+// communities and users are picked up.
+func NewReceiver(auths Auths, definitions Definitions, logger *slog.Logger, metrics Metrics) (*Receiver, error) {
+	r := &Receiver{
+		auths:       auths,
+		definitions: definitions,
+		logger:      logger,
+		metrics:     metrics,
+		listening:   make(chan bool, 1),
+		done:        make(chan struct{}),
+		series:      make(map[[3]string]bool),
+	}
+	loaded, err := auths()
+	if err != nil {
+		return nil, err
+	}
+	r.communities, r.users = split(loaded)
+	// Check the users before listening.
+	if _, err := r.newListener(r.users); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// split returns the communities of the v1 and v2c auths, and the v3 auths.
+func split(auths []*config.Auth) (map[string]bool, []config.Auth) {
+	communities := make(map[string]bool)
+	var users []config.Auth
+	for _, auth := range auths {
+		if auth.Version != 3 {
+			communities[string(auth.Community)] = true
+		} else {
+			users = append(users, *auth)
+		}
+	}
+	return communities, users
+}
+
+// newListener returns a listener that authenticates v3 notifications from
+// the users.
+func (r *Receiver) newListener(users []config.Auth) (*gosnmp.TrapListener, error) {
+	gosnmpLogger := gosnmp.NewLogger(slog.NewLogLogger(r.logger.Handler(), slog.LevelDebug))
+	table := gosnmp.NewSnmpV3SecurityParametersTable(gosnmpLogger)
+	for _, auth := range users {
+		g := &gosnmp.GoSNMP{}
+		auth.ConfigureSNMP(g, "")
+		if err := table.Add(auth.Username, g.SecurityParameters); err != nil {
+			return nil, fmt.Errorf("error adding user %q: %w", auth.Username, err)
+		}
+	}
+	l := gosnmp.NewTrapListener()
+	// Authentication of v3 notifications requires the listener to be v3.
+	// Notifications of other versions are decoded as sent.
+	l.Params = &gosnmp.GoSNMP{
+		Version:                     gosnmp.Version3,
+		TrapSecurityParametersTable: table,
+		Logger:                      gosnmpLogger,
+	}
+	l.OnNewTrap = r.handle
+	return l, nil
+}
+
+// Listen listens for notifications on the UDP address until Close is called.
+// Once the secrets of the users change, the listener is replaced by one that
+// authenticates them with the new secrets.
+func (r *Receiver) Listen(addr string) error {
+	ticker := time.NewTicker(authCheckInterval)
+	defer ticker.Stop()
+	l, err := r.newListener(r.users)
+	if err != nil {
+		return err
+	}
+	for {
+		listenErr := make(chan error, 1)
+		go func() {
+			listenErr <- l.Listen(addr)
+		}()
+		select {
+		case err := <-listenErr:
+			return err
+		case <-l.Listening():
+		}
+		select {
+		case r.listening <- true:
+		default:
+		}
+		var next *gosnmp.TrapListener
+		for next == nil {
+			select {
+			case err := <-listenErr:
+				return err
+			case <-r.done:
+				l.Close()
+				return <-listenErr
+			case <-ticker.C:
+				next = r.reloadUsers()
+			}
+		}
+		// The listener is only closed once it listens, as gosnmp does not
+		// return from listening otherwise.
+		l.Close()
+		if err := <-listenErr; err != nil {
+			return err
+		}
+		l = next
+	}
+}
+
+// reloadUsers loads the auths, keeps their communities, and returns a
+// listener for the v3 ones if they changed. On failure, the previous auths
+// are kept.
+func (r *Receiver) reloadUsers() *gosnmp.TrapListener {
+	loaded, err := r.auths()
+	if err != nil {
+		r.logger.Error("Error loading trap auths, keeping the previous ones", "err", err)
+		return nil
+	}
+	communities, users := split(loaded)
+	r.mu.Lock()
+	r.communities = communities
+	r.mu.Unlock()
+	if slices.Equal(users, r.users) {
+		return nil
+	}
+	l, err := r.newListener(users)
+	if err != nil {
+		r.logger.Error("Error adding the changed trap auths, keeping the previous ones", "err", err)
+		return nil
+	}
+	r.logger.Info("Secrets of the trap auths changed, listening with the new secrets")
+	r.users = users
+	return l
+}
+
+// Listening is signaled once the receiver listens.
+func (r *Receiver) Listening() <-chan bool {
+	return r.listening
+}
+
+// Close stops listening.
+func (r *Receiver) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
+
+// accepts reports whether the community is one of the auths, as of when they
+// were last loaded.
+func (r *Receiver) accepts(community string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.communities[community]
+}
+
+// counts reports whether a notification is counted with the labels, which it
+// is unless that exceeds the series limit.
+func (r *Receiver) counts(labels [3]string) bool {
+	if r.metrics.MaxSeries == 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.series[labels] {
+		return true
+	}
+	if len(r.series) >= r.metrics.MaxSeries {
+		return false
+	}
+	r.series[labels] = true
+	return true
+}
+
+func (r *Receiver) handle(packet *gosnmp.SnmpPacket, addr *net.UDPAddr) {
+	source := addr.IP.String()
+	if packet.Version != gosnmp.Version3 && !r.accepts(packet.Community) {
+		r.metrics.Rejected.WithLabelValues("unknown_community").Inc()
+		r.logger.Debug("Rejected notification with unknown community", "source", source)
+		return
+	}
+	oid, ok := trapOID(packet)
+	if !ok {
+		r.metrics.Rejected.WithLabelValues("no_trap_oid").Inc()
+		r.logger.Debug("Rejected notification without snmpTrapOID", "source", source)
+		return
+	}
+	name, def := r.definitions(oid)
+	if !r.counts([3]string{source, oid, name}) {
+		r.metrics.Rejected.WithLabelValues("series_limit").Inc()
+		r.logger.Debug("Rejected notification over the series limit", "source", source, "trap_oid", oid)
+		return
+	}
+	r.metrics.Received.WithLabelValues(source, oid, name).Inc()
+	r.metrics.LastReceived.WithLabelValues(source, oid, name).SetToCurrentTime()
+
+	attrs := []any{"source", source, "trap_oid", oid}
+	if name != "" {
+		attrs = append(attrs, "trap", name)
+	}
+	for _, v := range packet.Variables {
+		vbOID := strings.TrimPrefix(v.Name, ".")
+		if vbOID == sysUpTime || vbOID == snmpTrapOID {
+			continue
+		}
+		attrs = append(attrs, varbindName(vbOID, def), varbindValue(v))
+	}
+	if packet.PDUType == gosnmp.InformRequest {
+		r.logger.Info("Received inform", attrs...)
+	} else {
+		r.logger.Info("Received trap", attrs...)
+	}
+}
+
+// trapOID returns the OID of a notification. v1 traps are mapped to their v2c
+// OID as per RFC 3584.
+func trapOID(packet *gosnmp.SnmpPacket) (string, bool) {
+	if packet.PDUType == gosnmp.Trap {
+		if packet.GenericTrap < 6 {
+			return fmt.Sprintf("%s.%d", snmpTraps, packet.GenericTrap+1), true
+		}
+		return fmt.Sprintf("%s.0.%d", strings.TrimPrefix(packet.Enterprise, "."), packet.SpecificTrap), true
+	}
+	for _, v := range packet.Variables {
+		if strings.TrimPrefix(v.Name, ".") != snmpTrapOID {
+			continue
+		}
+		if oid, ok := v.Value.(string); ok {
+			return strings.TrimPrefix(oid, "."), true
+		}
+	}
+	return "", false
+}
+
+// varbindName names a varbind after the object of the definition it is an
+// instance of, followed by the index. Varbinds that are not objects of the
+// definition keep their OID.
+func varbindName(oid string, def *config.TrapDefinition) string {
+	if def == nil {
+		return oid
+	}
+	for _, o := range def.Objects {
+		if oid == o.Oid {
+			return o.Name
+		}
+		if index, ok := strings.CutPrefix(oid, o.Oid+"."); ok {
+			return o.Name + "." + index
+		}
+	}
+	return oid
+}
+
+// varbindValue formats the value of a varbind for logging. Values that do
+// not have the Go type of their SNMP type are formatted as is.
+func varbindValue(v gosnmp.SnmpPDU) string {
+	switch v.Type {
+	case gosnmp.OctetString:
+		b, ok := v.Value.([]byte)
+		if !ok {
+			break
+		}
+		for _, c := range b {
+			if c < 0x20 || c > 0x7e {
+				return fmt.Sprintf("0x%X", b)
+			}
+		}
+		return string(b)
+	case gosnmp.ObjectIdentifier, gosnmp.IPAddress:
+		if s, ok := v.Value.(string); ok {
+			return strings.TrimPrefix(s, ".")
+		}
+	case gosnmp.TimeTicks:
+		return (time.Duration(gosnmp.ToBigInt(v.Value).Int64()) * 10 * time.Millisecond).String()
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.Counter64, gosnmp.Uinteger32:
+		return gosnmp.ToBigInt(v.Value).String()
+	}
+	return fmt.Sprint(v.Value)
+}
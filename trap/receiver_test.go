@@ -0,0 +1,316 @@
+// Copyright The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trap
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+const linkDown = "1.3.6.1.6.3.1.1.5.3"
+
+func newTestMetrics() Metrics {
+	return Metrics{
+		Received:     prometheus.NewCounterVec(prometheus.CounterOpts{Name: "received"}, []string{"source", "trap_oid", "trap"}),
+		LastReceived: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "last_received"}, []string{"source", "trap_oid", "trap"}),
+		Rejected:     prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rejected"}, []string{"reason"}),
+	}
+}
+
+// freePort returns a UDP port on loopback that is not in use.
+func freePort(t *testing.T) uint16 {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestReceiver(t *testing.T) {
+	definitions := func(oid string) (string, *config.TrapDefinition) {
+		if oid != linkDown {
+			return "", nil
+		}
+		return "linkDown", &config.TrapDefinition{Oid: linkDown, Objects: []*config.TrapObject{{Name: "ifIndex", Oid: "1.3.6.1.2.1.2.2.1.1"}}}
+	}
+	auths := []*config.Auth{
+		{Version: 2, Community: "public"},
+		{Version: 3, SecurityLevel: "authNoPriv", Username: "trapper", Password: "trapper-password", AuthProtocol: "SHA"},
+	}
+	metrics := newTestMetrics()
+	r, err := NewReceiver(func() ([]*config.Auth, error) { return auths, nil }, definitions, promslog.NewNopLogger(), metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	go r.Listen(net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	defer r.Close()
+	select {
+	case <-r.Listening():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Receiver did not start listening")
+	}
+
+	v2Trap := gosnmp.SnmpTrap{Variables: []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(100)},
+		{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: gosnmp.ObjectIdentifier, Value: "." + linkDown},
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: gosnmp.Integer, Value: 3},
+	}}
+	send := func(g *gosnmp.GoSNMP, trap gosnmp.SnmpTrap) {
+		t.Helper()
+		g.Target = "127.0.0.1"
+		g.Port = port
+		g.Timeout = 2 * time.Second
+		if err := g.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Conn.Close()
+		if _, err := g.SendTrap(trap); err != nil {
+			t.Fatalf("Error sending trap: %v", err)
+		}
+	}
+
+	send(&gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "public"}, v2Trap)
+	// An inform is only answered once it has been handled.
+	inform := v2Trap
+	inform.IsInform = true
+	send(&gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "public"}, inform)
+	send(&gosnmp.GoSNMP{Version: gosnmp.Version1, Community: "public"}, gosnmp.SnmpTrap{
+		Enterprise:   ".1.3.6.1.4.1.8072",
+		AgentAddress: "127.0.0.1",
+		GenericTrap:  2,
+		Variables:    []gosnmp.SnmpPDU{{Name: ".1.3.6.1.2.1.2.2.1.1.4", Type: gosnmp.Integer, Value: 4}},
+	})
+	send(&gosnmp.GoSNMP{Version: gosnmp.Version1, Community: "public"}, gosnmp.SnmpTrap{
+		Enterprise:   ".1.3.6.1.4.1.8072",
+		AgentAddress: "127.0.0.1",
+		GenericTrap:  6,
+		SpecificTrap: 42,
+	})
+	send(&gosnmp.GoSNMP{
+		Version:       gosnmp.Version3,
+		SecurityModel: gosnmp.UserSecurityModel,
+		MsgFlags:      gosnmp.AuthNoPriv,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			UserName:                 "trapper",
+			AuthenticationProtocol:   gosnmp.SHA,
+			AuthenticationPassphrase: "trapper-password",
+			AuthoritativeEngineID:    "\x80\x00\x1f\x88\x80trapsender",
+			AuthoritativeEngineBoots: 1,
+			AuthoritativeEngineTime:  1,
+		},
+	}, v2Trap)
+	send(&gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "private"}, v2Trap)
+
+	// Traps are not answered, so wait for the last one to be handled.
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(metrics.Rejected.WithLabelValues("unknown_community")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the traps")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, c := range []struct {
+		oid, name string
+		count     float64
+	}{
+		{linkDown, "linkDown", 4},
+		{"1.3.6.1.4.1.8072.0.42", "", 1},
+	} {
+		if got := testutil.ToFloat64(metrics.Received.WithLabelValues("127.0.0.1", c.oid, c.name)); got != c.count {
+			t.Errorf("Expected %v traps with OID %s, got %v", c.count, c.oid, got)
+		}
+		if got := testutil.ToFloat64(metrics.LastReceived.WithLabelValues("127.0.0.1", c.oid, c.name)); got < float64(time.Now().Add(-time.Minute).Unix()) {
+			t.Errorf("Expected a recent last received timestamp for OID %s, got %v", c.oid, got)
+		}
+	}
+}
+
+func TestReceiverSecretChanges(t *testing.T) {
+	interval := authCheckInterval
+	authCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { authCheckInterval = interval })
+	var (
+		mu    sync.Mutex
+		auths = []*config.Auth{
+			{Version: 2, Community: "old"},
+			{Version: 3, SecurityLevel: "authNoPriv", Username: "trapper", Password: "old-password", AuthProtocol: "SHA"},
+		}
+	)
+	loadAuths := func() ([]*config.Auth, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return auths, nil
+	}
+	definitions := func(string) (string, *config.TrapDefinition) { return "", nil }
+	metrics := newTestMetrics()
+	r, err := NewReceiver(loadAuths, definitions, promslog.NewNopLogger(), metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	go r.Listen(net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	defer r.Close()
+	select {
+	case <-r.Listening():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Receiver did not start listening")
+	}
+
+	trap := gosnmp.SnmpTrap{Variables: []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: gosnmp.ObjectIdentifier, Value: "." + linkDown},
+	}}
+	// Sends may fail while the listener is replaced, so the notifications
+	// are sent until they are counted.
+	send := func(g *gosnmp.GoSNMP) {
+		t.Helper()
+		g.Target = "127.0.0.1"
+		g.Port = port
+		g.Timeout = time.Second
+		if err := g.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		defer g.Conn.Close()
+		g.SendTrap(trap)
+	}
+	v3 := func(password string) *gosnmp.GoSNMP {
+		return &gosnmp.GoSNMP{
+			Version:       gosnmp.Version3,
+			SecurityModel: gosnmp.UserSecurityModel,
+			MsgFlags:      gosnmp.AuthNoPriv,
+			SecurityParameters: &gosnmp.UsmSecurityParameters{
+				UserName:                 "trapper",
+				AuthenticationProtocol:   gosnmp.SHA,
+				AuthenticationPassphrase: password,
+				AuthoritativeEngineID:    "\x80\x00\x1f\x88\x80trapsender",
+				AuthoritativeEngineBoots: 1,
+				AuthoritativeEngineTime:  1,
+			},
+		}
+	}
+	received := metrics.Received.WithLabelValues("127.0.0.1", linkDown, "")
+	rejected := metrics.Rejected.WithLabelValues("unknown_community")
+	// waitFor sends traps with g until count reaches n.
+	waitFor := func(count prometheus.Counter, n float64, g func() *gosnmp.GoSNMP) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(count) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %v notifications, got %v", n, testutil.ToFloat64(count))
+			}
+			send(g())
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	mu.Lock()
+	auths = []*config.Auth{
+		{Version: 2, Community: "new"},
+		{Version: 3, SecurityLevel: "authNoPriv", Username: "trapper", Password: "new-password", AuthProtocol: "SHA"},
+	}
+	mu.Unlock()
+
+	// Communities are picked up once the auths are checked again.
+	waitFor(rejected, 1, func() *gosnmp.GoSNMP { return &gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "old"} })
+	waitFor(received, 1, func() *gosnmp.GoSNMP { return &gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "new"} })
+
+	// Users are authenticated with their new secrets once they changed, and
+	// no longer with the old ones.
+	before := testutil.ToFloat64(received)
+	waitFor(received, before+1, func() *gosnmp.GoSNMP { return v3("new-password") })
+	before = testutil.ToFloat64(received)
+	send(v3("old-password"))
+	time.Sleep(100 * time.Millisecond)
+	if got := testutil.ToFloat64(received); got != before {
+		t.Errorf("Expected the notification with the old secret to be rejected, got %v notifications", got-before)
+	}
+}
+
+func TestReceiverMaxSeries(t *testing.T) {
+	metrics := newTestMetrics()
+	metrics.MaxSeries = 2
+	definitions := func(string) (string, *config.TrapDefinition) { return "", nil }
+	r, err := NewReceiver(func() ([]*config.Auth, error) { return []*config.Auth{{Version: 2, Community: "public"}}, nil }, definitions, promslog.NewNopLogger(), metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trap := func(oid string) *gosnmp.SnmpPacket {
+		return &gosnmp.SnmpPacket{Version: gosnmp.Version2c, Community: "public", PDUType: gosnmp.SNMPv2Trap, Variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: gosnmp.ObjectIdentifier, Value: "." + oid},
+		}}
+	}
+	source := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	for _, oid := range []string{linkDown, "1.3.6.1.4.1.8072.0.1", "1.3.6.1.4.1.8072.0.2", linkDown} {
+		r.handle(trap(oid), source)
+	}
+	if got := testutil.CollectAndCount(metrics.Received); got != 2 {
+		t.Errorf("Expected 2 series, got %d", got)
+	}
+	if got := testutil.ToFloat64(metrics.Received.WithLabelValues("127.0.0.1", linkDown, "")); got != 2 {
+		t.Errorf("Expected the notifications of a counted series to be counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.Rejected.WithLabelValues("series_limit")); got != 1 {
+		t.Errorf("Expected 1 notification over the series limit, got %v", got)
+	}
+}
+
+func TestVarbindValue(t *testing.T) {
+	for _, c := range []struct {
+		pdu  gosnmp.SnmpPDU
+		want string
+	}{
+		{gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte("eth0")}, "eth0"},
+		{gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte{0, 1}}, "0x0001"},
+		{gosnmp.SnmpPDU{Type: gosnmp.ObjectIdentifier, Value: ".1.3.6"}, "1.3.6"},
+		{gosnmp.SnmpPDU{Type: gosnmp.TimeTicks, Value: uint32(100)}, "1s"},
+		// Values of an unexpected Go type don't panic.
+		{gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: "eth0"}, "eth0"},
+		{gosnmp.SnmpPDU{Type: gosnmp.IPAddress, Value: nil}, "<nil>"},
+	} {
+		if got := varbindValue(c.pdu); got != c.want {
+			t.Errorf("varbindValue(%v): expected %s, got %s", c.pdu, c.want, got)
+		}
+	}
+}
+
+func TestVarbindName(t *testing.T) {
+	def := &config.TrapDefinition{Objects: []*config.TrapObject{
+		{Name: "ifIndex", Oid: "1.3.6.1.2.1.2.2.1.1"},
+		{Name: "ifAdminStatus", Oid: "1.3.6.1.2.1.2.2.1.7"},
+	}}
+	for oid, want := range map[string]string{
+		"1.3.6.1.2.1.2.2.1.1.3":  "ifIndex.3",
+		"1.3.6.1.2.1.2.2.1.7":    "ifAdminStatus",
+		"1.3.6.1.2.1.2.2.1.10.3": "1.3.6.1.2.1.2.2.1.10.3",
+	} {
+		if got := varbindName(oid, def); got != want {
+			t.Errorf("varbindName(%s): expected %s, got %s", oid, want, got)
+		}
+	}
+	if got := varbindName("1.3.6.1.2.1.2.2.1.1.3", nil); got != "1.3.6.1.2.1.2.2.1.1.3" {
+		t.Errorf("Expected the OID without a definition, got %s", got)
+	}
+}